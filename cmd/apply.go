@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+// ApplyCmd represents the apply command
+var ApplyCmd = &cobra.Command{
+	Use:   "apply -f <file>",
+	Short: "Create or update machines from a definition file",
+	Long: `Create or update machines from a YAML definition file, '-' reads the standard input.
+A missing machine is created and started, the differences with an existing one are reported and applied,
+they take effect at its next start. A file can define several machines separated by ---.
+
+  name: dev
+  distribution: ubuntu
+  release: jammy
+  cpu: 4
+  memory: 4G
+  disk: 30G
+  ports: [8080:80]
+  labels:
+    team: web
+  cloud_init:
+    packages: [git]
+
+The definition of an existing machine is exported by 'machina get <name> -o yaml'.
+`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		file, _ := cmd.Flags().GetString("filename")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		definitions, err := readDefinitions(file)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		failed := false
+		for _, definition := range definitions {
+			if err := apply(definition, dryRun); err != nil {
+				utils.Logger.Error(err)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func readDefinitions(file string) ([]*internal.MachineDefinition, error) {
+	var reader io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		reader = f
+	}
+	return internal.ReadDefinitions(reader)
+}
+
+func apply(definition *internal.MachineDefinition, dryRun bool) error {
+	if !internal.ListExistingMachines().Contains(definition.Name) {
+		fmt.Printf("machine %s created\n", definition.Name)
+		if dryRun {
+			return nil
+		}
+		machine, err := definition.Machine()
+		if err != nil {
+			return err
+		}
+		if err = machine.Create(); err != nil {
+			return err
+		}
+		return machine.Spawn()
+	}
+
+	machine, err := internal.FromFileSpec(definition.Name)
+	if err != nil {
+		return err
+	}
+	var changes []internal.DefinitionChange
+	if dryRun {
+		changes, err = definition.Diff(machine)
+	} else {
+		changes, err = machine.Apply(definition)
+	}
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		fmt.Printf("machine %s unchanged\n", machine.Name)
+		return nil
+	}
+	fmt.Printf("machine %s configured\n", machine.Name)
+	for _, change := range changes {
+		fmt.Printf("  %s\n", change)
+	}
+	if machine.IsActive() && !dryRun {
+		utils.Logger.Warnf("machine %s is %s, the changes take effect at its next start", machine.Name, machine.State())
+	}
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(ApplyCmd)
+	ApplyCmd.Flags().StringP("filename", "f", "", "Definition file, - for the standard input")
+	ApplyCmd.Flags().Bool("dry-run", false, "Report the changes without applying them")
+	ApplyCmd.MarkFlagRequired("filename")
+}
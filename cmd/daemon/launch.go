@@ -1,8 +1,8 @@
 package daemon
 
 import (
+	"fmt"
 	internal "github.com/efortin/machina/pkg"
-	"github.com/efortin/machina/utils"
 	"github.com/spf13/cobra"
 )
 
@@ -23,13 +23,14 @@ Launch a machine named ubuntu with 2 cpu and 2 go of ram:
 or with shorthand:
   machine launch -n ubuntu -m 2 -c 2
 `,
-	Run: func(cmd *cobra.Command, args []string) {
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
 		mname := cmd.Flag("name").Value.String()
 		machine, err := internal.FromFileSpec(mname)
 		if err != nil {
-			utils.Logger.Fatalf("Cannot start machine %s, the spec file wasn't found or it is not valid. error: %v", mname, err)
+			return fmt.Errorf("cannot start machine %s, the spec file wasn't found or it is not valid. error: %v", mname, err)
 		}
-		machine.Run()
+		return machine.Run()
 	},
 }
 
@@ -0,0 +1,53 @@
+package daemon
+
+import (
+	"os"
+	"testing"
+
+	internal "github.com/efortin/machina/pkg"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLaunchCmd(t *testing.T) {
+	dir := t.TempDir()
+	os.Setenv("VMCTLDIR", dir)
+	os.Setenv("TMPDIR", "")
+	defer os.Unsetenv("VMCTLDIR")
+	defer os.Unsetenv("TMPDIR")
+
+	driver := internal.NewFakeDriver()
+	driver.OnStart = internal.FakeGuest
+	defaultDriver := internal.DefaultDriver
+	internal.DefaultDriver = driver
+	defer func() { internal.DefaultDriver = defaultDriver }()
+
+	t.Run("should fail when the machine doesn't exist", func(t *testing.T) {
+		RootCmd.SetArgs([]string{"launch", "-n", "unknown"})
+
+		assert.Error(t, RootCmd.Execute())
+	})
+
+	t.Run("should run an existing machine until the guest stops", func(t *testing.T) {
+		distribution, _ := internal.NewDistribution("ubuntu", "focal", "arm64")
+		machine := &internal.Machine{
+			Name:         "primary",
+			Distribution: distribution,
+			Spec:         internal.MachineSpec{Cpu: 1, Ram: internal.GB},
+		}
+		internal.DirectoryCreateIfAbsent(machine.Distribution.ImageDirectory())
+		for _, path := range []string{distribution.InitRd().Path, distribution.Image().Path} {
+			assert.NoError(t, os.WriteFile(path, []byte(path), 0644))
+		}
+		// the header of an arm64 kernel
+		kernel := make([]byte, 64)
+		copy(kernel[56:], "ARM\x64")
+		assert.NoError(t, os.WriteFile(distribution.Kernel().Path, kernel, 0644))
+		assert.NoError(t, internal.GenerateMachinaKeypair())
+		machine.BaseDirectory()
+		machine.ExportMachineSpecification()
+		RootCmd.SetArgs([]string{"launch", "-n", "primary"})
+
+		assert.NoError(t, RootCmd.Execute())
+		assert.Len(t, driver.VMs(), 1)
+	})
+}
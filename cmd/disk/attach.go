@@ -0,0 +1,42 @@
+package disk
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// attachCmd represents the attach command
+var attachCmd = &cobra.Command{
+	Use:   "attach <machine> <disk>",
+	Short: "Attach a data disk to a machine",
+	Long: `Attach a disk of the machine, or a shared disk, at the next start of the machine.
+The data disks follow the root disk and the seed image in the order they were attached: /dev/vdc, /dev/vdd...
+Detaching a disk renames the following ones, mount them by UUID or label in the guest, like UUID=<uuid> /data ext4 defaults,nofail 0 2 in /etc/fstab.
+A shared disk can't be attached read-write to two running machines.`,
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Errorf("the configure machine %s can't be loaded: %v", args[0], err)
+			os.Exit(1)
+		}
+		readOnly, _ := cmd.Flags().GetBool("read-only")
+		if err = machine.AttachDisk(args[1], readOnly); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Disk %s attached to machine %s\n", args[1], machine.Name)
+		if machine.IsActive() {
+			fmt.Printf("Restart machine %s to use it\n", machine.Name)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(attachCmd)
+	attachCmd.Flags().Bool("read-only", false, "Attach the disk read only")
+}
@@ -0,0 +1,50 @@
+package disk
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// createCmd represents the create command
+var createCmd = &cobra.Command{
+	Use:   "create <name>",
+	Short: "Create an empty data disk",
+	Long: `Create an empty sparse disk image, a size without unit is in GB.
+The disk belongs to a machine with --machine, otherwise it's shared and can be attached to several machines.
+
+create a disk of 20 GB for the machine named builder:
+  machina disk create cache --size 20G --machine builder
+
+create a shared disk of 100 GB:
+  machina disk create datasets --size 100G
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		value, _ := cmd.Flags().GetString("size")
+		size, err := internal.ParseSize(value, internal.GB)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		var machine *internal.Machine
+		if name, _ := cmd.Flags().GetString("machine"); name != utils.Empty {
+			machine = &internal.Machine{Name: name}
+		}
+		path, err := internal.CreateDataDisk(args[0], size, machine)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Disk %s of %s created in %s\n", args[0], internal.FormatSize(size), path)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(createCmd)
+	createCmd.Flags().String("size", utils.Empty, "Size of the disk like 20G")
+	createCmd.Flags().StringP("machine", "m", utils.Empty, "Machine owning the disk, the disk is shared when empty")
+	createCmd.MarkFlagRequired("size")
+}
@@ -0,0 +1,37 @@
+package disk
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// detachCmd represents the detach command
+var detachCmd = &cobra.Command{
+	Use:       "detach <machine> <disk>",
+	Short:     "Detach a data disk from a machine",
+	Long:      "Detach a disk at the next start of the machine, the disk is kept. The disks attached after it get the previous device names.",
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Errorf("the configure machine %s can't be loaded: %v", args[0], err)
+			os.Exit(1)
+		}
+		if err = machine.DetachDisk(args[1]); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Disk %s detached from machine %s\n", args[1], machine.Name)
+		if machine.IsActive() {
+			fmt.Printf("Restart machine %s to release it\n", machine.Name)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(detachCmd)
+}
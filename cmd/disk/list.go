@@ -0,0 +1,38 @@
+package disk
+
+import (
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the data disks and the machines they're attached to",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		disks, err := internal.ListDataDisks()
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		t := tablewriter.NewWriter(os.Stdout)
+		t.SetHeader([]string{"name", "machine", "size", "attached to"})
+		for _, disk := range disks {
+			owner := disk.Machine
+			if owner == utils.Empty {
+				owner = "<shared>"
+			}
+			t.Append([]string{disk.Name, owner, internal.FormatSize(uint64(disk.Size)), strings.Join(disk.Attachments, ",")})
+		}
+		t.Render()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,11 @@
+package disk
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// RootCmd groups the commands managing the data disks of the machines
+var RootCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Manage the data disks attached to the machines",
+}
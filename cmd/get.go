@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// GetCmd represents the get command
+var GetCmd = &cobra.Command{
+	Use:       "get <name>",
+	Short:     "Export the definition of a machine",
+	Long:      "Export the definition of a machine in the format read by 'machina apply -f'.",
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactValidArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		definition, err := internal.DefinitionOf(machine)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		switch output, _ := cmd.Flags().GetString("output"); output {
+		case "yaml":
+			err = internal.EncodeDefinition(os.Stdout, definition)
+		default:
+			err = fmt.Errorf("unknown output format %s, expected yaml", output)
+		}
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(GetCmd)
+	GetCmd.Flags().StringP("output", "o", "yaml", "Output format, only yaml is supported")
+}
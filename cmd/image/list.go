@@ -0,0 +1,37 @@
+package image
+
+import (
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"time"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the downloaded images",
+	Long:  "List the downloaded images with their size, their download date and the number of machines created from them.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		images, err := internal.ListImages()
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		t := tablewriter.NewWriter(os.Stdout)
+		t.SetHeader([]string{"distribution", "release", "arch", "size", "downloaded", "machines"})
+		for _, image := range images {
+			d := image.Distribution
+			t.Append([]string{d.Kind(), d.Release(), d.Arch(), internal.HumanBytes(image.Size), image.DownloadedAt.Format(time.RFC3339), strconv.Itoa(len(image.Machines))})
+		}
+		t.Render()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+}
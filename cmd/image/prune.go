@@ -0,0 +1,41 @@
+package image
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete the images no machine uses and the leftovers of the downloads",
+	Long: `Delete the images no machine was created from, and the archives and interrupted downloads left in the cache.
+With --dry-run, the files are listed without being deleted.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		pruned, err := internal.PruneImages(dryRun)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		var total int64
+		for _, file := range pruned {
+			fmt.Printf("%s (%s)\n", file.Path, internal.HumanBytes(file.Size))
+			total += file.Size
+		}
+		if dryRun {
+			fmt.Printf("%s would be freed\n", internal.HumanBytes(total))
+		} else {
+			fmt.Printf("%s freed\n", internal.HumanBytes(total))
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(pruneCmd)
+	pruneCmd.Flags().Bool("dry-run", false, "List the files without deleting them")
+}
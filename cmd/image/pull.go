@@ -0,0 +1,55 @@
+package image
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+	"runtime"
+)
+
+// pullCmd represents the pull command
+var pullCmd = &cobra.Command{
+	Use:   "pull <release>",
+	Short: "Download the image of a release ahead of the creation of a machine",
+	Long: `Download, verify and unpack the kernel, the initrd and the image of a release.
+
+download the image of Ubuntu jammy:
+  machina image pull jammy
+
+download the image of Debian bookworm for amd64:
+  machina image pull bookworm --distribution debian --arch amd64
+`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		distribution, err := distributionOf(cmd, args[0])
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		if err = internal.DownloadDistro(distribution); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Image %s %s %s downloaded\n", distribution.Kind(), distribution.Release(), distribution.Arch())
+	},
+}
+
+// distributionOf returns the release of the distribution selected by the flags
+func distributionOf(cmd *cobra.Command, release string) (internal.Distribution, error) {
+	kind, _ := cmd.Flags().GetString("distribution")
+	arch, _ := cmd.Flags().GetString("arch")
+	return internal.NewDistribution(kind, release, arch)
+}
+
+// addDistributionFlags adds the flags selecting the distribution of a release
+func addDistributionFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("distribution", "d", internal.DefaultDistribution, fmt.Sprintf("Distribution, one of %v", internal.DistributionKinds()))
+	cmd.Flags().String("arch", runtime.GOARCH, "Architecture of the distribution: arm64 or amd64")
+}
+
+func init() {
+	RootCmd.AddCommand(pullCmd)
+	addDistributionFlags(pullCmd)
+}
@@ -0,0 +1,37 @@
+package image
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// rmCmd represents the rm command
+var rmCmd = &cobra.Command{
+	Use:   "rm <release>",
+	Short: "Delete the downloaded image of a release",
+	Long: `Delete the kernel, the initrd and the image of a release.
+An image used by machines is only deleted with --force, it's downloaded again when they start.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		distribution, err := distributionOf(cmd, args[0])
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		force, _ := cmd.Flags().GetBool("force")
+		if err = internal.RemoveImage(distribution, force); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Image %s %s %s deleted\n", distribution.Kind(), distribution.Release(), distribution.Arch())
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rmCmd)
+	addDistributionFlags(rmCmd)
+	rmCmd.Flags().BoolP("force", "f", false, "Delete the image even if machines use it")
+}
@@ -0,0 +1,11 @@
+package image
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// RootCmd groups the commands managing the downloaded distribution images
+var RootCmd = &cobra.Command{
+	Use:   "image",
+	Short: "Manage the downloaded distribution images",
+}
@@ -0,0 +1,40 @@
+package image
+
+import (
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Check the cached images against their recorded checksums",
+	Long: `Check every cached kernel, initrd and image against the checksum recorded once its download was verified.
+A corrupted artifact must be deleted to be downloaded again, the command exits with 1 when there is one.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		verifications, err := internal.VerifyImageCache()
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		corrupted := false
+		t := tablewriter.NewWriter(os.Stdout)
+		t.SetHeader([]string{"path", "status"})
+		for _, verification := range verifications {
+			t.Append([]string{verification.Path, verification.Status})
+			corrupted = corrupted || verification.Status == internal.Artifact_corrupted
+		}
+		t.Render()
+		if corrupted {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+}
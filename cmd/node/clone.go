@@ -0,0 +1,42 @@
+package node
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// cloneCmd represents the clone command
+var cloneCmd = &cobra.Command{
+	Use:   "clone <source> <name>",
+	Short: "Create a machine from a copy of the disk of another one",
+	Long: `Create a machine with a copy-on-write copy of the disk, the kernel and the initrd of the source machine.
+The copy gets its own MAC address, its hostname, machine id and ssh host keys are regenerated at its first start.
+A running source machine is paused while its disk is copied, the host ports it forwards aren't forwarded by the copy.
+
+fork a configured machine into two:
+  machina node clone dev dev-1
+  machina node clone dev dev-2
+`,
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		source, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		clone, err := source.Clone(args[1])
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Machine %s cloned from %s, start it with 'machina node start %s'\n", clone.Name, source.Name, clone.Name)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cloneCmd)
+}
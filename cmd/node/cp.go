@@ -0,0 +1,43 @@
+package node
+
+import (
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// cpCmd represents the cp command
+var cpCmd = &cobra.Command{
+	Use:   "cp <source> <destination>",
+	Short: "Copy files between the host and a machine",
+	Long: `Copy files and directories between the host and a machine over sftp, like docker cp.
+The path in the machine is written <name>:<path>, a relative path starts at the home of the user.
+Directories are copied recursively, the modes are kept and a file is only replaced once fully copied.
+
+copy a file in the /tmp directory of the machine named ubuntu:
+  machina node cp ./file ubuntu:/tmp
+
+copy a log file of the machine in the current directory:
+  machina node cp ubuntu:/var/log/cloud-init.log .
+
+copy the content of the src directory in /srv:
+  machina node cp src/. ubuntu:/srv
+`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		options := internal.CopyOptions{}
+		if quiet, _ := cmd.Flags().GetBool("quiet"); !quiet && internal.IsTerminal(os.Stderr) {
+			options.Progress = os.Stderr
+		}
+		if err := internal.Copy(args[0], args[1], options); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cpCmd)
+	cpCmd.Flags().BoolP("quiet", "q", false, "Don't report the progress of the large files")
+}
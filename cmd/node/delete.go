@@ -0,0 +1,90 @@
+package node
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// deleteCmd represents the delete command
+var deleteCmd = &cobra.Command{
+	Use:   "delete [name...]",
+	Short: "Delete machines with their disk, console logs and state",
+	Long: `Delete machines with their disk, console logs and state.
+A running machine is only deleted with --force, it is stopped first.
+
+delete the machines named ubuntu and debian:
+  machina node delete ubuntu debian
+
+delete every stopped machine:
+  machina node delete --all-stopped
+`,
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args: func(cmd *cobra.Command, args []string) error {
+		allStopped, _ := cmd.Flags().GetBool("all-stopped")
+		if allStopped && len(args) > 0 {
+			return fmt.Errorf("--all-stopped doesn't accept machine names")
+		}
+		if !allStopped && len(args) == 0 {
+			return fmt.Errorf("requires at least one machine name or --all-stopped")
+		}
+		return cobra.OnlyValidArgs(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		names := args
+		if allStopped, _ := cmd.Flags().GetBool("all-stopped"); allStopped {
+			names = stoppedMachines()
+		}
+
+		failed := false
+		for _, machineName := range names {
+			if err := deleteMachine(machineName, force); err != nil {
+				utils.Logger.Error(err)
+				failed = true
+			} else {
+				utils.Logger.Infof("Machine %s deleted", machineName)
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(deleteCmd)
+	deleteCmd.Flags().BoolP("force", "f", false, "Stop running machines before deleting them")
+	deleteCmd.Flags().Bool("all-stopped", false, "Delete every stopped or failed machine")
+}
+
+// stoppedMachines returns the stopped and the failed machines, the ones being created are left alone
+func stoppedMachines() (names []string) {
+	for _, machineName := range internal.ListExistingMachines().List() {
+		machine := &internal.Machine{Name: machineName}
+		if state := machine.State(); state == internal.Machine_state_stop || state == internal.Machine_state_failed {
+			names = append(names, machineName)
+		}
+	}
+	return
+}
+
+func deleteMachine(machineName string, force bool) error {
+	machine, err := internal.FromFileSpec(machineName)
+	if err != nil {
+		// a machine with a broken spec can still be deleted
+		machine = &internal.Machine{Name: machineName}
+	}
+	if machine.IsActive() {
+		if !force {
+			return fmt.Errorf("the machine %s is %s, use --force to stop and delete it", machineName, machine.State())
+		}
+		// the disk is deleted right after, no need to stop the guest gracefully
+		if _, err = machine.Stop(internal.StopOptions{Force: true}); err != nil {
+			return err
+		}
+	}
+	return machine.Delete()
+}
@@ -0,0 +1,57 @@
+package node
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// diskCmd groups the commands managing the root disk of a machine
+var diskCmd = &cobra.Command{
+	Use:   "disk",
+	Short: "Manage the root disk of a machine",
+}
+
+// diskResizeCmd represents the disk resize command
+var diskResizeCmd = &cobra.Command{
+	Use:   "resize <name> <size>",
+	Short: "Grow the root disk of a machine",
+	Long: `Grow the root disk of a machine to a size like 60G, a disk without unit is in GB and it is never shrunk.
+The partition and the filesystem of / are grown at the next start of the machine,
+or right away over ssh when the running guest already sees the new size.
+
+grow the disk of the machine named ubuntu to 60 GB:
+  machina node disk resize ubuntu 60G
+`,
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Errorf("the configure machine %s can't be loaded: %v", args[0], err)
+			os.Exit(1)
+		}
+		size, err := internal.ParseSize(args[1], internal.GB)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		applied, err := machine.ResizeDisk(size)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		if applied {
+			fmt.Printf("The disk of machine %s is grown to %s\n", machine.Name, internal.FormatSize(size))
+		} else {
+			fmt.Printf("The disk of machine %s is grown to %s, its filesystem is grown at its next start\n", machine.Name, internal.FormatSize(size))
+		}
+	},
+}
+
+func init() {
+	diskCmd.AddCommand(diskResizeCmd)
+	RootCmd.AddCommand(diskCmd)
+}
@@ -0,0 +1,59 @@
+package node
+
+import (
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// execCmd represents the exec command
+var execCmd = &cobra.Command{
+	Use:   "exec <name> -- <command...>",
+	Short: "Run a command on a machine for scripting",
+	Long: `Run a command on a machine over ssh without terminal.
+stdout and stderr are streamed separately, stdin is forwarded when it is piped
+and the exit status is the one of the remote command.
+
+list the root directory of the machine named ubuntu:
+  machina node exec ubuntu -- ls -la /
+
+run a script from the host in /srv with a variable:
+  machina node exec ubuntu --workdir /srv --env MODE=test -- sh < script.sh
+`,
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		machineName := args[0]
+		machine, err := internal.FromFileSpec(machineName)
+		if err != nil {
+			utils.Logger.Errorf("the configure machine %s can't be loaded: %v", machineName, err)
+			os.Exit(255)
+		}
+
+		options := internal.ExecOptions{
+			Stdout: os.Stdout,
+			Stderr: os.Stderr,
+		}
+		options.User, _ = cmd.Flags().GetString("user")
+		options.Env, _ = cmd.Flags().GetStringArray("env")
+		options.WorkDir, _ = cmd.Flags().GetString("workdir")
+		if !internal.IsTerminal(os.Stdin) {
+			options.Stdin = os.Stdin
+		}
+
+		status, err := machine.Exec(args[1:], options)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(255)
+		}
+		os.Exit(status)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(execCmd)
+	execCmd.Flags().StringP("user", "u", internal.DefaultSshUser, "Remote user")
+	execCmd.Flags().StringArrayP("env", "e", nil, "Set an environment variable KEY=VALUE, can be repeated")
+	execCmd.Flags().StringP("workdir", "w", utils.Empty, "Working directory of the command")
+}
@@ -0,0 +1,142 @@
+package node
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+)
+
+// forwardCmd represents the forward command
+var forwardCmd = &cobra.Command{
+	Use:   "forward <name> [host:guest...]",
+	Short: "Forward ports of the host to a machine",
+	Long: `Forward ports of localhost to ports of a machine, the connections are tunneled over ssh.
+The forwards are saved in the machine spec and served by its daemon as long as it runs,
+without arguments the forwards of the machine are listed.
+
+forward localhost:8080 to the port 80 of the machine named ubuntu:
+  machina node forward ubuntu 8080:80
+
+stop forwarding localhost:8080:
+  machina node forward ubuntu --remove 8080
+
+forward the ports opened in the guest from 3000 to 9999 but 5432 to the same ports of localhost:
+  machina node forward ubuntu --auto --include 3000-9999 --exclude 5432
+`,
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Errorf("the configure machine %s can't be loaded: %v", args[0], err)
+			os.Exit(1)
+		}
+		removed, _ := cmd.Flags().GetIntSlice("remove")
+		if len(args) == 1 && len(removed) == 0 && !cmd.Flags().Changed("auto") {
+			printForwards(machine)
+			return
+		}
+		if auto, _ := cmd.Flags().GetBool("auto"); auto {
+			include, _ := cmd.Flags().GetStringSlice("include")
+			exclude, _ := cmd.Flags().GetStringSlice("exclude")
+			machine.Spec.AutoForward = &internal.AutoForward{Include: include, Exclude: exclude}
+			if err = machine.Spec.AutoForward.Validate(); err != nil {
+				utils.Logger.Error(err)
+				os.Exit(1)
+			}
+		} else if cmd.Flags().Changed("auto") {
+			machine.Spec.AutoForward = nil
+		}
+
+		forwards, err := internal.ResolvePortForwards(machine.Spec.Ports)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		ports := make([]string, 0, len(forwards)+len(args)-1)
+		for _, forward := range forwards {
+			if !containsPort(removed, forward.Host) {
+				ports = append(ports, forward.String())
+			}
+		}
+		if _, err = internal.ResolvePortForwards(append(ports, args[1:]...)); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		machine.Spec.Ports = append(ports, args[1:]...)
+		if err = machine.ExportMachineSpecification(); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		if !machine.IsActive() {
+			return
+		}
+		// a starting daemon doesn't listen yet, it reads the saved forwards once the machine runs
+		if response, err := machine.Control(internal.ControlReloadForwards); response == nil && err != nil {
+			utils.Logger.Debug(err)
+			utils.Logger.Infof("the forwards of machine %s are applied once it runs", machine.Name)
+		} else if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+	},
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// printForwards lists the forwards of the spec along with their state in the daemon
+func printForwards(machine *internal.Machine) {
+	forwards, err := internal.ResolvePortForwards(machine.Spec.Ports)
+	if err != nil {
+		utils.Logger.Error(err)
+		os.Exit(1)
+	}
+	active := map[internal.PortForward]internal.ForwardStatus{}
+	var automatic []internal.ForwardStatus
+	if statuses, err := machine.ActiveForwards(); err == nil {
+		for _, status := range statuses {
+			active[status.PortForward] = status
+			if status.Auto {
+				automatic = append(automatic, status)
+			}
+		}
+	}
+	if machine.Spec.AutoForward != nil {
+		fmt.Println("automatic forwards:", machine.Spec.AutoForward)
+	}
+	t := tablewriter.NewWriter(os.Stdout)
+	t.SetHeader([]string{"host", "guest", "status", "connections"})
+	for _, forward := range forwards {
+		status, found := active[forward]
+		state := "inactive"
+		if found && status.Error != utils.Empty {
+			state = status.Error
+		} else if found {
+			state = "active"
+		}
+		t.Append([]string{fmt.Sprint("localhost:", forward.Host), strconv.Itoa(forward.Guest), state, strconv.Itoa(status.Connections)})
+	}
+	for _, status := range automatic {
+		t.Append([]string{fmt.Sprint("localhost:", status.Host), strconv.Itoa(status.Guest), "automatic", strconv.Itoa(status.Connections)})
+	}
+	t.Render()
+}
+
+func init() {
+	RootCmd.AddCommand(forwardCmd)
+	forwardCmd.Flags().IntSlice("remove", nil, "Host ports to stop forwarding, can be repeated")
+	forwardCmd.Flags().Bool("auto", false, "Forward the ports opened in the guest to the same ports of localhost, --auto=false disables it")
+	forwardCmd.Flags().StringSlice("include", nil, "Ports or ranges like 3000-3999 forwarded automatically, the unprivileged ports by default")
+	forwardCmd.Flags().StringSlice("exclude", nil, "Ports or ranges never forwarded automatically")
+}
@@ -1,11 +1,12 @@
 package node
 
 import (
+	"fmt"
 	internal "github.com/efortin/machina/pkg"
 	"github.com/efortin/machina/utils"
 	"math"
 	"os"
-	"os/exec"
+	"runtime"
 	"strconv"
 
 	"github.com/spf13/cobra"
@@ -16,8 +17,7 @@ var LaunchCmd = &cobra.Command{
 	Use:   "launch",
 	Short: "Launch a machine using Apple Virtualization Framework",
 	Long: `Launch a machine using Apple Virtualization Framework.
-For the moment, only Ubuntu 20.04 ( focal) and 22.04 ( jammy) is supported but we'll try to add support
-for Centos and debian soon.
+The distribution is one of ubuntu (default, focal release), debian, fedora or alpine.
 For example:
 
 Launch a default machine:
@@ -25,6 +25,15 @@ Launch a default machine:
 
 Launch a machine named ubuntu with 2 cpu and 2 go of ram:
   machine Launch --name ubuntu --memory
+
+Launch a machine with a root disk of 60 GB:
+  machine Launch --name builder --disk 60G
+
+Launch a Debian bookworm machine:
+  machine Launch --name debian --distribution debian --release bookworm
+
+Launch a machine with additional packages and users, the rendered user-data is saved in the machine directory:
+  machine Launch --name dev --cloud-init dev.yaml
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		machineName := cmd.Flag("name").Value.String()
@@ -42,48 +51,69 @@ Launch a machine named ubuntu with 2 cpu and 2 go of ram:
 			ram = internal.Default_mem_mb
 		}
 
-		release, err := cmd.Flags().GetString("release")
+		kind, _ := cmd.Flags().GetString("distribution")
+		release, _ := cmd.Flags().GetString("release")
+		arch, _ := cmd.Flags().GetString("arch")
+		distribution, err := internal.NewDistribution(kind, release, arch)
 		if err != nil {
-			utils.Logger.Errorf("Invalid release name %s", release)
+			utils.Logger.Error(err)
 			os.Exit(1)
 		}
 		machine := &internal.Machine{
-			Name: cmd.Flag("name").Value.String(),
-			Distribution: &internal.UbuntuDistribution{
-				ReleaseName:  release,
-				Architecture: "arm64",
-			},
+			Name:         cmd.Flag("name").Value.String(),
+			Distribution: distribution,
 			Spec: internal.MachineSpec{
 				Cpu: uint(math.Min(float64(cpus), 8.0)),
 				Ram: uint64(math.Min(float64(ram)*internal.GB, 16*internal.GB)),
 			},
 		}
+		if disk, _ := cmd.Flags().GetString("disk"); disk != "" {
+			if machine.Spec.Disk, err = internal.ParseSize(disk, internal.GB); err != nil {
+				utils.Logger.Error(err)
+				os.Exit(1)
+			}
+		}
+		if cloudInit, _ := cmd.Flags().GetString("cloud-init"); cloudInit != "" {
+			content, err := os.ReadFile(cloudInit)
+			if err != nil {
+				utils.Logger.Error(err)
+				os.Exit(1)
+			}
+			machine.Spec.CloudInit = string(content)
+		}
+		if auto, _ := cmd.Flags().GetBool("auto-forward"); auto {
+			include, _ := cmd.Flags().GetStringSlice("auto-forward-include")
+			exclude, _ := cmd.Flags().GetStringSlice("auto-forward-exclude")
+			machine.Spec.AutoForward = &internal.AutoForward{Include: include, Exclude: exclude}
+			if err := machine.Spec.AutoForward.Validate(); err != nil {
+				utils.Logger.Error(err)
+				os.Exit(1)
+			}
+		}
 
-		machine.Distribution.DownloadDistro()
-		machine.BaseDirectory()
-		machine.RootDirectory()
-		machine.ExportMachineSpecification()
-
-		ou, _ := os.Create(machine.BaseDirectory() + "/process.log")
-		cwd, _ := os.Getwd()
-
-		//args := append(os.Args, "--detached")
-		mcmd := exec.Command(os.Args[0], "daemon", "launch", "-n", machineName)
-		mcmd.Stderr = ou
-		mcmd.Stdin = nil
-		mcmd.Stdout = ou
-		mcmd.Dir = cwd
-		_ = mcmd.Start()
-		mcmd.Process.Release()
-
+		if err := machine.Create(); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		if err := machine.Spawn(); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(LaunchCmd)
 	LaunchCmd.Flags().StringP("name", "n", "primary", "Unique machine name")
-	LaunchCmd.Flags().StringP("release", "r", "focal", "Ubuntu distribution")
+	LaunchCmd.Flags().StringP("distribution", "d", internal.DefaultDistribution, fmt.Sprintf("Distribution, one of %v", internal.DistributionKinds()))
+	LaunchCmd.Flags().StringP("release", "r", "", "Release of the distribution, its default one when empty")
+	LaunchCmd.Flags().String("arch", runtime.GOARCH, "Architecture of the distribution: arm64 or amd64")
 	LaunchCmd.Flags().IntP("memory", "m", 2048, "Ram / Memory in MB")
 	LaunchCmd.Flags().IntP("cpu", "c", 2, "Cpu/core to allocate")
+	LaunchCmd.Flags().String("disk", "", "Size of the root disk like 60G, 15G when empty")
+	LaunchCmd.Flags().String("cloud-init", "", "cloud-config file merged into the machina one, {{ .Name }}, {{ .Cpu }} and {{ .Memory }} are replaced")
+	LaunchCmd.Flags().Bool("auto-forward", false, "Forward the ports opened in the guest to the same ports of localhost")
+	LaunchCmd.Flags().StringSlice("auto-forward-include", nil, "Ports or ranges like 3000-3999 forwarded automatically, the unprivileged ports by default")
+	LaunchCmd.Flags().StringSlice("auto-forward-exclude", nil, "Ports or ranges never forwarded automatically")
 
 }
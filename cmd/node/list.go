@@ -5,6 +5,7 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package node
 
 import (
+	"encoding/json"
 	"fmt"
 	internal "github.com/efortin/machina/pkg"
 	"github.com/efortin/machina/utils"
@@ -12,6 +13,8 @@ import (
 	"github.com/spf13/cobra"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // listCmd represents the list command
@@ -27,14 +30,24 @@ to quickly create a Cobra application.`,
 	Run: func(cmd *cobra.Command, args []string) {
 
 		vmlist := internal.ListExistingMachines()
+		if output, _ := cmd.Flags().GetString("output"); output == "json" {
+			listJson(vmlist.List())
+			return
+		}
 		t := tablewriter.NewWriter(os.Stdout)
-		t.SetHeader([]string{"name", "status", "ip", "release", "aarch", "cpu", "memory", "process", "folder"})
+		t.SetHeader([]string{"name", "status", "vm", "since", "ip", "distribution", "release", "aarch", "cpu", "memory", "disk", "ports", "process", "last failure", "folder"})
 		for _, mname := range vmlist.List() {
 			machine, err := internal.FromFileSpec(mname)
 			if err == nil {
 				ip, _ := machine.IpAddress()
+				status, err := machine.Status()
+				if err != nil {
+					status = &internal.MachineStatus{State: internal.Machine_state_error, FailureReason: err.Error()}
+				}
+				vmState, _ := machine.VMState()
+				forwards, _ := machine.ActiveForwards()
 				t.Append([]string{
-					machine.Name, machine.State(), ip, machine.Distribution.ReleaseName, machine.Distribution.Architecture, strconv.Itoa(int(machine.Spec.Cpu)), fmt.Sprint(machine.Spec.Ram/internal.GB, " GB"), machine.PID(), machine.BaseDirectory(),
+					machine.Name, status.State, vmState, since(status.Since), ip, machine.Distribution.Kind(), machine.Distribution.Release(), machine.Distribution.Arch(), strconv.Itoa(int(machine.Spec.Cpu)), fmt.Sprint(machine.Spec.Ram/internal.GB, " GB"), internal.FormatSize(machine.DiskSize()), activePorts(forwards), machine.PID(), status.FailureReason, machine.BaseDirectory(),
 				})
 			} else {
 				utils.NewSetFromSlice(mname, "error").List()
@@ -44,6 +57,57 @@ to quickly create a Cobra application.`,
 	},
 }
 
+type machineListEntry struct {
+	Name string `json:"name"`
+	// Disk is the configured size of the root disk
+	Disk uint64 `json:"disk,omitempty"`
+	// VMState is the live state reported by the daemon, empty without daemon
+	VMState string `json:"vm_state,omitempty"`
+	// Forwards are the port forwards served by the daemon
+	Forwards []internal.ForwardStatus `json:"forwards,omitempty"`
+	*internal.MachineStatus
+}
+
+// listJson prints the lifecycle of every machine, it's meant for scripts
+func listJson(names []string) {
+	entries := make([]machineListEntry, 0, len(names))
+	for _, mname := range names {
+		machine := &internal.Machine{Name: mname}
+		status, err := machine.Status()
+		if err != nil {
+			status = &internal.MachineStatus{State: internal.Machine_state_error, FailureReason: err.Error()}
+		}
+		vmState, _ := machine.VMState()
+		forwards, _ := machine.ActiveForwards()
+		entry := machineListEntry{Name: mname, VMState: vmState, Forwards: forwards, MachineStatus: status}
+		if spec, err := internal.FromFileSpec(mname); err == nil {
+			entry.Disk = spec.DiskSize()
+		}
+		entries = append(entries, entry)
+	}
+	content, _ := json.MarshalIndent(entries, "", "  ")
+	fmt.Println(string(content))
+}
+
+// activePorts lists the port forwards which are listening
+func activePorts(forwards []internal.ForwardStatus) string {
+	ports := make([]string, 0, len(forwards))
+	for _, forward := range forwards {
+		if forward.Error == utils.Empty {
+			ports = append(ports, forward.String())
+		}
+	}
+	return strings.Join(ports, ",")
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return utils.Empty
+	}
+	return time.Since(t).Round(time.Second).String()
+}
+
 func init() {
 	RootCmd.AddCommand(listCmd)
+	listCmd.Flags().StringP("output", "o", "table", "Output format: table or json")
 }
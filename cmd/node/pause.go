@@ -0,0 +1,31 @@
+package node
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// pauseCmd represents the pause command
+var pauseCmd = &cobra.Command{
+	Use:       "pause <name>",
+	Short:     "Suspend the execution of a running machine",
+	Long:      "Suspend a running machine, its memory is kept until it is resumed with 'machina node resume'.",
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactValidArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine := &internal.Machine{Name: args[0]}
+		response, err := machine.Control(internal.ControlPause)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Machine %s paused, vm state: %s\n", machine.Name, response.VMState)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(pauseCmd)
+}
@@ -0,0 +1,31 @@
+package node
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// resumeCmd represents the resume command
+var resumeCmd = &cobra.Command{
+	Use:       "resume <name>",
+	Short:     "Resume the execution of a paused machine",
+	Long:      "Resume a machine suspended with 'machina node pause'.",
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactValidArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine := &internal.Machine{Name: args[0]}
+		response, err := machine.Control(internal.ControlResume)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Machine %s resumed, vm state: %s\n", machine.Name, response.VMState)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(resumeCmd)
+}
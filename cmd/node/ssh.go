@@ -0,0 +1,46 @@
+package node
+
+import (
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// sshCmd represents the ssh command
+var sshCmd = &cobra.Command{
+	Use:   "ssh <name> [-- command...]",
+	Short: "Open a shell or run a command on a machine",
+	Long: `Open an interactive shell on a machine, or run a command, using the machina ssh key.
+The exit status is the one of the remote command.
+
+open a root shell on the machine named ubuntu:
+  machina node ssh ubuntu
+
+run a command as the ubuntu user:
+  machina node ssh ubuntu --user ubuntu -- uname -a
+`,
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		machineName := args[0]
+		machine, err := internal.FromFileSpec(machineName)
+		if err != nil {
+			utils.Logger.Errorf("the configure machine %s can't be loaded: %v", machineName, err)
+			os.Exit(255)
+		}
+		user, _ := cmd.Flags().GetString("user")
+
+		status, err := machine.Ssh(user, args[1:], os.Stdin, os.Stdout, os.Stderr)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(255)
+		}
+		os.Exit(status)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(sshCmd)
+	sshCmd.Flags().StringP("user", "u", internal.DefaultSshUser, "Remote user")
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/efortin/machina/utils"
 	"github.com/spf13/cobra"
 	"os"
-	"os/exec"
 )
 
 // Launch represents the Launch command
@@ -34,28 +33,24 @@ start the machine named ubuntu and override cpu with 2 cpu and 2 go of ram:
 			os.Exit(1)
 		}
 
-		if machine.State() == internal.Machine_state_running {
-			utils.Logger.Warnf("the configure machine %s is already running", machineName)
+		if machine.IsActive() {
+			utils.Logger.Warnf("the configure machine %s is already %s", machineName, machine.State())
 			os.Exit(1)
 		}
 
-		machine.Distribution.DownloadDistro()
-		machine.BaseDirectory()
-
-		ou, _ := os.Create(machine.BaseDirectory() + "/process.log")
-		er, _ := os.Create(machine.BaseDirectory() + "/process.log")
-		cwd, _ := os.Getwd()
-
-		//args := append(os.Args, "--detached")
-		mcmd := exec.Command(os.Args[0], "daemon", "launch", "-n", machineName)
-		mcmd.Stderr = er
-		mcmd.Stdin = nil
-		mcmd.Stdout = ou
-		mcmd.Dir = cwd
-		_ = mcmd.Start()
-		pid := mcmd.Process.Pid
-		utils.Logger.Debug("the current process a pid: ", pid)
-		mcmd.Process.Release()
+		if err := machine.Transition(internal.Machine_state_downloading); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		if err := internal.DownloadDistro(machine.Distribution); err != nil {
+			machine.Fail(err)
+			utils.Logger.Errorf("Cannot download the distribution of %s: %v", machineName, err)
+			os.Exit(1)
+		}
+		if err := machine.Spawn(); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
 
 		if follow, err := cmd.Flags().GetBool("follow"); follow && err == nil {
 			machine.Log()
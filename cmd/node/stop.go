@@ -5,29 +5,49 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package node
 
 import (
+	"fmt"
 	internal "github.com/efortin/machina/pkg"
 	"github.com/efortin/machina/utils"
 	"github.com/spf13/cobra"
+	"os"
+	"time"
 )
 
 // stopCmd represents the stop command
 var stopCmd = &cobra.Command{
-	Use:   "stop",
-	Short: "A brief description of your command",
-	Long: `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	Use:   "stop <name>",
+	Short: "Stop a machine gracefully",
+	Long: `Stop a machine, escalating until it's stopped:
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`,
+  1. request-stop: the daemon asks the guest to stop
+  2. poweroff: poweroff is run in the guest over ssh
+  3. kill: the daemon is killed with the machine
+
+Each graceful stage waits --timeout before escalating, --force kills the machine right away.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		timeout, _ := cmd.Flags().GetDuration("timeout")
+		force, _ := cmd.Flags().GetBool("force")
+
 		m, err := internal.FromFileSpec(args[0])
-		utils.Logger.Debug(err)
-		if m.State() == internal.Machine_state_running {
-			m.Stop()
-		} else {
+		if err != nil {
+			utils.Logger.Errorf("the machine %s can't be loaded: %v", args[0], err)
+			os.Exit(1)
+		}
+		if !m.IsActive() {
 			utils.Logger.Warn("Machine is not running, state:", m.State())
+			return
+		}
+		started := time.Now()
+		stage, err := m.Stop(internal.StopOptions{Timeout: timeout, Force: force})
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
 		}
+		if stage == internal.StopStageNone {
+			utils.Logger.Warn("Machine has no running process, state:", m.State())
+			return
+		}
+		fmt.Printf("Machine %s stopped by %s in %s\n", m.Name, stage, time.Since(started).Round(time.Second))
 	},
 	ValidArgs: internal.ListExistingMachines().List(),
 	Args:      cobra.ExactValidArgs(1),
@@ -35,14 +55,6 @@ to quickly create a Cobra application.`,
 
 func init() {
 	RootCmd.AddCommand(stopCmd)
-
-	// Here you will define your flags and configuration settings.
-
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// stopCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// stopCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	stopCmd.Flags().Duration("timeout", internal.DefaultStopTimeout, "Time given to each graceful stage before escalating")
+	stopCmd.Flags().BoolP("force", "f", false, "Kill the machine without trying to stop it gracefully")
 }
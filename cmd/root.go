@@ -6,7 +6,10 @@ package cmd
 
 import (
 	"github.com/efortin/machina/cmd/daemon"
+	"github.com/efortin/machina/cmd/disk"
+	"github.com/efortin/machina/cmd/image"
 	"github.com/efortin/machina/cmd/node"
+	"github.com/efortin/machina/cmd/snapshot"
 	"os"
 
 	"github.com/spf13/cobra"
@@ -43,6 +46,9 @@ func init() {
 
 	RootCmd.AddCommand(node.RootCmd)
 	RootCmd.AddCommand(daemon.RootCmd)
+	RootCmd.AddCommand(image.RootCmd)
+	RootCmd.AddCommand(snapshot.RootCmd)
+	RootCmd.AddCommand(disk.RootCmd)
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	RootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
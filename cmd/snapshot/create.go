@@ -0,0 +1,39 @@
+package snapshot
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+var description string
+
+// createCmd represents the create command
+var createCmd = &cobra.Command{
+	Use:   "create <machine> <snapshot>",
+	Short: "Snapshot the disk and the spec of a machine",
+	Long: `Clone the root disk of a machine along with its spec, the clone is copy-on-write on APFS.
+A running machine is paused while its disk is cloned.`,
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		snapshot, err := machine.CreateSnapshot(args[1], description)
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Snapshot %s of machine %s created\n", snapshot.Name, machine.Name)
+	},
+}
+
+func init() {
+	createCmd.Flags().StringVarP(&description, "description", "d", utils.Empty, "description of the snapshot")
+	RootCmd.AddCommand(createCmd)
+}
@@ -0,0 +1,29 @@
+package snapshot
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// deleteCmd represents the delete command
+var deleteCmd = &cobra.Command{
+	Use:       "delete <machine> <snapshot>",
+	Short:     "Delete a snapshot of a machine",
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine := &internal.Machine{Name: args[0]}
+		if err := machine.DeleteSnapshot(args[1]); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Snapshot %s of machine %s deleted\n", args[1], machine.Name)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(deleteCmd)
+}
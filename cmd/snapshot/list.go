@@ -0,0 +1,41 @@
+package snapshot
+
+import (
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/olekukonko/tablewriter"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"time"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:       "list <machine>",
+	Short:     "List the snapshots of a machine",
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactValidArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		snapshots, err := machine.Snapshots()
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		t := tablewriter.NewWriter(os.Stdout)
+		t.SetHeader([]string{"name", "created", "running", "description"})
+		for _, snapshot := range snapshots {
+			t.Append([]string{snapshot.Name, snapshot.CreatedAt.Format(time.RFC3339), strconv.FormatBool(snapshot.Running), snapshot.Description})
+		}
+		t.Render()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,34 @@
+package snapshot
+
+import (
+	"fmt"
+	internal "github.com/efortin/machina/pkg"
+	"github.com/efortin/machina/utils"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:       "restore <machine> <snapshot>",
+	Short:     "Restore the disk and the spec of a machine from a snapshot",
+	Long:      "Replace the disk and the spec of a stopped machine by the ones of the snapshot, the snapshot is kept.",
+	ValidArgs: internal.ListExistingMachines().List(),
+	Args:      cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		machine, err := internal.FromFileSpec(args[0])
+		if err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		if err = machine.RestoreSnapshot(args[1]); err != nil {
+			utils.Logger.Error(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Machine %s restored from snapshot %s\n", machine.Name, args[1])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(restoreCmd)
+}
@@ -0,0 +1,11 @@
+package snapshot
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// RootCmd groups the commands managing the snapshots of the machine disks
+var RootCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage the snapshots of the machine disks",
+}
@@ -6,21 +6,25 @@ require (
 	//github.com/Code-Hex/vz v0.0.4
 	github.com/Code-Hex/vz v0.0.5-0.20220406150231-a2ebc854a261
 	github.com/Netflix/go-expect v0.0.0-20220104043353-73e0943537d2 // indirect
-	github.com/cavaliergopher/grab/v3 v3.0.1
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/hpcloud/tail v1.0.0
+	github.com/klauspost/compress v1.15.9
 	github.com/mattn/go-runewidth v0.0.13 // indirect
 	github.com/mitchellh/go-ps v1.0.0
 	github.com/olekukonko/tablewriter v0.0.5
 	github.com/papertrail/go-tail v0.0.0-20180509224916-973c153b0431 // indirect
-	github.com/pkg/term v1.1.0 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21
+	github.com/pkg/sftp v1.13.4
+	github.com/pkg/term v1.1.0
 	github.com/rs/xid v1.3.0 // indirect
 	github.com/smartystreets/goconvey v1.7.2 // indirect
 	github.com/spf13/cobra v1.4.0
 	github.com/stretchr/testify v1.7.1
+	github.com/ulikunitz/xz v0.5.12
 	github.com/withmandala/go-log v0.1.0
-	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/crypto v0.0.0-20210421170649-83a5a9bb288b
 	golang.org/x/sys v0.0.0-20220408201424-a24fb2fb8a0f
 	gopkg.in/fsnotify.v1 v1.4.7 // indirect
 	gopkg.in/tomb.v1 v1.0.0-20141024135613-dd632973f1e7 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// autoForwardInterval is the delay between two inspections of the guest listening sockets
+	autoForwardInterval = 3 * time.Second
+	// tcpListen is the state of a listening socket in /proc/net/tcp
+	tcpListen = "0A"
+)
+
+// defaultAutoForwardInclude are the ports forwarded automatically without include ranges:
+// the unprivileged ones, the privileged ones usually belong to the system
+var defaultAutoForwardInclude = []string{"1024-65535"}
+
+// AutoForward forwards the ports the guest listens on to the same ports of localhost.
+// Include and Exclude are ports or ranges like 3000-3999, Exclude wins.
+type AutoForward struct {
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+}
+
+func (a *AutoForward) String() string {
+	if a == nil {
+		return utils.Empty
+	}
+	include := a.Include
+	if len(include) == 0 {
+		include = defaultAutoForwardInclude
+	}
+	description := "include " + strings.Join(include, ",")
+	if len(a.Exclude) > 0 {
+		description += " exclude " + strings.Join(a.Exclude, ",")
+	}
+	return description
+}
+
+// Validate checks the port ranges
+func (a *AutoForward) Validate() error {
+	_, err := a.matcher()
+	return err
+}
+
+// matcher returns whether a guest port is forwarded automatically
+func (a *AutoForward) matcher() (func(port int) bool, error) {
+	include := a.Include
+	if len(include) == 0 {
+		include = defaultAutoForwardInclude
+	}
+	included, err := parsePortRanges(include)
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := parsePortRanges(a.Exclude)
+	if err != nil {
+		return nil, err
+	}
+	return func(port int) bool {
+		return inPortRanges(included, port) && !inPortRanges(excluded, port)
+	}, nil
+}
+
+// portRange holds the ports from First to Last included
+type portRange struct {
+	First, Last int
+}
+
+func parsePortRanges(values []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(values))
+	for _, value := range values {
+		bounds := strings.SplitN(value, "-", 2)
+		// a single port is the range from the port to itself
+		bounds = []string{bounds[0], bounds[len(bounds)-1]}
+		var ports [2]int
+		for i := range ports {
+			port, err := strconv.Atoi(strings.TrimSpace(bounds[i]))
+			if err != nil || port < 1 || port > 65535 {
+				return nil, fmt.Errorf("invalid port range %q, expected a port or first-last", value)
+			}
+			ports[i] = port
+		}
+		if ports[0] > ports[1] {
+			return nil, fmt.Errorf("invalid port range %q, the first port is after the last one", value)
+		}
+		ranges = append(ranges, portRange{First: ports[0], Last: ports[1]})
+	}
+	return ranges, nil
+}
+
+func inPortRanges(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.First && port <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// setAutoForward changes the automatic forwards, nil disables them
+func (f *portForwarder) setAutoForward(autoForward *AutoForward) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.autoForward = autoForward
+}
+
+// watchGuestPorts follows the listening sockets of the guest until the forwarder is closed
+func (f *portForwarder) watchGuestPorts(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := f.scanGuestPorts(); err != nil {
+			utils.Logger.Debugf("the ports of machine %s can't be inspected: %v", f.name, err)
+		}
+	}
+}
+
+// scanGuestPorts forwards the guest ports listening on the loopback or on every address,
+// the forwards of the ports which are closed are torn down.
+func (f *portForwarder) scanGuestPorts() error {
+	f.mu.Lock()
+	autoForward := f.autoForward
+	f.mu.Unlock()
+	if autoForward == nil {
+		f.syncAuto(nil)
+		return nil
+	}
+	forwarded, err := autoForward.matcher()
+	if err != nil {
+		return err
+	}
+	client, err := f.sshClient()
+	if err != nil {
+		return err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	// a guest without ipv6 has no tcp6 file, cat fails but prints tcp
+	output, err := session.Output("cat /proc/net/tcp /proc/net/tcp6 2>/dev/null")
+	var exitError *ssh.ExitError
+	if err != nil && !errors.As(err, &exitError) {
+		return err
+	}
+
+	ports := map[int]string{}
+	for port, host := range listeningPorts(output) {
+		if forwarded(port) {
+			ports[port] = host
+		}
+	}
+	f.syncAuto(ports)
+	return nil
+}
+
+// syncAuto forwards the guest ports to the same host ports, ports maps a port to the guest address to reach it.
+// The host ports forwarded by the spec or already used are skipped.
+func (f *portForwarder) syncAuto(ports map[int]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	used := map[int]bool{}
+	for forward, listener := range f.listeners {
+		if listener.auto && ports[forward.Guest] != listener.guestHost {
+			utils.Logger.Infof("The port %d of machine %s is closed, it's not forwarded anymore", forward.Guest, f.name)
+			listener.Close()
+			delete(f.listeners, forward)
+			continue
+		}
+		used[forward.Host] = true
+	}
+	for port, host := range ports {
+		if used[port] {
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err != nil {
+			utils.Logger.Debugf("the port %d of machine %s can't be forwarded: %v", port, f.name, err)
+			continue
+		}
+		utils.Logger.Infof("Forwarding localhost:%d to the opened port %d of machine %s", port, port, f.name)
+		forward := PortForward{Host: port, Guest: port}
+		f.listeners[forward] = &forwardListener{Listener: listener, guestHost: host, auto: true}
+		go f.serve(f.listeners[forward], port)
+	}
+}
+
+// listeningPorts parses /proc/net/tcp and tcp6, it returns the ports listening on the loopback or on every
+// address along with the address to connect to, the ipv4 one is preferred.
+func listeningPorts(content []byte) map[int]string {
+	ports := map[int]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[3] != tcpListen {
+			continue
+		}
+		address := strings.SplitN(fields[1], ":", 2)
+		if len(address) != 2 {
+			continue
+		}
+		ip := procNetIP(address[0])
+		port, err := strconv.ParseUint(address[1], 16, 16)
+		if ip == nil || err != nil || !ip.IsLoopback() && !ip.IsUnspecified() {
+			continue
+		}
+		host := "127.0.0.1"
+		// a socket listening on the ipv6 loopback only isn't reachable on the ipv4 one
+		if ip.To4() == nil && ip.IsLoopback() {
+			host = "::1"
+		}
+		if current, found := ports[int(port)]; !found || current != "127.0.0.1" {
+			ports[int(port)] = host
+		}
+	}
+	return ports
+}
+
+// procNetIP decodes an address of /proc/net/tcp, it's written as 32 bits words in host order, little endian
+func procNetIP(value string) net.IP {
+	content, err := hex.DecodeString(value)
+	if err != nil || len(content) != net.IPv4len && len(content) != net.IPv6len {
+		return nil
+	}
+	ip := make(net.IP, len(content))
+	for word := 0; word < len(content); word += 4 {
+		for i := 0; i < 4; i++ {
+			ip[word+i] = content[word+3-i]
+		}
+	}
+	return ip
+}
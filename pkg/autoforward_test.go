@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+const testProcNetTcp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:1F90 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 662 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 913 1 0000000000000000 100 0 0 10 0
+   2: 0F02000A:2328 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 914 1 0000000000000000 100 0 0 10 0
+   3: 0F02000A:0016 0202000A:C350 01 00000000:00000000 02:0009D2A1 00000000     0        0 915 4 0000000000000000 20 4 30 10 -1
+  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:1435 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000  1000        0 916 1 0000000000000000 100 0 0 10 0
+   1: 00000000000000000000000000000000:1F90 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 917 1 0000000000000000 100 0 0 10 0
+`
+
+func TestAutoForward_matcher(t *testing.T) {
+	t.Run("should include the unprivileged ports by default", func(t *testing.T) {
+		forwarded, err := (&AutoForward{Exclude: []string{"5432", "6000-6010"}}).matcher()
+		assert.NoError(t, err)
+		for port, expected := range map[int]bool{80: false, 1024: true, 5432: false, 6005: false, 8080: true} {
+			assert.Equal(t, expected, forwarded(port), port)
+		}
+	})
+
+	t.Run("should follow the include ranges", func(t *testing.T) {
+		forwarded, err := (&AutoForward{Include: []string{"80", "3000-3999"}}).matcher()
+		assert.NoError(t, err)
+		for port, expected := range map[int]bool{80: true, 3000: true, 3999: true, 4000: false} {
+			assert.Equal(t, expected, forwarded(port), port)
+		}
+	})
+
+	for _, value := range []string{"a", "0", "70000", "20-10", "1-2-3", ""} {
+		assert.Error(t, (&AutoForward{Include: []string{value}}).Validate(), value)
+	}
+}
+
+func TestListeningPorts(t *testing.T) {
+	assert.Equal(t, map[int]string{8080: "127.0.0.1", 3000: "127.0.0.1", 5173: "::1"}, listeningPorts([]byte(testProcNetTcp)))
+}
+
+func TestPortForwarder_scanGuestPorts(t *testing.T) {
+	newTestMachine(t, nil)
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no ipv6 loopback", err)
+	}
+	listener.Close()
+	guest := startTestGuestPortOn(t, listener.Addr().String())
+
+	var mu sync.Mutex
+	procNetTcp := fmt.Sprintf("   0: 00000000000000000000000001000000:%04X 00000000000000000000000000000000:0000 0A\n", guest)
+	address := startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 {
+		mu.Lock()
+		defer mu.Unlock()
+		channel.Write([]byte(procNetTcp))
+		return 1
+	})
+	forwarder := newPortForwarder("test", func() (string, error) { return address, nil })
+	defer forwarder.close()
+
+	t.Run("should not forward without automatic forwards", func(t *testing.T) {
+		assert.NoError(t, forwarder.scanGuestPorts())
+		assert.Empty(t, forwarder.status())
+	})
+
+	t.Run("should forward an opened port to the same host port", func(t *testing.T) {
+		forwarder.setAutoForward(&AutoForward{Include: []string{strconv.Itoa(guest)}})
+		assert.NoError(t, forwarder.scanGuestPorts())
+
+		assert.Equal(t, []ForwardStatus{{PortForward: PortForward{Host: guest, Guest: guest}, Auto: true}}, forwarder.status())
+		assert.Equal(t, "echo ping", roundTrip(t, guest, "ping"))
+	})
+
+	t.Run("should keep the port for the spec forwards", func(t *testing.T) {
+		assert.NoError(t, forwarder.sync([]string{PortForward{Host: guest, Guest: 22}.String()}))
+		assert.NoError(t, forwarder.scanGuestPorts())
+
+		assert.Equal(t, []ForwardStatus{{PortForward: PortForward{Host: guest, Guest: 22}}}, forwarder.status())
+		assert.NoError(t, forwarder.sync(nil))
+	})
+
+	t.Run("should tear down a closed port", func(t *testing.T) {
+		assert.NoError(t, forwarder.scanGuestPorts())
+		assert.Len(t, forwarder.status(), 1)
+		mu.Lock()
+		procNetTcp = ""
+		mu.Unlock()
+
+		assert.NoError(t, forwarder.scanGuestPorts())
+		assert.Empty(t, forwarder.status())
+		_, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(guest)))
+		assert.Error(t, err)
+	})
+}
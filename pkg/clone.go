@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"io"
+	"os"
+)
+
+// sparseBlockSize is the granularity of the holes left by sparseCopy
+const sparseBlockSize = 64 * 1024
+
+// sparseCopy copies src to dst without writing the blocks of zeros, they are left as holes.
+// dst must not exist, it's removed when the copy fails.
+func sparseCopy(srcFilePath string, dstFilePath string) (err error) {
+	src, err := os.Open(srcFilePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(dstFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(dstFilePath)
+		}
+	}()
+
+	if _, err = sparseWrite(dst, src); err != nil {
+		return err
+	}
+	return dst.Close()
+}
+
+// sparseWrite writes src to dst without writing the blocks of zeros, they are left as holes.
+// It returns the number of bytes written, holes included.
+func sparseWrite(dst *os.File, src io.Reader) (int64, error) {
+	var written int64
+	block := make([]byte, sparseBlockSize)
+	for {
+		n, readErr := io.ReadFull(src, block)
+		if n > 0 {
+			var err error
+			if isZero(block[:n]) {
+				_, err = dst.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, err = dst.Write(block[:n])
+			}
+			if err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		} else if readErr != nil {
+			return written, readErr
+		}
+	}
+	// a file ending with a hole gets its size from the truncate
+	return written, dst.Truncate(written)
+}
+
+func isZero(content []byte) bool {
+	for _, b := range content {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// cloneDisk clones the root disk of the machine to dst, it returns whether the machine was running.
+// A running machine is paused during the clone so that its disk isn't written meanwhile.
+func (m *Machine) cloneDisk(dst string) (running bool, err error) {
+	state := m.State()
+	running = state == Machine_state_running || state == Machine_state_paused
+	if m.IsActive() && !running {
+		return false, fmt.Errorf("machine %s is %s, its disk is changing", m.Name, state)
+	}
+	if state == Machine_state_running {
+		if _, err := m.Control(ControlPause); err != nil {
+			utils.Logger.Warnf("machine %s can't be paused, its disk is cloned while it runs: %v", m.Name, err)
+		} else {
+			defer func() {
+				if _, err := m.Control(ControlResume); err != nil {
+					utils.Logger.Errorf("machine %s can't be resumed: %v", m.Name, err)
+				}
+			}()
+		}
+	}
+	return running, cloneFile(m.rootDiskPath(), dst)
+}
@@ -0,0 +1,19 @@
+//go:build darwin
+// +build darwin
+
+package internal
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile creates a copy-on-write clone of src, it relies on APFS clonefile.
+// A filesystem without clones or a copy to another volume falls back to a sparse copy.
+func cloneFile(srcFilePath string, dstFilePath string) error {
+	err := unix.Clonefile(srcFilePath, dstFilePath, 0)
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EXDEV) {
+		return sparseCopy(srcFilePath, dstFilePath)
+	}
+	return err
+}
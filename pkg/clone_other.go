@@ -0,0 +1,9 @@
+//go:build !darwin
+// +build !darwin
+
+package internal
+
+// cloneFile copies src to dst, clonefile is only available on darwin.
+func cloneFile(srcFilePath string, dstFilePath string) error {
+	return sparseCopy(srcFilePath, dstFilePath)
+}
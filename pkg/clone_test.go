@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSparseCopy(t *testing.T) {
+	dir := t.TempDir()
+	content := make([]byte, 3*sparseBlockSize+10)
+	copy(content[sparseBlockSize:], "data")
+	src := filepath.Join(dir, "src")
+	assert.NoError(t, os.WriteFile(src, content, 0640))
+
+	t.Run("should copy the content and the mode", func(t *testing.T) {
+		dst := filepath.Join(dir, "dst")
+		assert.NoError(t, sparseCopy(src, dst))
+		copied, err := os.ReadFile(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, content, copied)
+		info, _ := os.Stat(dst)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	})
+
+	t.Run("should refuse an existing destination", func(t *testing.T) {
+		dst := filepath.Join(dir, "existing")
+		assert.NoError(t, os.WriteFile(dst, []byte("kept"), 0644))
+		assert.Error(t, sparseCopy(src, dst))
+		kept, _ := os.ReadFile(dst)
+		assert.Equal(t, "kept", string(kept))
+	})
+}
+
+func TestMachine_Clone(t *testing.T) {
+	t.Run("should copy the disk and the spec of a stopped machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running, Machine_state_stop)
+		assert.NoError(t, m.markProvisioned())
+		m.Spec.Ports = []string{"8080:80"}
+		m.Spec.Labels = map[string]string{"team": "web"}
+		newTestDisk(t, m, "disk")
+		_, err := m.KernelDirectory()
+		assert.NoError(t, err)
+		_, err = CreateDataDisk("cache", GB, m)
+		assert.NoError(t, err)
+		assert.NoError(t, m.AttachDisk("cache", false))
+
+		clone, err := m.Clone("test-1")
+		assert.NoError(t, err)
+		content, err := os.ReadFile(clone.rootDiskPath())
+		assert.NoError(t, err)
+		assert.Equal(t, "disk", string(content))
+		assert.FileExists(t, filepath.Join(MachineDirectory("test-1"), "vmlinuz"))
+		assert.FileExists(t, clone.dataDiskPath(DataDisk{Name: "cache"}))
+		assert.NotEqual(t, GenerateAlmostUniqueMac(m.Name), GenerateAlmostUniqueMac(clone.Name))
+
+		loaded, err := FromFileSpec("test-1")
+		assert.NoError(t, err)
+		assert.Equal(t, "test-1", loaded.Name)
+		assert.Empty(t, loaded.Spec.Ports)
+		assert.Equal(t, map[string]string{"team": "web"}, loaded.Spec.Labels)
+		assert.Equal(t, Machine_state_stop, clone.State())
+		assert.True(t, clone.hasAlreadyBeenConfigured())
+	})
+
+	t.Run("should pause a running machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		vm, _ := serveTestControl(t, m, NewFakeDriver())
+		newTestDisk(t, m, "disk")
+
+		_, err := m.Clone("test-1")
+		assert.NoError(t, err)
+		assert.Equal(t, VMStateRunning, vm.State())
+		assert.Equal(t, Machine_state_running, m.State())
+	})
+
+	t.Run("should refuse an existing machine and leave it untouched", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		newTestDisk(t, m, "disk")
+
+		_, err := m.Clone("test")
+		assert.Error(t, err)
+		content, _ := os.ReadFile(m.rootDiskPath())
+		assert.Equal(t, "disk", string(content))
+	})
+
+	t.Run("should remove the copy of a machine without disk", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		m.BaseDirectory()
+
+		_, err := m.Clone("test-1")
+		assert.Error(t, err)
+		assert.NoDirExists(t, MachineDirectory("test-1"))
+	})
+}
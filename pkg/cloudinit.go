@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"gopkg.in/yaml.v3"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+const (
+	cloudConfigHeader = "#cloud-config"
+	userDataFileName  = "user-data"
+)
+
+// CloudInitValues are the variables of the cloud-init documents, like {{ .Name }}. Memory is in MB.
+type CloudInitValues struct {
+	Name         string
+	Cpu          uint
+	Memory       uint64
+	Distribution string
+	Release      string
+	Arch         string
+	PublicKey    string
+}
+
+// UserDataPath is the rendered user-data of the last boot, kept for inspection
+func (m *Machine) UserDataPath() string {
+	return fmt.Sprintf("%s/%s", MachineDirectory(m.Name), userDataFileName)
+}
+
+func (m *Machine) cloudInitValues() (*CloudInitValues, error) {
+	key, err := GetMachinaPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("no machina ssh key found, please use `machina init`")
+	}
+	values := &CloudInitValues{
+		Name:      m.Name,
+		Cpu:       m.Spec.Cpu,
+		Memory:    m.Spec.Ram / (1024 * 1024),
+		PublicKey: strings.TrimSpace(key),
+	}
+	if m.Distribution != nil {
+		values.Distribution, values.Release, values.Arch = m.Distribution.Kind(), m.Distribution.Release(), m.Distribution.Arch()
+	}
+	return values, nil
+}
+
+// RenderUserData renders the cloud-init document of the spec and deep merges it with the keys
+// machina requires: maps are merged, lists are appended to machina's ones and machina's values are kept.
+// A boot command gives a cloned disk its own machine id, the commands of the distribution run at the first boot.
+func (m *Machine) RenderUserData() ([]byte, error) {
+	values, err := m.cloudInitValues()
+	if err != nil {
+		return nil, err
+	}
+	required, err := renderCloudConfig("machina", cloudinit, values)
+	if err != nil {
+		return nil, err
+	}
+	required["bootcmd"] = []interface{}{
+		[]interface{}{"cloud-init-per", "instance", "machina-identity", "sh", "-c", identityScript},
+	}
+	if m.Distribution != nil {
+		var commands []interface{}
+		for _, command := range m.Distribution.Layout().Commands {
+			arguments := make([]interface{}, 0, len(command))
+			for _, argument := range command {
+				arguments = append(arguments, argument)
+			}
+			commands = append(commands, arguments)
+		}
+		if len(commands) > 0 {
+			required["runcmd"] = commands
+		}
+	}
+	user, err := renderCloudConfig("cloud-init of "+m.Name, m.Spec.CloudInit, values)
+	if err != nil {
+		return nil, err
+	}
+	content, err := yaml.Marshal(mergeCloudConfig(required, user, utils.Empty))
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(cloudConfigHeader+"\n"), content...), nil
+}
+
+// ValidateCloudInit checks the cloud-init document of the spec renders to a valid cloud-config
+func (m *Machine) ValidateCloudInit() error {
+	_, err := m.RenderUserData()
+	return err
+}
+
+// renderCloudConfig executes the template then parses the cloud-config document
+func renderCloudConfig(name, content string, values *CloudInitValues) (map[string]interface{}, error) {
+	trimmed := strings.TrimSpace(content)
+	if strings.HasPrefix(trimmed, "#") && !strings.HasPrefix(trimmed, cloudConfigHeader) {
+		return nil, fmt.Errorf("invalid %s: only %s documents are supported", name, cloudConfigHeader)
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, values); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	document := map[string]interface{}{}
+	if err = yaml.Unmarshal(rendered.Bytes(), &document); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return document, nil
+}
+
+// mergeCloudConfig merges user into required, path locates the merged map for the warnings
+func mergeCloudConfig(required, user map[string]interface{}, path string) map[string]interface{} {
+	merged := make(map[string]interface{}, len(required)+len(user))
+	for key, value := range required {
+		merged[key] = value
+	}
+	for key, value := range user {
+		current, found := merged[key]
+		if !found || reflect.DeepEqual(current, value) {
+			merged[key] = value
+			continue
+		}
+		switch current := current.(type) {
+		case map[string]interface{}:
+			if value, ok := value.(map[string]interface{}); ok {
+				merged[key] = mergeCloudConfig(current, value, path+key+".")
+				continue
+			}
+		case []interface{}:
+			if value, ok := value.([]interface{}); ok {
+				merged[key] = append(append([]interface{}{}, current...), value...)
+				continue
+			}
+		}
+		utils.Logger.Warnf("the cloud-init key %s%s is set by machina, %v is ignored", path, key, value)
+	}
+	return merged
+}
+
+// identityScript regenerates the machine id of a disk which served another instance, a cloned disk.
+// cloud-init regenerates the hostname and the ssh host keys itself once the instance id changes.
+const identityScript = `if [ "$(ls /var/lib/cloud/instances | wc -l)" -gt 1 ]; then
+  rm -f /etc/machine-id
+  systemd-machine-id-setup || dbus-uuidgen --ensure=/etc/machine-id
+fi
+`
+
+const cloudinit = `#cloud-config
+disable_root: false
+
+users:
+  - name: root
+    sudo: ['ALL=(ALL) NOPASSWD:ALL']
+    lock_passwd: false
+    ssh-authorized-keys:
+      - {{ .PublicKey }}
+`
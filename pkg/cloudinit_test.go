@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestMachine_RenderUserData(t *testing.T) {
+	render := func(t *testing.T, cloudInit string) (map[string]interface{}, error) {
+		m := newTestMachine(t, nil)
+		m.Spec.CloudInit = cloudInit
+		content, err := m.RenderUserData()
+		if err != nil {
+			return nil, err
+		}
+		assert.True(t, strings.HasPrefix(string(content), "#cloud-config\n"))
+		document := map[string]interface{}{}
+		assert.NoError(t, yaml.Unmarshal(content, &document))
+		return document, nil
+	}
+
+	t.Run("should render the machina keys without user document", func(t *testing.T) {
+		document, err := render(t, "")
+		assert.NoError(t, err)
+		key, _ := GetMachinaPublicKey()
+		users := document["users"].([]interface{})
+		assert.Len(t, users, 1)
+		assert.Equal(t, []interface{}{strings.TrimSpace(key)}, users[0].(map[string]interface{})["ssh-authorized-keys"])
+		identity := document["bootcmd"].([]interface{})[0].([]interface{})
+		assert.Equal(t, []interface{}{"cloud-init-per", "instance", "machina-identity", "sh", "-c", identityScript}, identity)
+		assert.Equal(t, []interface{}{"cp", "/usr/bin/true", "/usr/sbin/flash-kernel"}, document["runcmd"].([]interface{})[0])
+	})
+
+	t.Run("should only run the commands of the distribution", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		m.Distribution, _ = NewDistribution("fedora", "40", "arm64")
+		content, err := m.RenderUserData()
+		assert.NoError(t, err)
+
+		assert.NotContains(t, string(content), "runcmd")
+		assert.NotContains(t, string(content), "apt")
+	})
+
+	t.Run("should merge the user document", func(t *testing.T) {
+		document, err := render(t, `#cloud-config
+disable_root: true
+packages: [git]
+users:
+  - name: dev
+runcmd:
+  - echo done
+write_files:
+  - path: /etc/motd
+    content: "{{ .Name }} has {{ .Cpu }} cpu and {{ .Memory }} MB"
+`)
+		assert.NoError(t, err)
+		assert.Equal(t, false, document["disable_root"])
+		assert.Equal(t, []interface{}{"git"}, document["packages"])
+		users := document["users"].([]interface{})
+		assert.Len(t, users, 2)
+		assert.Equal(t, "root", users[0].(map[string]interface{})["name"])
+		assert.Equal(t, "dev", users[1].(map[string]interface{})["name"])
+		runcmd := document["runcmd"].([]interface{})
+		assert.Equal(t, "echo done", runcmd[len(runcmd)-1])
+		files := document["write_files"].([]interface{})
+		assert.Equal(t, "test has 2 cpu and 2048 MB", files[0].(map[string]interface{})["content"])
+	})
+
+	for _, test := range []struct {
+		name      string
+		cloudInit string
+	}{
+		{"invalid yaml", "packages: [git\n"},
+		{"a document which isn't a map", "- git\n"},
+		{"a shell script", "#!/bin/sh\necho hello\n"},
+		{"an unknown variable", "hostname: {{ .Hostname }}\n"},
+	} {
+		test := test
+		t.Run("should refuse "+test.name, func(t *testing.T) {
+			_, err := render(t, test.cloudInit)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMachine_writeSeedSavesUserData(t *testing.T) {
+	m := newTestMachine(t, nil)
+	m.Spec.CloudInit = "packages: [git]\n"
+	m.BaseDirectory()
+
+	assert.NoError(t, m.writeSeed())
+	image, _ := os.ReadFile(m.SeedPath())
+	_, files := readISO9660(t, image)
+	saved, err := os.ReadFile(m.UserDataPath())
+	assert.NoError(t, err)
+	assert.Equal(t, files["user-data"], string(saved))
+	assert.Contains(t, string(saved), "git")
+}
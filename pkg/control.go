@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	controlSocketName = "control.sock"
+	controlTimeout    = 10 * time.Second
+
+	// ControlStatus returns the persisted lifecycle along with the VM state
+	ControlStatus = "status"
+	// ControlState returns the VM state only
+	ControlState = "state"
+	// ControlRequestStop asks the guest to stop
+	ControlRequestStop = "request-stop"
+	// ControlForceStop makes the daemon leave, the VM is destroyed with it
+	ControlForceStop = "force-stop"
+	ControlPause     = "pause"
+	ControlResume    = "resume"
+	// ControlForwards returns the port forwards
+	ControlForwards = "forwards"
+	// ControlReloadForwards serves the port forwards of the saved spec
+	ControlReloadForwards = "reload-forwards"
+)
+
+// ControlRequest is a command sent to a machine daemon over its control socket
+type ControlRequest struct {
+	Command string `json:"command"`
+}
+
+// ControlResponse is the answer of a machine daemon, VMState is always set
+type ControlResponse struct {
+	VMState string `json:"vm_state"`
+	// Pid is the process of the daemon
+	Pid    int            `json:"pid"`
+	Status *MachineStatus `json:"status,omitempty"`
+	// Accepted tells whether the guest accepted a stop request
+	Accepted bool            `json:"accepted,omitempty"`
+	Forwards []ForwardStatus `json:"forwards,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// controlCall is a request waiting to be handled by the daemon main loop
+type controlCall struct {
+	request ControlRequest
+	reply   chan ControlResponse
+}
+
+func (m *Machine) ControlSocketPath() string {
+	return fmt.Sprintf("%s/%s", MachineDirectory(m.Name), controlSocketName)
+}
+
+// Control sends the command to the daemon of the machine and returns its response
+func (m *Machine) Control(command string) (*ControlResponse, error) {
+	conn, err := net.DialTimeout("unix", m.ControlSocketPath(), time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach the daemon of machine %s: %v", m.Name, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * controlTimeout))
+
+	if err = json.NewEncoder(conn).Encode(ControlRequest{Command: command}); err != nil {
+		return nil, err
+	}
+	var response ControlResponse
+	if err = json.NewDecoder(conn).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid response from the daemon of machine %s: %v", m.Name, err)
+	}
+	if response.Error != utils.Empty {
+		return &response, errors.New(response.Error)
+	}
+	return &response, nil
+}
+
+// VMState returns the live state of the virtual machine, as known by its daemon
+func (m *Machine) VMState() (string, error) {
+	response, err := m.Control(ControlState)
+	if err != nil {
+		return utils.Empty, err
+	}
+	return response.VMState, nil
+}
+
+// listenControl serves the control socket, the requests are forwarded to the returned channel
+// until the listener is closed.
+func (m *Machine) listenControl() (net.Listener, <-chan *controlCall, error) {
+	// a crashed daemon leaves its socket behind
+	os.Remove(m.ControlSocketPath())
+	listener, err := net.Listen("unix", m.ControlSocketPath())
+	if err != nil {
+		return nil, nil, err
+	}
+	calls := make(chan *controlCall)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveControlConn(conn, calls)
+		}
+	}()
+	return listener, calls, nil
+}
+
+func serveControlConn(conn net.Conn, calls chan<- *controlCall) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * controlTimeout))
+
+	var response ControlResponse
+	call := &controlCall{reply: make(chan ControlResponse, 1)}
+	if err := json.NewDecoder(conn).Decode(&call.request); err != nil {
+		response.Error = fmt.Sprintf("invalid request: %v", err)
+	} else {
+		select {
+		case calls <- call:
+			response = <-call.reply
+		case <-time.After(controlTimeout):
+			response.Error = "the daemon didn't handle the request in time"
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(response); err != nil {
+		utils.Logger.Debug("cannot answer a control request", err)
+	}
+}
+
+// control handles a request in the daemon main loop, exit is true when the daemon must leave
+func (m *Machine) control(vm VM, request ControlRequest) (response ControlResponse, exit bool) {
+	var err error
+	response.Pid = os.Getpid()
+	switch request.Command {
+	case ControlStatus:
+		response.Status, err = m.Status()
+	case ControlState:
+	case ControlRequestStop:
+		response.Accepted, err = m.requestStop(vm)
+	case ControlForceStop:
+		exit = true
+	case ControlPause:
+		err = m.pause(vm)
+	case ControlResume:
+		err = m.resume(vm)
+	case ControlForwards:
+		if m.forwarder != nil {
+			response.Forwards = m.forwarder.status()
+		}
+	case ControlReloadForwards:
+		err = m.reloadForwards()
+	default:
+		err = fmt.Errorf("unknown command %q", request.Command)
+	}
+	response.VMState = vm.State().String()
+	if err != nil {
+		response.Error = err.Error()
+	}
+	return response, exit
+}
+
+// reloadForwards reads the port forwards of the saved spec, the forwards already served are kept.
+// The automatic forwards follow at the next inspection of the guest.
+func (m *Machine) reloadForwards() error {
+	if m.forwarder == nil {
+		return fmt.Errorf("the machine %s doesn't forward ports", m.Name)
+	}
+	if err := m.readSavedForwards(); err != nil {
+		return err
+	}
+	m.forwarder.setAutoForward(m.Spec.AutoForward)
+	return m.forwarder.sync(m.Spec.Ports)
+}
+
+// readSavedForwards reads the port forwards of the saved spec, they're changed by the CLI while the daemon runs
+func (m *Machine) readSavedForwards() error {
+	saved, err := FromFileSpec(m.Name)
+	if err != nil {
+		return err
+	}
+	m.Spec.Ports, m.Spec.AutoForward = saved.Spec.Ports, saved.Spec.AutoForward
+	return nil
+}
+
+// requestStop asks the guest to stop, a paused machine is resumed first to be able to handle it
+func (m *Machine) requestStop(vm VM) (bool, error) {
+	if vm.State() == VMStatePaused {
+		if err := m.resume(vm); err != nil {
+			return false, err
+		}
+	}
+	if err := m.Transition(Machine_state_stopping); err != nil {
+		return false, err
+	}
+	// the guest may ignore the request, it keeps running and the stop command escalates then
+	accepted, err := vm.RequestStop()
+	if err != nil {
+		utils.Logger.Warn("The machine", m.Name, "cannot be requested to stop: ", err)
+	} else if !accepted {
+		utils.Logger.Info("The machine", m.Name, "did not accept the stop request")
+	}
+	if !accepted {
+		if err := m.Transition(Machine_state_running); err != nil {
+			return false, err
+		}
+	}
+	return accepted, nil
+}
+
+func (m *Machine) pause(vm VM) error {
+	if err := m.Transition(Machine_state_paused); err != nil {
+		return err
+	}
+	if err := waitCompletion(vm.Pause); err != nil {
+		m.Transition(Machine_state_running)
+		return fmt.Errorf("cannot pause machine %s: %v", m.Name, err)
+	}
+	return nil
+}
+
+func (m *Machine) resume(vm VM) error {
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if status.State != Machine_state_paused {
+		return &InvalidTransitionError{Machine: m.Name, From: status.State, To: Machine_state_running}
+	}
+	if err = waitCompletion(vm.Resume); err != nil {
+		return fmt.Errorf("cannot resume machine %s: %v", m.Name, err)
+	}
+	return m.Transition(Machine_state_running)
+}
+
+// waitCompletion runs an asynchronous VM operation and waits for its result
+func waitCompletion(operation func(fn func(error))) error {
+	done := make(chan error, 1)
+	operation(func(err error) {
+		done <- err
+	})
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(controlTimeout):
+		return errors.New("timeout")
+	}
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveTestControl runs the daemon main loop of a running machine in background,
+// the returned channel gets the result of waitTermination.
+func serveTestControl(t *testing.T, m *Machine, driver *FakeDriver) (*FakeVM, <-chan error) {
+	moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+	vm, _ := driver.Create(&VMConfig{})
+	vm.(*FakeVM).SetState(VMStateRunning)
+	<-vm.StateChangedNotify()
+
+	listener, controlCh, err := m.listenControl()
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	done := make(chan error, 1)
+	go func() {
+		done <- m.waitTermination(vm, make(chan os.Signal), controlCh, nil)
+	}()
+	return vm.(*FakeVM), done
+}
+
+func TestMachine_Control(t *testing.T) {
+	t.Run("should report the status and the vm state", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		serveTestControl(t, m, NewFakeDriver())
+
+		response, err := m.Control(ControlStatus)
+		assert.NoError(t, err)
+		assert.Equal(t, "running", response.VMState)
+		assert.Equal(t, Machine_state_running, response.Status.State)
+		state, err := m.VMState()
+		assert.NoError(t, err)
+		assert.Equal(t, "running", state)
+	})
+
+	t.Run("should pause and resume the machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		vm, _ := serveTestControl(t, m, NewFakeDriver())
+
+		response, err := m.Control(ControlPause)
+		assert.NoError(t, err)
+		assert.Equal(t, "paused", response.VMState)
+		assert.Equal(t, Machine_state_paused, m.State())
+
+		response, err = m.Control(ControlResume)
+		assert.NoError(t, err)
+		assert.Equal(t, "running", response.VMState)
+		assert.Equal(t, VMStateRunning, vm.State())
+		assert.Equal(t, Machine_state_running, m.State())
+	})
+
+	t.Run("should refuse to resume a running machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		serveTestControl(t, m, NewFakeDriver())
+
+		_, err := m.Control(ControlResume)
+		assert.Error(t, err)
+		assert.Equal(t, Machine_state_running, m.State())
+	})
+
+	t.Run("should stop the machine on request", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		vm, done := serveTestControl(t, m, NewFakeDriver())
+
+		response, err := m.Control(ControlRequestStop)
+		assert.NoError(t, err)
+		assert.True(t, response.Accepted)
+		assert.NoError(t, <-done)
+		assert.Equal(t, 1, vm.StopRequests())
+		assert.Equal(t, Machine_state_stop, m.State())
+		assert.NoFileExists(t, m.ControlSocketPath())
+	})
+
+	t.Run("should resume a paused machine to stop it", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		_, done := serveTestControl(t, m, NewFakeDriver())
+		_, err := m.Control(ControlPause)
+		assert.NoError(t, err)
+
+		_, err = m.Control(ControlRequestStop)
+		assert.NoError(t, err)
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("should leave on force stop", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		driver := NewFakeDriver()
+		driver.IgnoreStopRequest = true
+		vm, done := serveTestControl(t, m, driver)
+
+		response, err := m.Control(ControlRequestStop)
+		assert.NoError(t, err)
+		assert.False(t, response.Accepted)
+		// the guest keeps running
+		assert.Equal(t, Machine_state_running, m.State())
+		_, err = m.Control(ControlForceStop)
+		assert.NoError(t, err)
+		assert.NoError(t, <-done)
+		assert.Equal(t, VMStateRunning, vm.State())
+		assert.Equal(t, Machine_state_stop, m.State())
+	})
+
+	t.Run("should reject an unknown command", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		serveTestControl(t, m, NewFakeDriver())
+
+		response, err := m.Control("reboot")
+		assert.Error(t, err)
+		assert.Equal(t, "running", response.VMState)
+	})
+
+	t.Run("should fail without daemon", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		m.BaseDirectory()
+
+		_, err := m.Control(ControlStatus)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"github.com/pkg/sftp"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// progressThreshold is the size from which the progress of a file is reported
+const progressThreshold = 8 * 1024 * 1024
+
+// CopyOptions configures a copy between the host and a machine
+type CopyOptions struct {
+	// Progress receives the progress of the large files, nothing is reported when nil
+	Progress io.Writer
+}
+
+// ParseCopyPath splits a machine:path argument, machine is empty for a path of the host.
+// A host path holding a colon is written with a directory, like ./a:b.
+func ParseCopyPath(value string) (machine, path string) {
+	index := strings.Index(value, ":")
+	if index <= 0 || strings.ContainsAny(value[:index], `/\`) || !machineNamePattern.MatchString(value[:index]) {
+		return utils.Empty, value
+	}
+	if path = value[index+1:]; path == utils.Empty {
+		path = "."
+	}
+	return value[:index], path
+}
+
+// Copy copies a file or a directory between the host and a machine, like docker cp.
+// One of the paths is in a machine, written machine:path, it's relative to the home of the ssh user.
+func Copy(source, destination string, options CopyOptions) error {
+	sourceMachine, sourcePath := ParseCopyPath(source)
+	destinationMachine, destinationPath := ParseCopyPath(destination)
+	if (sourceMachine == utils.Empty) == (destinationMachine == utils.Empty) {
+		return errors.New("exactly one of the paths must be in a machine, written <name>:<path>")
+	}
+	name := sourceMachine + destinationMachine
+	machine, err := FromFileSpec(name)
+	if err != nil {
+		return fmt.Errorf("the machine %s can't be loaded: %v", name, err)
+	}
+	address, err := machine.SshAddress()
+	if err != nil {
+		return err
+	}
+	return copyOverSftp(address, sourcePath, destinationPath, destinationMachine != utils.Empty, options)
+}
+
+// copyOverSftp uploads source to destination, or downloads it when upload is false
+func copyOverSftp(address, source, destination string, upload bool, options CopyOptions) error {
+	client, session, err := connectToHost(DefaultSshUser, address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	defer session.Close()
+
+	input, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	output, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		return fmt.Errorf("the sftp subsystem isn't available: %v", err)
+	}
+	sftpClient, err := sftp.NewClientPipe(output, input, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	var local, remote copyFS = localFS{}, remoteFS{sftpClient}
+	if upload {
+		return copyTree(local, source, remote, destination, options)
+	}
+	return copyTree(remote, source, local, destination, options)
+}
+
+// copyFS is the filesystem of one side of a copy
+type copyFS interface {
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	ReadLink(name string) (string, error)
+	Open(name string) (io.ReadCloser, error)
+	// Create creates a new file, it fails when it exists
+	Create(name string) (io.WriteCloser, error)
+	Mkdir(name string) error
+	Symlink(target, name string) error
+	Chmod(name string, mode os.FileMode) error
+	// Rename replaces to by from
+	Rename(from, to string) error
+	Remove(name string) error
+	Join(elem ...string) string
+	Split(name string) (dir, file string)
+}
+
+type localFS struct{}
+
+func (localFS) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (localFS) Lstat(name string) (os.FileInfo, error)     { return os.Lstat(name) }
+func (localFS) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+func (localFS) ReadLink(name string) (string, error)       { return os.Readlink(name) }
+func (localFS) Open(name string) (io.ReadCloser, error)    { return os.Open(name) }
+func (localFS) Mkdir(name string) error                    { return os.Mkdir(name, 0755) }
+func (localFS) Symlink(target, name string) error          { return os.Symlink(target, name) }
+func (localFS) Chmod(name string, mode os.FileMode) error  { return os.Chmod(name, mode) }
+func (localFS) Rename(from, to string) error               { return os.Rename(from, to) }
+func (localFS) Remove(name string) error                   { return os.Remove(name) }
+func (localFS) Join(elem ...string) string                 { return filepath.Join(elem...) }
+func (localFS) Split(name string) (string, string)         { return filepath.Split(filepath.Clean(name)) }
+
+func (localFS) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+}
+
+type remoteFS struct {
+	*sftp.Client
+}
+
+func (r remoteFS) Open(name string) (io.ReadCloser, error) { return r.Client.Open(name) }
+func (remoteFS) Join(elem ...string) string                { return path.Join(elem...) }
+func (remoteFS) Split(name string) (string, string)        { return path.Split(path.Clean(name)) }
+
+func (r remoteFS) Create(name string) (io.WriteCloser, error) {
+	return r.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+}
+
+func (r remoteFS) Rename(from, to string) error {
+	// the rename of the sftp protocol doesn't replace an existing file, the openssh extension does
+	if err := r.PosixRename(from, to); err == nil {
+		return nil
+	}
+	if err := r.Client.Remove(to); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return r.Client.Rename(from, to)
+}
+
+// copyTree copies source into destination with the rules of docker cp: a directory is copied into an
+// existing directory, or created with the content of source. source ending with /. copies its content.
+func copyTree(src copyFS, source string, dst copyFS, destination string, options CopyOptions) error {
+	info, err := src.Lstat(source)
+	if err != nil {
+		return err
+	}
+	target := destination
+	existing, err := dst.Stat(destination)
+	switch {
+	case err == nil && existing.IsDir():
+		if !info.IsDir() || !strings.HasSuffix(source, "/.") {
+			_, name := src.Split(source)
+			target = dst.Join(destination, name)
+		}
+	case err == nil:
+		if info.IsDir() {
+			return fmt.Errorf("cannot copy the directory %s to the file %s", source, destination)
+		}
+	case os.IsNotExist(err):
+		if strings.HasSuffix(destination, "/") && !info.IsDir() {
+			return fmt.Errorf("the directory %s doesn't exist", destination)
+		}
+		dir, _ := dst.Split(destination)
+		if dir != utils.Empty {
+			if parent, err := dst.Stat(dir); err != nil || !parent.IsDir() {
+				return fmt.Errorf("the directory %s doesn't exist", dir)
+			}
+		}
+	default:
+		return err
+	}
+	return copyEntry(src, source, info, dst, target, options)
+}
+
+// copyEntry copies source to target, directories are copied recursively and symbolic links as is
+func copyEntry(src copyFS, source string, info os.FileInfo, dst copyFS, target string, options CopyOptions) error {
+	mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	switch {
+	case info.IsDir():
+		if existing, err := dst.Lstat(target); err != nil || !existing.IsDir() {
+			if err = dst.Mkdir(target); err != nil {
+				return err
+			}
+		}
+		entries, err := src.ReadDir(source)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = copyEntry(src, src.Join(source, entry.Name()), entry, dst, dst.Join(target, entry.Name()), options); err != nil {
+				return err
+			}
+		}
+		// the mode is set last, the directory may not be writable
+		return dst.Chmod(target, mode)
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := src.ReadLink(source)
+		if err != nil {
+			return err
+		}
+		if err = dst.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return dst.Symlink(link, target)
+	case info.Mode().IsRegular():
+		return copyFile(src, source, info, dst, target, mode, options)
+	default:
+		utils.Logger.Warnf("%s is not a regular file, it's not copied", source)
+		return nil
+	}
+}
+
+// copyFile writes the content of source to a temporary file next to target, which is renamed once complete
+func copyFile(src copyFS, source string, info os.FileInfo, dst copyFS, target string, mode os.FileMode, options CopyOptions) (err error) {
+	dir, name := dst.Split(target)
+	temporary := dst.Join(dir, fmt.Sprintf(".%s.machina-%s", name, strconv.FormatInt(time.Now().UnixNano(), 36)))
+	input, err := src.Open(source)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	output, err := dst.Create(temporary)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			output.Close()
+			dst.Remove(temporary)
+		}
+	}()
+
+	var report *progress
+	if options.Progress != nil && info.Size() >= progressThreshold {
+		report = newProgress(options.Progress, name, info.Size())
+	}
+	if err = copyContent(output, input, report); err != nil {
+		return err
+	}
+	if err = output.Close(); err != nil {
+		return err
+	}
+	if err = dst.Chmod(temporary, mode); err != nil {
+		return err
+	}
+	return dst.Rename(temporary, target)
+}
+
+// copyContent keeps the concurrent transfers of sftp: the progress is counted on the side which isn't sftp
+func copyContent(output io.Writer, input io.Reader, report *progress) error {
+	if report == nil {
+		_, err := io.Copy(output, input)
+		return err
+	}
+	defer report.done()
+	var err error
+	if _, ok := input.(*sftp.File); ok {
+		_, err = io.Copy(io.MultiWriter(output, report), input)
+	} else {
+		_, err = io.Copy(output, io.TeeReader(input, report))
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSftpServer serves the filesystem of the host over sftp
+func startTestSftpServer(t *testing.T) string {
+	newTestMachine(t, nil)
+	return startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 {
+		if request.Subsystem != "sftp" {
+			return 1
+		}
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return 1
+		}
+		server.Serve()
+		return 0
+	})
+}
+
+// writeTree creates the files of tree in dir, a name ending with / is a directory
+func writeTree(t *testing.T, dir string, tree map[string]string) {
+	for name, content := range tree {
+		if strings.HasSuffix(name, "/") {
+			assert.NoError(t, os.MkdirAll(filepath.Join(dir, name), 0755))
+			continue
+		}
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+}
+
+// readTree returns the files of dir, the directories end with /
+func readTree(t *testing.T, dir string) map[string]string {
+	tree := map[string]string{}
+	assert.NoError(t, filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return err
+		}
+		name, _ := filepath.Rel(dir, path)
+		if info.IsDir() {
+			tree[name+"/"] = ""
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		tree[name] = string(content)
+		return err
+	}))
+	return tree
+}
+
+func TestParseCopyPath(t *testing.T) {
+	for _, test := range []struct {
+		value, machine, path string
+	}{
+		{"ubuntu:/var/log/syslog", "ubuntu", "/var/log/syslog"},
+		{"ubuntu:", "ubuntu", "."},
+		{"./file", "", "./file"},
+		{"./a:b", "", "./a:b"},
+		{"/tmp/a:b", "", "/tmp/a:b"},
+		{":b", "", ":b"},
+	} {
+		machine, path := ParseCopyPath(test.value)
+		assert.Equal(t, test.machine, machine, test.value)
+		assert.Equal(t, test.path, path, test.value)
+	}
+}
+
+func TestCopyOverSftp(t *testing.T) {
+	address := startTestSftpServer(t)
+
+	t.Run("should copy a file into a directory and keep its mode", func(t *testing.T) {
+		host, guest := t.TempDir(), t.TempDir()
+		writeTree(t, host, map[string]string{"run.sh": "#!/bin/sh"})
+		assert.NoError(t, os.Chmod(filepath.Join(host, "run.sh"), 0750))
+
+		assert.NoError(t, copyOverSftp(address, filepath.Join(host, "run.sh"), guest, true, CopyOptions{}))
+		assert.Equal(t, map[string]string{"run.sh": "#!/bin/sh"}, readTree(t, guest))
+		info, err := os.Stat(filepath.Join(guest, "run.sh"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+	})
+
+	t.Run("should replace a file without leaving the temporary file", func(t *testing.T) {
+		host, guest := t.TempDir(), t.TempDir()
+		writeTree(t, host, map[string]string{"syslog": "new"})
+		writeTree(t, guest, map[string]string{"copy": "old"})
+
+		assert.NoError(t, copyOverSftp(address, filepath.Join(guest, "copy"), filepath.Join(host, "syslog"), false, CopyOptions{}))
+		assert.Equal(t, map[string]string{"syslog": "old"}, readTree(t, host))
+	})
+
+	t.Run("should copy a directory recursively", func(t *testing.T) {
+		host, guest := t.TempDir(), t.TempDir()
+		writeTree(t, host, map[string]string{"src/main.go": "package main", "src/pkg/a.go": "package pkg", "src/empty/": ""})
+		assert.NoError(t, os.Symlink("main.go", filepath.Join(host, "src", "link")))
+
+		assert.NoError(t, copyOverSftp(address, filepath.Join(host, "src"), guest, true, CopyOptions{}))
+		assert.Equal(t, map[string]string{
+			"src/": "", "src/main.go": "package main", "src/pkg/": "", "src/pkg/a.go": "package pkg", "src/empty/": "", "src/link": "package main",
+		}, readTree(t, guest))
+		link, err := os.Readlink(filepath.Join(guest, "src", "link"))
+		assert.NoError(t, err)
+		assert.Equal(t, "main.go", link)
+	})
+
+	t.Run("should create the destination directory or copy the content with /.", func(t *testing.T) {
+		host, guest := t.TempDir(), t.TempDir()
+		writeTree(t, guest, map[string]string{"logs/a.log": "a"})
+
+		assert.NoError(t, copyOverSftp(address, filepath.Join(guest, "logs"), filepath.Join(host, "copy"), false, CopyOptions{}))
+		assert.NoError(t, copyOverSftp(address, filepath.Join(guest, "logs")+"/.", host, false, CopyOptions{}))
+		assert.Equal(t, map[string]string{"copy/": "", "copy/a.log": "a", "a.log": "a"}, readTree(t, host))
+	})
+
+	t.Run("should refuse a missing destination directory", func(t *testing.T) {
+		host, guest := t.TempDir(), t.TempDir()
+		writeTree(t, host, map[string]string{"file": "content", "dir/": ""})
+
+		assert.Error(t, copyOverSftp(address, filepath.Join(host, "file"), filepath.Join(guest, "missing")+"/", true, CopyOptions{}))
+		assert.Error(t, copyOverSftp(address, filepath.Join(host, "file"), filepath.Join(guest, "missing", "file"), true, CopyOptions{}))
+		writeTree(t, guest, map[string]string{"file": ""})
+		assert.Error(t, copyOverSftp(address, filepath.Join(host, "dir"), filepath.Join(guest, "file"), true, CopyOptions{}))
+	})
+
+	t.Run("should report the progress of a large file", func(t *testing.T) {
+		host, guest := t.TempDir(), t.TempDir()
+		assert.NoError(t, os.WriteFile(filepath.Join(host, "disk.img"), make([]byte, progressThreshold), 0644))
+		var output bytes.Buffer
+
+		assert.NoError(t, copyOverSftp(address, filepath.Join(host, "disk.img"), guest, true, CopyOptions{Progress: &output}))
+		assert.True(t, strings.HasSuffix(output.String(), "\rdisk.img 100% 8.0MiB/8.0MiB\n"), output.String())
+	})
+}
@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	dataDisksDirectoryName = "disks"
+	dataDiskExtension      = ".img"
+)
+
+// DataDisk is an additional disk attached to a machine.
+// A shared disk is in the disks store and can be attached to several machines, the other ones are in the machine directory.
+type DataDisk struct {
+	Name     string `json:"name"`
+	Shared   bool   `json:"shared,omitempty"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+func (d DataDisk) String() string {
+	if d.ReadOnly {
+		return d.Name + ":ro"
+	}
+	return d.Name
+}
+
+// DataDiskInfo is a data disk along with the machines it's attached to
+type DataDiskInfo struct {
+	Name string
+	// Machine owns the disk, it's empty for a shared disk
+	Machine string
+	Size    int64
+	// Attachments are the machines the disk is attached to, with :ro when read only
+	Attachments []string
+}
+
+func (m *Machine) dataDisksDirectory() string {
+	return fmt.Sprintf("%s/%s", MachineDirectory(m.Name), dataDisksDirectoryName)
+}
+
+func (m *Machine) dataDiskPath(disk DataDisk) string {
+	if disk.Shared {
+		return sharedDataDiskPath(disk.Name)
+	}
+	return fmt.Sprintf("%s/%s%s", m.dataDisksDirectory(), disk.Name, dataDiskExtension)
+}
+
+func sharedDataDiskPath(name string) string {
+	return fmt.Sprintf("%s/%s%s", baseDiskDirectory(), name, dataDiskExtension)
+}
+
+// CreateDataDisk creates an empty sparse disk of size, in the directory of the machine or in the shared store when nil
+func CreateDataDisk(name string, size uint64, machine *Machine) (string, error) {
+	if !machineNamePattern.MatchString(name) {
+		return utils.Empty, fmt.Errorf("invalid disk name %q, it must match %s", name, machineNamePattern)
+	}
+	if size == 0 {
+		return utils.Empty, fmt.Errorf("the disk %s needs a size", name)
+	}
+	path := sharedDataDiskPath(name)
+	if machine != nil {
+		if !ListExistingMachines().Contains(machine.Name) {
+			return utils.Empty, fmt.Errorf("the machine %s doesn't exist", machine.Name)
+		}
+		if err := DirectoryCreateIfAbsent(machine.dataDisksDirectory()); err != nil && !os.IsExist(err) {
+			return utils.Empty, err
+		}
+		path = machine.dataDiskPath(DataDisk{Name: name})
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return utils.Empty, fmt.Errorf("the disk %s already exists", name)
+	} else if err != nil {
+		return utils.Empty, err
+	}
+	if err = file.Truncate(int64(size)); err != nil {
+		file.Close()
+		os.Remove(path)
+		return utils.Empty, err
+	}
+	return path, file.Close()
+}
+
+// AttachDisk records the data disk in the spec, a disk of the machine is preferred to a shared one with the same name.
+// It's attached at the next start of the machine.
+func (m *Machine) AttachDisk(name string, readOnly bool) error {
+	for _, disk := range m.Spec.DataDisks {
+		if disk.Name == name {
+			return fmt.Errorf("the disk %s is already attached to machine %s", name, m.Name)
+		}
+	}
+	disk := DataDisk{Name: name, ReadOnly: readOnly}
+	if _, err := os.Stat(m.dataDiskPath(disk)); os.IsNotExist(err) {
+		disk.Shared = true
+	}
+	if _, err := os.Stat(m.dataDiskPath(disk)); err != nil {
+		return fmt.Errorf("no disk %s for machine %s, create it with `machina disk create`", name, m.Name)
+	}
+	m.Spec.DataDisks = append(m.Spec.DataDisks, disk)
+	return m.ExportMachineSpecification()
+}
+
+// DetachDisk removes the data disk from the spec, it's detached at the next start of the machine.
+// The disks attached after it get the following device names, the guest mounts them by UUID or label.
+func (m *Machine) DetachDisk(name string) error {
+	for i, disk := range m.Spec.DataDisks {
+		if disk.Name == name {
+			m.Spec.DataDisks = append(m.Spec.DataDisks[:i:i], m.Spec.DataDisks[i+1:]...)
+			return m.ExportMachineSpecification()
+		}
+	}
+	return fmt.Errorf("the disk %s isn't attached to machine %s", name, m.Name)
+}
+
+// dataDiskConfigs returns the block devices of the data disks in the order of the spec.
+// A shared disk is attached read-write to one running machine at most, it's locked until cleanBeforeExit.
+func (m *Machine) dataDiskConfigs() ([]DiskConfig, error) {
+	m.unlockDataDisks()
+	configs := make([]DiskConfig, 0, len(m.Spec.DataDisks))
+	for _, disk := range m.Spec.DataDisks {
+		path := m.dataDiskPath(disk)
+		if _, err := os.Stat(path); err != nil {
+			m.unlockDataDisks()
+			return nil, fmt.Errorf("the disk %s of machine %s is missing: %v", disk.Name, m.Name, err)
+		}
+		if disk.Shared && !disk.ReadOnly {
+			if err := m.lockDataDisk(disk, path); err != nil {
+				m.unlockDataDisks()
+				return nil, err
+			}
+		}
+		configs = append(configs, DiskConfig{Path: path, ReadOnly: disk.ReadOnly})
+	}
+	return configs, nil
+}
+
+// lockDataDisk takes the lock of a shared disk the machine writes, a machine starting at the same time fails to take it.
+// The running machines recorded with the disk are refused too.
+func (m *Machine) lockDataDisk(disk DataDisk, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return fmt.Errorf("the disk %s is attached read-write to another running machine", disk.Name)
+		}
+		return fmt.Errorf("cannot lock the disk %s: %v", disk.Name, err)
+	}
+	m.diskLocks = append(m.diskLocks, f)
+	if other := writerOf(disk.Name, m.Name); other != utils.Empty {
+		return fmt.Errorf("the disk %s is attached read-write to the running machine %s", disk.Name, other)
+	}
+	return nil
+}
+
+// unlockDataDisks releases the locks of the shared disks
+func (m *Machine) unlockDataDisks() {
+	for _, f := range m.diskLocks {
+		f.Close()
+	}
+	m.diskLocks = nil
+}
+
+// writerOf returns the active machine, other than except, which has the shared disk attached read-write
+func writerOf(name string, except string) string {
+	for _, machineName := range ListExistingMachines().List() {
+		if machineName == except {
+			continue
+		}
+		machine, err := FromFileSpec(machineName)
+		if err != nil {
+			continue
+		}
+		for _, disk := range machine.Spec.DataDisks {
+			if disk.Shared && disk.Name == name && !disk.ReadOnly && machine.IsActive() {
+				return machineName
+			}
+		}
+	}
+	return utils.Empty
+}
+
+// ListDataDisks returns the shared disks then the disks of each machine, sorted by name
+func ListDataDisks() ([]DataDiskInfo, error) {
+	type diskKey struct{ name, machine string }
+	var disks []DataDiskInfo
+	attachments := map[diskKey][]string{}
+	machines := ListExistingMachines().List()
+	sort.Strings(machines)
+	for _, machineName := range machines {
+		machine, err := FromFileSpec(machineName)
+		if err != nil {
+			continue
+		}
+		for _, disk := range machine.Spec.DataDisks {
+			key := diskKey{name: disk.Name}
+			if !disk.Shared {
+				key.machine = machineName
+			}
+			attachment := machineName
+			if disk.ReadOnly {
+				attachment += ":ro"
+			}
+			attachments[key] = append(attachments[key], attachment)
+		}
+	}
+
+	for _, owner := range append([]string{utils.Empty}, machines...) {
+		dir := baseDiskDirectory()
+		if owner != utils.Empty {
+			dir = (&Machine{Name: owner}).dataDisksDirectory()
+		}
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasSuffix(entry.Name(), dataDiskExtension) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			name := strings.TrimSuffix(entry.Name(), dataDiskExtension)
+			disks = append(disks, DataDiskInfo{Name: name, Machine: owner, Size: info.Size(), Attachments: attachments[diskKey{name, owner}]})
+		}
+	}
+	return disks, nil
+}
@@ -0,0 +1,120 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateDataDisk(t *testing.T) {
+	m := newTestMachine(t, nil)
+	m.BaseDirectory()
+
+	t.Run("should create a sparse disk of the size", func(t *testing.T) {
+		path, err := CreateDataDisk("datasets", 100*GB, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, sharedDataDiskPath("datasets"), path)
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(100*GB), info.Size())
+
+		path, err = CreateDataDisk("cache", GB, m)
+		assert.NoError(t, err)
+		assert.Equal(t, m.dataDiskPath(DataDisk{Name: "cache"}), path)
+	})
+
+	t.Run("should refuse an existing disk, an empty size or a missing machine", func(t *testing.T) {
+		_, err := CreateDataDisk("datasets", GB, nil)
+		assert.Error(t, err)
+		_, err = CreateDataDisk("empty", 0, nil)
+		assert.Error(t, err)
+		_, err = CreateDataDisk("cache", GB, &Machine{Name: "missing"})
+		assert.Error(t, err)
+		_, err = CreateDataDisk("../cache", GB, nil)
+		assert.Error(t, err)
+	})
+
+	t.Run("should list the disks with their attachments", func(t *testing.T) {
+		assert.NoError(t, m.ExportMachineSpecification())
+		assert.NoError(t, m.AttachDisk("datasets", true))
+
+		disks, err := ListDataDisks()
+		assert.NoError(t, err)
+		assert.Equal(t, []DataDiskInfo{
+			{Name: "datasets", Size: 100 * GB, Attachments: []string{"test:ro"}},
+			{Name: "cache", Machine: "test", Size: GB},
+		}, disks)
+	})
+}
+
+func TestMachine_AttachDisk(t *testing.T) {
+	t.Run("should attach the disks in order after the seed image", func(t *testing.T) {
+		m := newTestMachine(t, NewFakeDriver())
+		m.BaseDirectory()
+		_, err := CreateDataDisk("cache", GB, m)
+		assert.NoError(t, err)
+		_, err = CreateDataDisk("datasets", GB, nil)
+		assert.NoError(t, err)
+
+		assert.NoError(t, m.AttachDisk("datasets", true))
+		assert.NoError(t, m.AttachDisk("cache", false))
+		assert.Error(t, m.AttachDisk("cache", false))
+		assert.Error(t, m.AttachDisk("missing", false))
+
+		saved, err := FromFileSpec(m.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, []DataDisk{{Name: "datasets", Shared: true, ReadOnly: true}, {Name: "cache"}}, saved.Spec.DataDisks)
+		config, err := m.vmConfig(2, 2*GB)
+		assert.NoError(t, err)
+		assert.Equal(t, []DiskConfig{
+			{Path: sharedDataDiskPath("datasets"), ReadOnly: true},
+			{Path: m.dataDiskPath(DataDisk{Name: "cache"})},
+		}, config.Disks[2:])
+
+		assert.NoError(t, m.DetachDisk("datasets"))
+		assert.Equal(t, []DataDisk{{Name: "cache"}}, m.Spec.DataDisks)
+		assert.Error(t, m.DetachDisk("datasets"))
+	})
+
+	t.Run("should refuse a shared disk written by another running machine", func(t *testing.T) {
+		m := newTestMachine(t, NewFakeDriver())
+		m.BaseDirectory()
+		_, err := CreateDataDisk("datasets", GB, nil)
+		assert.NoError(t, err)
+		other := &Machine{Name: "other", Distribution: m.Distribution, Spec: m.Spec}
+		moveTo(t, other, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+		assert.NoError(t, other.ExportMachineSpecification())
+		assert.NoError(t, other.AttachDisk("datasets", false))
+
+		assert.NoError(t, m.AttachDisk("datasets", false))
+		_, err = m.dataDiskConfigs()
+		assert.EqualError(t, err, "the disk datasets is attached read-write to the running machine other")
+
+		assert.NoError(t, m.DetachDisk("datasets"))
+		assert.NoError(t, m.AttachDisk("datasets", true))
+		_, err = m.dataDiskConfigs()
+		assert.NoError(t, err)
+	})
+
+	t.Run("should refuse a shared disk written by a machine starting at the same time", func(t *testing.T) {
+		m := newTestMachine(t, NewFakeDriver())
+		m.BaseDirectory()
+		_, err := CreateDataDisk("datasets", GB, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, m.AttachDisk("datasets", false))
+		other := &Machine{Name: "other", Distribution: m.Distribution, Spec: m.Spec}
+		other.BaseDirectory()
+		assert.NoError(t, other.ExportMachineSpecification())
+
+		_, err = m.dataDiskConfigs()
+		assert.NoError(t, err)
+		_, err = other.dataDiskConfigs()
+		assert.EqualError(t, err, "the disk datasets is attached read-write to another running machine")
+
+		m.cleanBeforeExit()
+		_, err = other.dataDiskConfigs()
+		assert.NoError(t, err)
+		other.cleanBeforeExit()
+	})
+}
@@ -0,0 +1,358 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"gopkg.in/yaml.v3"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	Max_cpu_number = 8
+	Max_mem_size   = 16 * GB
+)
+
+var (
+	machineNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]*$`)
+	sizePattern        = regexp.MustCompile(`^(\d+)\s*([kKmMgGtT]?)(i?[bB])?$`)
+	sizeUnits          = map[string]uint64{"": 1, "k": 1024, "m": 1024 * 1024, "g": GB, "t": 1024 * GB}
+)
+
+// MachineDefinition is the declarative form of a machine, read by `machina apply` and written by `machina get`.
+// Sizes are written like 2G or 2048M, a memory without unit is in MB and a disk without unit in GB.
+type MachineDefinition struct {
+	Name         string `yaml:"name"`
+	Distribution string `yaml:"distribution,omitempty"`
+	Release      string `yaml:"release,omitempty"`
+	Arch         string `yaml:"arch,omitempty"`
+	Cpu          uint   `yaml:"cpu,omitempty"`
+	Memory       string `yaml:"memory,omitempty"`
+	Disk         string `yaml:"disk,omitempty"`
+	// Ports are host:guest port forwards, a list or a comma separated string
+	Ports *utils.Set `yaml:"ports,omitempty"`
+	// AutoForward forwards the ports opened in the guest, an empty one includes the unprivileged ports
+	AutoForward *AutoForward `yaml:"auto_forward,omitempty"`
+	// CloudInit is merged into the cloud-init user-data of the machine
+	CloudInit map[string]interface{} `yaml:"cloud_init,omitempty"`
+	Labels    map[string]string      `yaml:"labels,omitempty"`
+}
+
+// DefinitionChange is a difference between a definition and an existing machine
+type DefinitionChange struct {
+	Field string
+	From  string
+	To    string
+}
+
+func (c DefinitionChange) String() string {
+	from, to := c.From, c.To
+	if from == utils.Empty {
+		from = "<none>"
+	}
+	if to == utils.Empty {
+		to = "<none>"
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Field, from, to)
+}
+
+// PortForward forwards a port of the host to a port of the guest
+type PortForward struct {
+	Host  int `json:"host"`
+	Guest int `json:"guest"`
+}
+
+// ReadDefinitions reads the machine definitions of a YAML stream, documents are separated by ---
+func ReadDefinitions(reader io.Reader) ([]*MachineDefinition, error) {
+	var definitions []*MachineDefinition
+	decoder := yaml.NewDecoder(reader)
+	decoder.KnownFields(true)
+	for {
+		definition := &MachineDefinition{}
+		err := decoder.Decode(definition)
+		if errors.Is(err, io.EOF) {
+			return definitions, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid machine definition: %v", err)
+		}
+		if err = definition.Validate(); err != nil {
+			return nil, err
+		}
+		definitions = append(definitions, definition)
+	}
+}
+
+// Validate checks every field of the definition
+func (d *MachineDefinition) Validate() error {
+	if !machineNamePattern.MatchString(d.Name) {
+		return fmt.Errorf("invalid machine name %q", d.Name)
+	}
+	if d.Distribution != utils.Empty {
+		if _, err := NewDistribution(d.Distribution, d.Release, d.Arch); err != nil {
+			return fmt.Errorf("machine %s: %v", d.Name, err)
+		}
+	}
+	if d.Cpu > Max_cpu_number {
+		return fmt.Errorf("machine %s: at most %d cpu can be allocated", d.Name, Max_cpu_number)
+	}
+	if d.Memory != utils.Empty {
+		memory, err := ParseSize(d.Memory, 1024*1024)
+		if err != nil {
+			return fmt.Errorf("machine %s: invalid memory: %v", d.Name, err)
+		}
+		if memory > Max_mem_size {
+			return fmt.Errorf("machine %s: at most %s of memory can be allocated", d.Name, FormatSize(Max_mem_size))
+		}
+	}
+	if d.Disk != utils.Empty {
+		if _, err := ParseSize(d.Disk, GB); err != nil {
+			return fmt.Errorf("machine %s: invalid disk: %v", d.Name, err)
+		}
+	}
+	if _, err := ResolvePortForwards(setList(d.Ports)); err != nil {
+		return fmt.Errorf("machine %s: %v", d.Name, err)
+	}
+	if d.AutoForward != nil {
+		if err := d.AutoForward.Validate(); err != nil {
+			return fmt.Errorf("machine %s: %v", d.Name, err)
+		}
+	}
+	return nil
+}
+
+// Machine returns the machine described by the definition, the omitted fields get their default value
+func (d *MachineDefinition) Machine() (*Machine, error) {
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	kind := d.Distribution
+	if kind == utils.Empty {
+		kind = DefaultDistribution
+	}
+	distribution, err := NewDistribution(kind, d.Release, d.Arch)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := d.spec()
+	if err != nil {
+		return nil, err
+	}
+	return &Machine{Name: d.Name, Distribution: distribution, Spec: spec}, nil
+}
+
+func (d *MachineDefinition) spec() (MachineSpec, error) {
+	spec := MachineSpec{Cpu: d.Cpu, Ram: Default_mem_mb, Labels: d.Labels}
+	if spec.Cpu == 0 {
+		spec.Cpu = Default_cpu_number
+	}
+	var err error
+	if d.Memory != utils.Empty {
+		if spec.Ram, err = ParseSize(d.Memory, 1024*1024); err != nil {
+			return spec, err
+		}
+	}
+	if d.Disk != utils.Empty {
+		if spec.Disk, err = ParseSize(d.Disk, GB); err != nil {
+			return spec, err
+		}
+	}
+	spec.Ports = setList(d.Ports)
+	spec.AutoForward = d.AutoForward
+	if len(d.CloudInit) > 0 {
+		content, err := yaml.Marshal(d.CloudInit)
+		if err != nil {
+			return spec, err
+		}
+		spec.CloudInit = string(content)
+	}
+	return spec, nil
+}
+
+// DefinitionOf exports an existing machine as a definition
+func DefinitionOf(m *Machine) (*MachineDefinition, error) {
+	d := &MachineDefinition{
+		Name:   m.Name,
+		Cpu:    m.Spec.Cpu,
+		Memory: FormatSize(m.Spec.Ram),
+		Disk:   FormatSize(m.DiskSize()),
+		Labels: m.Spec.Labels,
+	}
+	if m.Distribution != nil {
+		d.Distribution, d.Release, d.Arch = m.Distribution.Kind(), m.Distribution.Release(), m.Distribution.Arch()
+	}
+	if len(m.Spec.Ports) > 0 {
+		d.Ports = utils.NewSetFromArray(m.Spec.Ports)
+	}
+	d.AutoForward = m.Spec.AutoForward
+	if m.Spec.CloudInit != utils.Empty {
+		if err := yaml.Unmarshal([]byte(m.Spec.CloudInit), &d.CloudInit); err != nil {
+			return nil, fmt.Errorf("invalid cloud-init of machine %s: %v", m.Name, err)
+		}
+	}
+	return d, nil
+}
+
+// Diff returns the changes to apply to the machine to match the definition.
+// The distribution, release and architecture are compared when set only since they can't be changed,
+// and a disk can't be shrunk.
+func (d *MachineDefinition) Diff(m *Machine) ([]DefinitionChange, error) {
+	_, changes, err := d.plan(m)
+	return changes, err
+}
+
+// Apply updates the specification of the machine to match the definition and returns the changes.
+// The changes of a running machine take effect at its next start.
+func (m *Machine) Apply(d *MachineDefinition) ([]DefinitionChange, error) {
+	spec, changes, err := d.plan(m)
+	if err != nil || len(changes) == 0 {
+		return changes, err
+	}
+	m.Spec = spec
+	return changes, m.ExportMachineSpecification()
+}
+
+// plan returns the specification of the machine matching the definition along with the changes
+func (d *MachineDefinition) plan(m *Machine) (MachineSpec, []DefinitionChange, error) {
+	target, err := d.Machine()
+	if err != nil {
+		return MachineSpec{}, nil, err
+	}
+	if m.Distribution != nil {
+		for _, field := range []struct{ name, current, defined string }{
+			{"distribution", m.Distribution.Kind(), d.Distribution},
+			{"release", m.Distribution.Release(), d.Release},
+			{"arch", m.Distribution.Arch(), d.Arch},
+		} {
+			if field.defined != utils.Empty && field.defined != field.current {
+				return MachineSpec{}, nil, fmt.Errorf("the %s of machine %s can't be changed from %s to %s, delete and create it again",
+					field.name, m.Name, field.current, field.defined)
+			}
+		}
+	}
+	// the data disks are managed with `machina disk` only
+	target.Spec.DataDisks = m.Spec.DataDisks
+	if d.Disk == utils.Empty {
+		target.Spec.Disk = m.Spec.Disk
+	} else if target.DiskSize() < m.DiskSize() {
+		return MachineSpec{}, nil, fmt.Errorf("the disk of machine %s can't be shrunk from %s to %s", m.Name, FormatSize(m.DiskSize()), d.Disk)
+	}
+
+	var changes []DefinitionChange
+	compare := func(field string, current, defined interface{}, format func(interface{}) string) {
+		if !reflect.DeepEqual(current, defined) {
+			changes = append(changes, DefinitionChange{Field: field, From: format(current), To: format(defined)})
+		}
+	}
+	compare("cpu", m.Spec.Cpu, target.Spec.Cpu, formatValue)
+	compare("memory", m.Spec.Ram, target.Spec.Ram, formatBytes)
+	compare("disk", m.DiskSize(), target.DiskSize(), formatBytes)
+	compare("ports", emptyIfNil(m.Spec.Ports), emptyIfNil(target.Spec.Ports), formatValue)
+	compare("auto_forward", m.Spec.AutoForward.String(), target.Spec.AutoForward.String(), formatValue)
+	compare("cloud_init", m.Spec.CloudInit, target.Spec.CloudInit, formatValue)
+	compare("labels", formatLabels(m.Spec.Labels), formatLabels(target.Spec.Labels), formatValue)
+	if target.Spec.CloudInit != m.Spec.CloudInit {
+		if err = target.ValidateCloudInit(); err != nil {
+			return MachineSpec{}, nil, err
+		}
+	}
+	return target.Spec, changes, nil
+}
+
+// EncodeDefinition writes the definition as a YAML document
+func EncodeDefinition(writer io.Writer, d *MachineDefinition) error {
+	encoder := yaml.NewEncoder(writer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(d); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// ParsePortForward reads a host:guest port forward
+func ParsePortForward(value string) (PortForward, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 2 {
+		return PortForward{}, fmt.Errorf("invalid port forward %q, expected host:guest", value)
+	}
+	var ports [2]int
+	for i, part := range parts {
+		port, err := strconv.Atoi(part)
+		if err != nil || port < 1 || port > 65535 {
+			return PortForward{}, fmt.Errorf("invalid port %q in %s", part, value)
+		}
+		ports[i] = port
+	}
+	return PortForward{Host: ports[0], Guest: ports[1]}, nil
+}
+
+func (p PortForward) String() string {
+	return fmt.Sprintf("%d:%d", p.Host, p.Guest)
+}
+
+// ParseSize reads a size like 2G, 512M or 2GiB, a size without unit is a number of defaultUnit
+func ParseSize(value string, defaultUnit uint64) (uint64, error) {
+	matches := sizePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if matches == nil {
+		return 0, fmt.Errorf("invalid size %q, expected a number followed by K, M, G or T", value)
+	}
+	size, err := strconv.ParseUint(matches[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	unit := defaultUnit
+	if matches[2] != utils.Empty {
+		unit = sizeUnits[strings.ToLower(matches[2])]
+	} else if matches[3] != utils.Empty {
+		unit = 1
+	}
+	return size * unit, nil
+}
+
+// FormatSize writes the size with the largest unit dividing it
+func FormatSize(size uint64) string {
+	for _, unit := range []string{"t", "g", "m", "k"} {
+		if size >= sizeUnits[unit] && size%sizeUnits[unit] == 0 {
+			return fmt.Sprintf("%d%s", size/sizeUnits[unit], strings.ToUpper(unit))
+		}
+	}
+	return strconv.FormatUint(size, 10)
+}
+
+func formatValue(value interface{}) string {
+	if list, ok := value.([]string); ok {
+		return strings.Join(list, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+func formatBytes(value interface{}) string {
+	return FormatSize(value.(uint64))
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func setList(set *utils.Set) []string {
+	if set == nil {
+		return nil
+	}
+	return set.List()
+}
+
+func emptyIfNil(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
@@ -0,0 +1,147 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDefinition = `name: dev
+distribution: ubuntu
+release: focal
+arch: arm64
+cpu: 4
+memory: 4G
+disk: 30G
+ports: 8080:80,9090:90
+auto_forward:
+  exclude: [5432]
+cloud_init:
+  packages: [git]
+labels:
+  team: web
+`
+
+func TestReadDefinitions(t *testing.T) {
+	t.Run("should read every document", func(t *testing.T) {
+		definitions, err := ReadDefinitions(strings.NewReader(testDefinition + "---\nname: other\n"))
+		assert.NoError(t, err)
+		assert.Len(t, definitions, 2)
+
+		machine, err := definitions[0].Machine()
+		assert.NoError(t, err)
+		assert.Equal(t, "ubuntu", machine.Distribution.Kind())
+		assert.Equal(t, "focal", machine.Distribution.Release())
+		assert.Equal(t, MachineSpec{
+			Cpu:         4,
+			Ram:         4 * GB,
+			Disk:        30 * GB,
+			Ports:       []string{"8080:80", "9090:90"},
+			AutoForward: &AutoForward{Exclude: []string{"5432"}},
+			CloudInit:   "packages:\n    - git\n",
+			Labels:      map[string]string{"team": "web"},
+		}, machine.Spec)
+
+		defaults, err := definitions[1].Machine()
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultDistribution, defaults.Distribution.Kind())
+		assert.Equal(t, MachineSpec{Cpu: Default_cpu_number, Ram: Default_mem_mb}, defaults.Spec)
+	})
+
+	for _, test := range []struct {
+		name       string
+		definition string
+	}{
+		{"unknown field", "name: dev\ncpus: 2\n"},
+		{"invalid name", "name: ../dev\n"},
+		{"unknown distribution", "name: dev\ndistribution: gentoo\n"},
+		{"too many cpu", "name: dev\ncpu: 64\n"},
+		{"invalid memory", "name: dev\nmemory: 2 apples\n"},
+		{"too much memory", "name: dev\nmemory: 64G\n"},
+		{"invalid port", "name: dev\nports: [8080:99999]\n"},
+		{"twice forwarded port", "name: dev\nports: [8080:80, 8080:81]\n"},
+		{"invalid automatic forward range", "name: dev\nauto_forward: {include: [9000-80]}\n"},
+	} {
+		test := test
+		t.Run("should refuse "+test.name, func(t *testing.T) {
+			_, err := ReadDefinitions(strings.NewReader(test.definition))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMachineDefinition_Apply(t *testing.T) {
+	newDefinition := func(t *testing.T, content string) *MachineDefinition {
+		definitions, err := ReadDefinitions(strings.NewReader(content))
+		assert.NoError(t, err)
+		return definitions[0]
+	}
+
+	t.Run("should report no change for an exported machine", func(t *testing.T) {
+		machine := newTestMachine(t, nil)
+		machine.Spec.Labels = map[string]string{"team": "web"}
+		definition, err := DefinitionOf(machine)
+		assert.NoError(t, err)
+
+		var exported bytes.Buffer
+		assert.NoError(t, EncodeDefinition(&exported, definition))
+		changes, err := newDefinition(t, exported.String()).Diff(machine)
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+	})
+
+	t.Run("should apply and save the changes", func(t *testing.T) {
+		machine := newTestMachine(t, nil)
+		machine.Spec = MachineSpec{Cpu: 2, Ram: 2 * GB}
+		machine.BaseDirectory()
+		assert.NoError(t, machine.ExportMachineSpecification())
+
+		changes, err := machine.Apply(newDefinition(t, "name: test\ncpu: 4\nmemory: 2048\ndisk: 20G\nports: [8080:80]\n"))
+		assert.NoError(t, err)
+		assert.Equal(t, []DefinitionChange{
+			{Field: "cpu", From: "2", To: "4"},
+			{Field: "disk", From: "15G", To: "20G"},
+			{Field: "ports", From: "", To: "8080:80"},
+		}, changes)
+
+		saved, err := FromFileSpec(machine.Name)
+		assert.NoError(t, err)
+		if assert.NotNil(t, saved) {
+			assert.Equal(t, MachineSpec{Cpu: 4, Ram: 2 * GB, Disk: 20 * GB, Ports: []string{"8080:80"}}, saved.Spec)
+		}
+	})
+
+	t.Run("should refuse to change the distribution", func(t *testing.T) {
+		machine := newTestMachine(t, nil)
+		_, err := machine.Apply(newDefinition(t, "name: test\nrelease: jammy\n"))
+		assert.Error(t, err)
+	})
+
+	t.Run("should refuse to shrink the disk", func(t *testing.T) {
+		machine := newTestMachine(t, nil)
+		_, err := machine.Apply(newDefinition(t, "name: test\ndisk: 10G\n"))
+		assert.Error(t, err)
+	})
+}
+
+func TestParseSize(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected uint64
+	}{
+		{"2G", 2 * GB},
+		{"2GiB", 2 * GB},
+		{"512m", 512 * 1024 * 1024},
+		{"2048", 2048 * 1024 * 1024},
+		{"100B", 100},
+	} {
+		size, err := ParseSize(test.value, 1024*1024)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, size, test.value)
+	}
+	assert.Equal(t, "2G", FormatSize(2*GB))
+	assert.Equal(t, "1536M", FormatSize(1536*1024*1024))
+	assert.Equal(t, "100", FormatSize(100))
+}
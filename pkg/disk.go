@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sectorSize is the unit of the sizes of /sys/block
+const sectorSize = 512
+
+// growScript grows the partition and the filesystem mounted on / to the size of the disk.
+// growpart exits with 1 when the partition already fills the disk.
+const growScript = `set -e
+set -- $(awk '$2 == "/" { source = $1; type = $3 } END { print source, type }' /proc/mounts)
+source=$1 type=$2
+name=$(basename "$(readlink -f "$source")")
+if [ -e "/sys/class/block/$name/partition" ]; then
+  disk=$(basename "$(readlink -f "/sys/class/block/$name/..")")
+  growpart "/dev/$disk" "$(cat "/sys/class/block/$name/partition")" || [ $? -eq 1 ]
+fi
+case $type in
+  ext*) resize2fs "$source" ;;
+  xfs) xfs_growfs / ;;
+  btrfs) btrfs filesystem resize max / ;;
+esac
+`
+
+// ResizeDisk grows the root disk of the machine to size, a disk is never shrunk.
+// The image is grown right away and cloud-init grows the partition and the filesystem of / at every boot.
+// The guest of a running machine only sees the new size once restarted, unless the hypervisor reports
+// it already: the partition and the filesystem are then grown over ssh and applied is true.
+func (m *Machine) ResizeDisk(size uint64) (applied bool, err error) {
+	if size < m.DiskSize() {
+		return false, fmt.Errorf("the disk of machine %s can't be shrunk from %s to %s", m.Name, FormatSize(m.DiskSize()), FormatSize(size))
+	}
+	if disk, err := os.Stat(m.rootDiskPath()); err == nil && int64(size) > disk.Size() {
+		if err = os.Truncate(m.rootDiskPath(), int64(size)); err != nil {
+			return false, err
+		}
+	} else if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	m.Spec.Disk = size
+	if err = m.ExportMachineSpecification(); err != nil {
+		return false, err
+	}
+	if m.State() != Machine_state_running {
+		return false, nil
+	}
+
+	address, err := m.SshAddress()
+	if err != nil {
+		return false, err
+	}
+	return growGuestDisk(address, size)
+}
+
+// growGuestDisk grows the partition and the filesystem of / when the guest sees a disk of size
+func growGuestDisk(address string, size uint64) (bool, error) {
+	var stdout, stderr bytes.Buffer
+	status, err := execCommand(address, []string{"cat", "/sys/block/vda/size"}, ExecOptions{User: DefaultSshUser, Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		return false, err
+	}
+	if status != 0 {
+		return false, fmt.Errorf("cannot read the disk size of the guest: %s", strings.TrimSpace(stderr.String()))
+	}
+	sectors, err := strconv.ParseUint(strings.TrimSpace(stdout.String()), 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("invalid disk size of the guest: %v", err)
+	}
+	if sectors*sectorSize < size {
+		return false, nil
+	}
+
+	// the outputs are copied concurrently, they don't share a buffer
+	stdout.Reset()
+	stderr.Reset()
+	status, err = execCommand(address, []string{"sh", "-c", growScript}, ExecOptions{User: DefaultSshUser, Stdout: &stdout, Stderr: &stderr})
+	if err != nil {
+		return false, err
+	}
+	if status != 0 {
+		return false, fmt.Errorf("the filesystem of the guest can't be grown: %s", strings.TrimSpace(stdout.String()+stderr.String()))
+	}
+	return true, nil
+}
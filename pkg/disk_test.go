@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMachine_ResizeDisk(t *testing.T) {
+	t.Run("should grow the image and save the size of a stopped machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running, Machine_state_stop)
+		_, err := m.RootDirectory()
+		assert.NoError(t, err)
+		assert.NoError(t, m.ExportMachineSpecification())
+
+		applied, err := m.ResizeDisk(60 * GB)
+		assert.NoError(t, err)
+		assert.False(t, applied)
+		disk, err := os.Stat(m.rootDiskPath())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(60*GB), disk.Size())
+		saved, err := FromFileSpec(m.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(60*GB), saved.DiskSize())
+	})
+
+	t.Run("should refuse to shrink the disk", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		m.Spec.Disk = 30 * GB
+		m.BaseDirectory()
+
+		_, err := m.ResizeDisk(20 * GB)
+		assert.EqualError(t, err, "the disk of machine test can't be shrunk from 30G to 20G")
+		assert.Equal(t, uint64(30*GB), m.DiskSize())
+	})
+}
+
+func TestGrowGuestDisk(t *testing.T) {
+	newTestMachine(t, nil)
+	// serve answers the disk size in sectors and records the commands
+	serve := func(t *testing.T, sectors uint64, growStatus uint32) (string, func() []string) {
+		var mu sync.Mutex
+		var commands []string
+		address := startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 {
+			mu.Lock()
+			commands = append(commands, request.Command)
+			mu.Unlock()
+			if strings.HasPrefix(request.Command, "'cat' ") {
+				channel.Write([]byte(strconv.FormatUint(sectors, 10) + "\n"))
+				return 0
+			}
+			return growStatus
+		})
+		return address, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			return commands
+		}
+	}
+
+	t.Run("should grow the filesystem when the guest sees the new size", func(t *testing.T) {
+		address, commands := serve(t, 60*GB/sectorSize, 0)
+
+		applied, err := growGuestDisk(address, 60*GB)
+		assert.NoError(t, err)
+		assert.True(t, applied)
+		assert.Len(t, commands(), 2)
+		assert.Contains(t, commands()[1], "growpart")
+	})
+
+	t.Run("should wait for a restart when the guest sees the former size", func(t *testing.T) {
+		address, commands := serve(t, 15*GB/sectorSize, 0)
+
+		applied, err := growGuestDisk(address, 60*GB)
+		assert.NoError(t, err)
+		assert.False(t, applied)
+		assert.Equal(t, []string{"'cat' '/sys/block/vda/size'"}, commands())
+	})
+
+	t.Run("should report a failed resize", func(t *testing.T) {
+		address, _ := serve(t, 60*GB/sectorSize, 1)
+
+		_, err := growGuestDisk(address, 60*GB)
+		assert.Error(t, err)
+	})
+}
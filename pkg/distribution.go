@@ -0,0 +1,399 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultDistribution = "ubuntu"
+
+	CompressionGzip = "gzip"
+	CompressionXz   = "xz"
+	FormatQcow2     = "qcow2"
+)
+
+// Distribution is an operating system a machine boots: where the kernel, the initrd
+// and the root filesystem of a release are published, and how to boot them.
+type Distribution interface {
+	// Kind is the name of the distribution in the registry, it's recorded in spec.json
+	Kind() string
+	Release() string
+	// Arch is the architecture as named by Go: arm64 or amd64
+	Arch() string
+	// ImageDirectory holds the downloaded artifacts of the release
+	ImageDirectory() string
+	Kernel() Artifact
+	InitRd() Artifact
+	Image() Artifact
+	Layout() BootLayout
+}
+
+// Artifact is a file of a distribution release, published at URL and stored at Path once unpacked.
+type Artifact struct {
+	URL  string
+	Path string
+	// Member is the file to extract when the published file is a tar archive
+	Member string
+	// Compression of the published file, an archive included: gzip, xz or none
+	Compression string
+	// Format of a disk image when it isn't raw: qcow2
+	Format string
+	// Checksums lists the published file under ChecksumName, the base name of URL by default
+	Checksums    *Checksums
+	ChecksumName string
+	// ImageFile is the file of the image the artifact is extracted from when it isn't published apart,
+	// a pattern of the files of a directory like boot/vmlinuz-*, the last match in lexical order is taken
+	ImageFile string
+}
+
+// BootLayout tells how to boot the root filesystem of a distribution
+type BootLayout struct {
+	// CommandLine are the kernel arguments of a regular boot
+	CommandLine []string
+	// Commands are run by cloud-init at the first boot, the workarounds the guest needs
+	Commands [][]string
+}
+
+// DistributionFactory creates a distribution, an empty release selects the default one
+type DistributionFactory func(release, arch string) Distribution
+
+var distributions = map[string]DistributionFactory{}
+
+// RegisterDistribution makes a distribution available under kind
+func RegisterDistribution(kind string, factory DistributionFactory) {
+	distributions[kind] = factory
+}
+
+// DistributionKinds returns the registered distributions, sorted
+func DistributionKinds() []string {
+	kinds := make([]string, 0, len(distributions))
+	for kind := range distributions {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// NewDistribution returns the release of the registered distribution kind,
+// the architecture defaults to the host one.
+func NewDistribution(kind, release, arch string) (Distribution, error) {
+	factory, found := distributions[kind]
+	if !found {
+		return nil, fmt.Errorf("unknown distribution %s, expected one of %v", kind, DistributionKinds())
+	}
+	if arch == utils.Empty {
+		arch = runtime.GOARCH
+	}
+	return factory(release, arch), nil
+}
+
+// DistributionRelease is embedded by the distributions to hold their release and architecture
+type DistributionRelease struct {
+	ReleaseName  string `json:"release"`
+	Architecture string `json:"arch"`
+}
+
+func (r *DistributionRelease) Release() string {
+	return r.ReleaseName
+}
+
+func (r *DistributionRelease) Arch() string {
+	return r.Architecture
+}
+
+// gnuArch returns the architecture as named by the kernel: aarch64 or x86_64
+func (r *DistributionRelease) gnuArch() string {
+	switch r.Architecture {
+	case "arm64":
+		return "aarch64"
+	case "amd64":
+		return "x86_64"
+	}
+	return r.Architecture
+}
+
+func (r *DistributionRelease) imageDirectory(kind string) string {
+	return fmt.Sprintf("%s/%s-%s", baseImageDirectory(), kind, r.ReleaseName)
+}
+
+// marshalDistribution encodes the distribution with its kind
+func marshalDistribution(d Distribution) (json.RawMessage, error) {
+	content, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]interface{}{}
+	if err = json.Unmarshal(content, &fields); err != nil {
+		return nil, err
+	}
+	fields["kind"] = d.Kind()
+	return json.Marshal(fields)
+}
+
+// unmarshalDistribution decodes a distribution encoded by marshalDistribution,
+// a distribution without kind was saved before they were pluggable and is Ubuntu.
+func unmarshalDistribution(content json.RawMessage) (Distribution, error) {
+	if len(content) == 0 || string(content) == "null" {
+		return nil, nil
+	}
+	var header struct {
+		Kind string `json:"kind"`
+	}
+	if err := json.Unmarshal(content, &header); err != nil {
+		return nil, err
+	}
+	if header.Kind == utils.Empty {
+		header.Kind = DefaultDistribution
+	}
+	factory, found := distributions[header.Kind]
+	if !found {
+		return nil, fmt.Errorf("unknown distribution %s", header.Kind)
+	}
+	distribution := factory(utils.Empty, utils.Empty)
+	return distribution, json.Unmarshal(content, distribution)
+}
+
+// DownloadDistro downloads, verifies and unpacks the kernel, the initrd and the image of the distribution,
+// the artifacts already present are kept.
+func DownloadDistro(d Distribution) error {
+	if err := DirectoryCreateIfAbsent(d.ImageDirectory()); err != nil {
+		return err
+	}
+	artifacts := []Artifact{d.InitRd(), d.Kernel(), d.Image()}
+	if err := checkUnpackTools(artifacts); err != nil {
+		return fmt.Errorf("%s %s: %v", d.Kind(), d.Release(), err)
+	}
+	verifier, err := newChecksumVerifier(d.Kind())
+	if err != nil {
+		return err
+	}
+	for _, artifact := range artifacts {
+		if artifact.ImageFile != utils.Empty {
+			continue
+		}
+		if err := downloadArtifact(artifact, verifier); err != nil {
+			return err
+		}
+	}
+	// the boot files of the image are extracted once it's downloaded
+	for _, artifact := range artifacts {
+		if artifact.ImageFile == utils.Empty {
+			continue
+		}
+		if err := extractImageFile(d.Image().Path, artifact); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkUnpackTools checks the external tools required to unpack the artifacts which aren't there yet
+func checkUnpackTools(artifacts []Artifact) error {
+	for _, artifact := range artifacts {
+		if _, err := os.Stat(artifact.Path); err == nil || artifact.Format != FormatQcow2 {
+			continue
+		}
+		if _, err := exec.LookPath("qemu-img"); err != nil {
+			return fmt.Errorf("qemu-img is required to convert the qcow2 image, install it with brew install qemu")
+		}
+	}
+	return nil
+}
+
+// extractImageFile copies the file of the image matching the pattern of the artifact to its path,
+// the artifact is as verified as the image.
+func extractImageFile(image string, artifact Artifact) error {
+	if _, err := os.Stat(artifact.Path); err == nil {
+		utils.Logger.Debugf("%s already exists", artifact.Path)
+		return nil
+	}
+	disk, err := os.Open(image)
+	if err != nil {
+		return err
+	}
+	defer disk.Close()
+	info, err := disk.Stat()
+	if err != nil {
+		return err
+	}
+	name, content, err := readImageFile(disk, info.Size(), artifact.ImageFile)
+	if err != nil {
+		return fmt.Errorf("cannot extract %s from %s: %v", artifact.ImageFile, filepath.Base(image), err)
+	}
+	utils.Logger.Infof("Extracting %s from %s", name, filepath.Base(image))
+	status, err := VerifyArtifact(image)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := artifact.Path + ".tmp"
+	defer os.Remove(tmpPath)
+	if err = ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	if err = recordChecksum(tmpPath, artifact.Path, status == Artifact_verified); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, artifact.Path)
+}
+
+func downloadArtifact(artifact Artifact, verifier *checksumVerifier) error {
+	if _, err := os.Stat(artifact.Path); err == nil {
+		utils.Logger.Debugf("%s already exists", artifact.Path)
+		return nil
+	}
+	utils.Logger.Infof("Downloading %s", artifact.URL)
+	published := artifact.Path + ".download"
+	if err := download(artifact.URL, published, progressOutput()); err != nil {
+		return err
+	}
+	defer os.Remove(published)
+	authenticated, err := verifier.verify(artifact, published)
+	if err != nil {
+		return err
+	}
+	if err := artifact.unpack(published, authenticated); err != nil {
+		return fmt.Errorf("cannot unpack %s: %v", artifact.URL, err)
+	}
+	return nil
+}
+
+// unpack turns the published file into the artifact, the artifact appears once complete and its checksum recorded
+func (a Artifact) unpack(published string, authenticated bool) error {
+	tmpPath := a.Path + ".tmp"
+	defer os.Remove(tmpPath)
+
+	var err error
+	switch {
+	case a.Member != utils.Empty:
+		err = extractMember(published, a.Compression, a.Member, tmpPath)
+	case a.Compression == CompressionGzip, a.Compression == CompressionXz:
+		err = decompressFile(published, a.Compression, tmpPath)
+	default:
+		err = os.Rename(published, tmpPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	if a.Format == FormatQcow2 {
+		rawPath := a.Path + ".raw"
+		defer os.Remove(rawPath)
+		if output, err := exec.Command("qemu-img", "convert", "-f", FormatQcow2, "-O", "raw", tmpPath, rawPath).CombinedOutput(); err != nil {
+			return fmt.Errorf("qemu-img cannot convert the qcow2 image: %v %s", err, strings.TrimSpace(string(output)))
+		}
+		tmpPath = rawPath
+	}
+	if err = recordChecksum(tmpPath, a.Path, authenticated); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, a.Path)
+}
+
+// extractMember streams member of the tar archive to dst, the archive is only read up to the member.
+// The blocks of zeros of the member are left as holes in dst.
+func extractMember(archive, compression, member, dst string) error {
+	in, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	reader, err := decompressor(in, compression)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return fmt.Errorf("%s isn't in the archive %s", member, filepath.Base(archive))
+		} else if err != nil {
+			return fmt.Errorf("invalid archive %s: %v", filepath.Base(archive), err)
+		}
+		name, err := memberName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name != member {
+			continue
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			return fmt.Errorf("%s isn't a regular file in the archive %s", member, filepath.Base(archive))
+		}
+		out, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		written, err := sparseWrite(out, tarReader)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil && written != header.Size {
+			err = fmt.Errorf("%s is truncated in the archive %s", member, filepath.Base(archive))
+		}
+		return err
+	}
+}
+
+// memberName returns the cleaned name of an archive entry, a name escaping the archive is refused
+func memberName(name string) (string, error) {
+	cleaned := path.Clean(name)
+	if path.IsAbs(cleaned) || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return utils.Empty, fmt.Errorf("unsafe path %s in the archive", name)
+	}
+	return cleaned, nil
+}
+
+// decompressor reads in decompressed, compression is gzip, xz or none
+func decompressor(in io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionGzip:
+		return gzip.NewReader(in)
+	case CompressionXz:
+		reader, err := xz.NewReader(in)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(reader), nil
+	}
+	return ioutil.NopCloser(in), nil
+}
+
+func decompressFile(src, compression, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	reader, err := decompressor(in, compression)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = sparseWrite(out, reader); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"strings"
+)
+
+const alpineReleasesUrl = "https://dl-cdn.alpinelinux.org/alpine"
+
+func init() {
+	RegisterDistribution("alpine", func(release, arch string) Distribution {
+		if release == utils.Empty {
+			release = "3.19.1"
+		}
+		return &AlpineDistribution{DistributionRelease{ReleaseName: release, Architecture: arch}}
+	})
+}
+
+// AlpineDistribution boots the Alpine nocloud images with the virt kernel of the release.
+// The images are only published as qcow2, they're converted to raw with qemu-img.
+type AlpineDistribution struct {
+	DistributionRelease
+}
+
+func (a *AlpineDistribution) Kind() string {
+	return "alpine"
+}
+
+func (a *AlpineDistribution) ImageDirectory() string {
+	return a.imageDirectory(a.Kind())
+}
+
+// branch returns the release branch, v3.19 for 3.19.1
+func (a *AlpineDistribution) branch() string {
+	parts := strings.Split(a.ReleaseName, ".")
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+	return "v" + strings.Join(parts, ".")
+}
+
+// netboot returns a file of the netboot directory, each file is published along with its .sha256
+func (a *AlpineDistribution) netboot(file string) Artifact {
+	url := fmt.Sprintf("%s/%s/releases/%s/netboot-%s/%s", alpineReleasesUrl, a.branch(), a.gnuArch(), a.ReleaseName, file)
+	return Artifact{
+		URL:       url,
+		Path:      fmt.Sprintf("%s/alpine-%s-%s-%s", a.ImageDirectory(), a.ReleaseName, a.gnuArch(), file),
+		Checksums: &Checksums{URL: url + ".sha256"},
+	}
+}
+
+func (a *AlpineDistribution) Kernel() Artifact {
+	return a.netboot("vmlinuz-virt")
+}
+
+func (a *AlpineDistribution) InitRd() Artifact {
+	return a.netboot("initramfs-virt")
+}
+
+func (a *AlpineDistribution) Image() Artifact {
+	name := fmt.Sprintf("nocloud_alpine-%s-%s-uefi-cloudinit-r0", a.ReleaseName, a.gnuArch())
+	url := fmt.Sprintf("%s/%s/releases/cloud/%s.qcow2", alpineReleasesUrl, a.branch(), name)
+	return Artifact{
+		URL:    url,
+		Path:   fmt.Sprintf("%s/%s.raw", a.ImageDirectory(), name),
+		Format: FormatQcow2,
+		// the checksums of the cloud images aren't signed
+		Checksums: &Checksums{URL: url + ".sha512"},
+	}
+}
+
+// Layout boots the second partition of the image, the first one is the EFI system partition.
+func (a *AlpineDistribution) Layout() BootLayout {
+	return BootLayout{
+		CommandLine: []string{"console=hvc0", "root=/dev/vda2", "rootfstype=ext4", "modules=virtio_blk,ext4"},
+	}
+}
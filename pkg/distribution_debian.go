@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/efortin/machina/utils"
+)
+
+const debianImagesUrl = "https://cloud.debian.org/images/cloud"
+
+// debianVersions maps the Debian codenames to their version, used in the image names
+var debianVersions = map[string]string{
+	"bullseye": "11",
+	"bookworm": "12",
+	"trixie":   "13",
+}
+
+func init() {
+	RegisterDistribution("debian", func(release, arch string) Distribution {
+		if release == utils.Empty {
+			release = "bookworm"
+		}
+		return &DebianDistribution{DistributionRelease{ReleaseName: release, Architecture: arch}}
+	})
+}
+
+// DebianDistribution boots the Debian generic cloud images, a partitioned raw disk.
+// The kernel and the initrd aren't published apart from the image, they're extracted from its /boot.
+type DebianDistribution struct {
+	DistributionRelease
+}
+
+func (d *DebianDistribution) Kind() string {
+	return "debian"
+}
+
+func (d *DebianDistribution) ImageDirectory() string {
+	return d.imageDirectory(d.Kind())
+}
+
+// version returns the version of the release, the release may be given as a version
+func (d *DebianDistribution) version() string {
+	if version, found := debianVersions[d.ReleaseName]; found {
+		return version
+	}
+	return d.ReleaseName
+}
+
+// Kernel is the kernel of the image, the Debian cloud kernels aren't published apart from the images
+func (d *DebianDistribution) Kernel() Artifact {
+	return Artifact{
+		Path:      fmt.Sprintf("%s/debian-%s-%s-vmlinuz", d.ImageDirectory(), d.version(), d.Architecture),
+		ImageFile: "boot/vmlinuz-*",
+	}
+}
+
+// InitRd is the initramfs of the image, it's generated with the modules of most of the hardware
+func (d *DebianDistribution) InitRd() Artifact {
+	return Artifact{
+		Path:      fmt.Sprintf("%s/debian-%s-%s-initrd", d.ImageDirectory(), d.version(), d.Architecture),
+		ImageFile: "boot/initrd.img-*",
+	}
+}
+
+func (d *DebianDistribution) Image() Artifact {
+	name := fmt.Sprintf("debian-%s-genericcloud-%s", d.version(), d.Architecture)
+	return Artifact{
+		URL:         fmt.Sprintf("%s/%s/latest/%s.tar.xz", debianImagesUrl, d.ReleaseName, name),
+		Path:        fmt.Sprintf("%s/%s.raw", d.ImageDirectory(), name),
+		Member:      "disk.raw",
+		Compression: CompressionXz,
+		// the cloud images checksums aren't signed
+		Checksums: &Checksums{URL: fmt.Sprintf("%s/%s/latest/SHA512SUMS", debianImagesUrl, d.ReleaseName)},
+	}
+}
+
+// Layout boots the first partition of the image
+func (d *DebianDistribution) Layout() BootLayout {
+	return BootLayout{
+		CommandLine: []string{"console=hvc0", "root=/dev/vda1"},
+		Commands:    debianFamilyCommands,
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/efortin/machina/utils"
+)
+
+const fedoraReleasesUrl = "https://download.fedoraproject.org/pub/fedora/linux/releases"
+
+// fedoraComposes maps the Fedora releases to the compose of their cloud image
+var fedoraComposes = map[string]string{
+	"39": "1.5",
+	"40": "1.14",
+	"41": "1.4",
+}
+
+func init() {
+	RegisterDistribution("fedora", func(release, arch string) Distribution {
+		if release == utils.Empty {
+			release = "40"
+		}
+		return &FedoraDistribution{DistributionRelease: DistributionRelease{ReleaseName: release, Architecture: arch}}
+	})
+}
+
+// FedoraDistribution boots the Fedora Cloud base images, an xz compressed raw disk with a btrfs root.
+// The kernel and the initramfs are extracted from the /boot partition of the image.
+type FedoraDistribution struct {
+	DistributionRelease
+	// Compose identifies the cloud image of the release, the known one is used when empty
+	Compose string `json:"compose,omitempty"`
+}
+
+func (f *FedoraDistribution) Kind() string {
+	return "fedora"
+}
+
+func (f *FedoraDistribution) ImageDirectory() string {
+	return f.imageDirectory(f.Kind())
+}
+
+func (f *FedoraDistribution) compose() string {
+	if f.Compose != utils.Empty {
+		return f.Compose
+	}
+	return fedoraComposes[f.ReleaseName]
+}
+
+// Kernel is the kernel of the /boot partition of the image, the rescue kernel named vmlinuz-0-rescue-* is left out
+func (f *FedoraDistribution) Kernel() Artifact {
+	return Artifact{
+		Path:      fmt.Sprintf("%s/fedora-%s-%s-vmlinuz", f.ImageDirectory(), f.ReleaseName, f.gnuArch()),
+		ImageFile: "vmlinuz-[1-9]*",
+	}
+}
+
+// InitRd is the generic initramfs of the /boot partition of the image
+func (f *FedoraDistribution) InitRd() Artifact {
+	return Artifact{
+		Path:      fmt.Sprintf("%s/fedora-%s-%s-initramfs", f.ImageDirectory(), f.ReleaseName, f.gnuArch()),
+		ImageFile: "initramfs-[1-9]*.img",
+	}
+}
+
+func (f *FedoraDistribution) Image() Artifact {
+	name := fmt.Sprintf("Fedora-Cloud-Base-Generic.%s-%s-%s", f.gnuArch(), f.ReleaseName, f.compose())
+	return Artifact{
+		URL:         fmt.Sprintf("%s/%s/Cloud/%s/images/%s.raw.xz", fedoraReleasesUrl, f.ReleaseName, f.gnuArch(), name),
+		Path:        fmt.Sprintf("%s/%s.raw", f.ImageDirectory(), name),
+		Compression: CompressionXz,
+		// the CHECKSUM file is clearsigned
+		Checksums: &Checksums{URL: fmt.Sprintf("%s/%s/Cloud/%s/images/Fedora-Cloud-%s-%s-%s-CHECKSUM",
+			fedoraReleasesUrl, f.ReleaseName, f.gnuArch(), f.ReleaseName, f.compose(), f.gnuArch())},
+	}
+}
+
+// Layout boots the root subvolume of the btrfs filesystem labeled fedora
+func (f *FedoraDistribution) Layout() BootLayout {
+	return BootLayout{
+		CommandLine: []string{"console=hvc0", "root=LABEL=fedora", "rootflags=subvol=root"},
+	}
+}
@@ -0,0 +1,260 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/efortin/machina/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+func TestNewDistribution(t *testing.T) {
+	t.Run("should register every distribution", func(t *testing.T) {
+		assert.Equal(t, []string{"alpine", "debian", "fedora", "ubuntu"}, DistributionKinds())
+	})
+
+	t.Run("should default the release and the architecture", func(t *testing.T) {
+		distribution, err := NewDistribution("debian", "", "")
+		assert.NoError(t, err)
+		assert.Equal(t, "bookworm", distribution.Release())
+		assert.Equal(t, runtime.GOARCH, distribution.Arch())
+	})
+
+	t.Run("should refuse an unknown distribution", func(t *testing.T) {
+		_, err := NewDistribution("gentoo", "", "")
+		assert.Error(t, err)
+	})
+}
+
+func TestDistribution_Artifacts(t *testing.T) {
+	newTestMachine(t, nil)
+	// kernel is the published kernel or the file of the image it's extracted from
+	tests := []struct {
+		kind, release string
+		kernel        string
+		image         string
+		root          string
+	}{
+		{"ubuntu", "jammy",
+			"https://cloud-images.ubuntu.com/jammy/current/unpacked/jammy-server-cloudimg-arm64-vmlinuz-generic",
+			"https://cloud-images.ubuntu.com/jammy/current/jammy-server-cloudimg-arm64.tar.gz",
+			"root=/dev/vda"},
+		{"debian", "bookworm",
+			"boot/vmlinuz-*",
+			"https://cloud.debian.org/images/cloud/bookworm/latest/debian-12-genericcloud-arm64.tar.xz",
+			"root=/dev/vda1"},
+		{"fedora", "40",
+			"vmlinuz-[1-9]*",
+			"https://download.fedoraproject.org/pub/fedora/linux/releases/40/Cloud/aarch64/images/Fedora-Cloud-Base-Generic.aarch64-40-1.14.raw.xz",
+			"root=LABEL=fedora"},
+		{"alpine", "3.19.1",
+			"https://dl-cdn.alpinelinux.org/alpine/v3.19/releases/aarch64/netboot-3.19.1/vmlinuz-virt",
+			"https://dl-cdn.alpinelinux.org/alpine/v3.19/releases/cloud/nocloud_alpine-3.19.1-aarch64-uefi-cloudinit-r0.qcow2",
+			"root=/dev/vda2"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.kind, func(t *testing.T) {
+			distribution, err := NewDistribution(test.kind, test.release, "arm64")
+			assert.NoError(t, err)
+
+			assert.Equal(t, test.kernel, distribution.Kernel().URL+distribution.Kernel().ImageFile)
+			assert.Equal(t, test.image, distribution.Image().URL)
+			assert.Contains(t, distribution.Layout().CommandLine, test.root)
+			for _, artifact := range []Artifact{distribution.Kernel(), distribution.InitRd(), distribution.Image()} {
+				assert.Equal(t, distribution.ImageDirectory(), filepath.Dir(artifact.Path))
+				// the published artifacts are verified, the other ones are as verified as the image
+				assert.True(t, artifact.Checksums != nil || artifact.ImageFile != "", artifact.Path)
+			}
+			assert.Empty(t, distribution.Image().ImageFile)
+		})
+	}
+}
+
+func TestMachine_JSON(t *testing.T) {
+	t.Run("should load an Ubuntu spec saved without kind", func(t *testing.T) {
+		var machine Machine
+		spec := `{"name":"old","distribution":{"release":"focal","arch":"arm64"},"specs":{"cpu":2,"memory":2147483648}}`
+
+		assert.NoError(t, json.Unmarshal([]byte(spec), &machine))
+		assert.Equal(t, "old", machine.Name)
+		assert.Equal(t, uint(2), machine.Spec.Cpu)
+		assert.IsType(t, &UbuntuDistribution{}, machine.Distribution)
+		assert.Equal(t, "focal", machine.Distribution.Release())
+		assert.Equal(t, "arm64", machine.Distribution.Arch())
+	})
+
+	t.Run("should record the kind of the distribution", func(t *testing.T) {
+		distribution, _ := NewDistribution("fedora", "40", "arm64")
+		distribution.(*FedoraDistribution).Compose = "1.2"
+		machine := &Machine{Name: "fedora", Distribution: distribution, Spec: MachineSpec{Cpu: 1, Ram: GB}}
+
+		content, err := json.Marshal(machine)
+		assert.NoError(t, err)
+		assert.Contains(t, string(content), `"kind":"fedora"`)
+		var loaded Machine
+		assert.NoError(t, json.Unmarshal(content, &loaded))
+		assert.Equal(t, machine, &loaded)
+	})
+
+	t.Run("should refuse an unknown kind", func(t *testing.T) {
+		var machine Machine
+		assert.Error(t, json.Unmarshal([]byte(`{"name":"x","distribution":{"kind":"gentoo"}}`), &machine))
+	})
+}
+
+func TestDownloadArtifact(t *testing.T) {
+	newTestMachine(t, nil)
+	verifier, _ := newChecksumVerifier("test")
+	var gzipped, xzipped, archive bytes.Buffer
+	gzipWriter := gzip.NewWriter(&gzipped)
+	gzipWriter.Write([]byte("kernel"))
+	gzipWriter.Close()
+	xzWriter, _ := xz.NewWriter(&xzipped)
+	xzWriter.Write([]byte("disk"))
+	xzWriter.Close()
+	tarWriter := tar.NewWriter(&archive)
+	tarWriter.WriteHeader(&tar.Header{Name: "disk.raw", Mode: 0644, Size: 4})
+	tarWriter.Write([]byte("root"))
+	tarWriter.Close()
+
+	files := map[string][]byte{"/kernel.gz": gzipped.Bytes(), "/disk.xz": xzipped.Bytes(), "/image.tar": archive.Bytes(), "/initrd": []byte("initrd")}
+	var sums bytes.Buffer
+	for name, content := range files {
+		fmt.Fprintf(&sums, "%x *%s\n", sha256.Sum256(content), name[1:])
+	}
+	files["/SHA256SUMS"] = sums.Bytes()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, found := files[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		artifact Artifact
+		content  string
+	}{
+		{"should keep a plain file", Artifact{URL: server.URL + "/initrd"}, "initrd"},
+		{"should decompress gzip", Artifact{URL: server.URL + "/kernel.gz", Compression: CompressionGzip}, "kernel"},
+		{"should decompress xz", Artifact{URL: server.URL + "/disk.xz", Compression: CompressionXz}, "disk"},
+		{"should extract an archive member", Artifact{URL: server.URL + "/image.tar", Member: "disk.raw"}, "root"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			test.artifact.Path = filepath.Join(dir, "artifact")
+			test.artifact.Checksums = &Checksums{URL: server.URL + "/SHA256SUMS"}
+
+			assert.NoError(t, downloadArtifact(test.artifact, verifier))
+			content, err := os.ReadFile(test.artifact.Path)
+			assert.NoError(t, err)
+			assert.Equal(t, test.content, string(content))
+			entries, _ := os.ReadDir(dir)
+			assert.Len(t, entries, 2)
+			status, err := VerifyArtifact(test.artifact.Path)
+			assert.NoError(t, err)
+			// the checksums aren't signed
+			assert.Equal(t, Artifact_unverified, status)
+		})
+	}
+
+	t.Run("should fail on a missing file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "artifact")
+
+		assert.Error(t, downloadArtifact(Artifact{URL: server.URL + "/missing", Path: path}, verifier))
+		assert.NoFileExists(t, path)
+	})
+}
+
+func TestDownloadDistro(t *testing.T) {
+	newTestMachine(t, nil)
+
+	t.Run("should require qemu-img before downloading a qcow2 image", func(t *testing.T) {
+		setTestEnv(t, "PATH", t.TempDir())
+		distribution, _ := NewDistribution("alpine", "3.19.1", "arm64")
+
+		err := DownloadDistro(distribution)
+		assert.EqualError(t, err, "alpine 3.19.1: qemu-img is required to convert the qcow2 image, install it with brew install qemu")
+		entries, _ := os.ReadDir(distribution.ImageDirectory())
+		assert.Empty(t, entries)
+	})
+}
+
+func TestExtractMember(t *testing.T) {
+	dir := t.TempDir()
+	sparse := make([]byte, 3*sparseBlockSize)
+	copy(sparse[sparseBlockSize:], "root")
+	archive := func(t *testing.T, headers ...*tar.Header) string {
+		var content bytes.Buffer
+		gzipWriter := gzip.NewWriter(&content)
+		tarWriter := tar.NewWriter(gzipWriter)
+		for _, header := range headers {
+			assert.NoError(t, tarWriter.WriteHeader(header))
+			if header.Typeflag == tar.TypeReg {
+				tarWriter.Write(sparse[:header.Size])
+			}
+		}
+		tarWriter.Close()
+		gzipWriter.Close()
+		path := filepath.Join(dir, "archive.tar.gz")
+		assert.NoError(t, os.WriteFile(path, content.Bytes(), 0644))
+		return path
+	}
+	regular := func(name string, size int) *tar.Header {
+		return &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(size)}
+	}
+
+	t.Run("should extract the member of a gzip archive", func(t *testing.T) {
+		path := archive(t, regular("README", 10), regular("./disk.img", len(sparse)))
+		dst := filepath.Join(dir, "disk.img")
+
+		assert.NoError(t, extractMember(path, CompressionGzip, "disk.img", dst))
+		content, err := os.ReadFile(dst)
+		assert.NoError(t, err)
+		assert.Equal(t, sparse, content)
+	})
+
+	for _, test := range []struct {
+		name    string
+		headers []*tar.Header
+	}{
+		{"a missing member", []*tar.Header{regular("README", 10)}},
+		{"a path escaping the archive", []*tar.Header{regular("../../etc/passwd", 10), regular("disk.img", 10)}},
+		{"an absolute path", []*tar.Header{regular("/etc/passwd", 10), regular("disk.img", 10)}},
+		{"a member which isn't a file", []*tar.Header{{Name: "disk.img", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}}},
+	} {
+		test := test
+		t.Run("should refuse "+test.name, func(t *testing.T) {
+			path := archive(t, test.headers...)
+			assert.Error(t, extractMember(path, CompressionGzip, "disk.img", filepath.Join(dir, "refused.img")))
+		})
+	}
+
+	t.Run("should refuse a truncated archive", func(t *testing.T) {
+		var content bytes.Buffer
+		tarWriter := tar.NewWriter(&content)
+		tarWriter.WriteHeader(regular("disk.img", len(sparse)))
+		tarWriter.Write(sparse)
+		path := filepath.Join(dir, "truncated.tar")
+		assert.NoError(t, os.WriteFile(path, content.Bytes()[:content.Len()-sparseBlockSize], 0644))
+
+		assert.Error(t, extractMember(path, utils.Empty, "disk.img", filepath.Join(dir, "truncated.img")))
+	})
+}
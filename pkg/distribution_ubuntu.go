@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/efortin/machina/utils"
+)
+
+const ubuntuImagesUrl = "https://cloud-images.ubuntu.com"
+
+// debianFamilyCommands disable flash-kernel, it fails on kernel upgrades without a device tree it knows,
+// and remove irqbalance from the guests of the Debian family
+var debianFamilyCommands = [][]string{
+	{"cp", "/usr/bin/true", "/usr/sbin/flash-kernel"},
+	{"apt", "remove", "--purge", "irqbalance", "-y"},
+}
+
+func init() {
+	RegisterDistribution("ubuntu", func(release, arch string) Distribution {
+		if release == utils.Empty {
+			release = "focal"
+		}
+		return &UbuntuDistribution{DistributionRelease{ReleaseName: release, Architecture: arch}}
+	})
+}
+
+// UbuntuDistribution boots the Ubuntu server cloud images, their kernel and initrd are published unpacked
+type UbuntuDistribution struct {
+	DistributionRelease
+}
+
+func (u *UbuntuDistribution) Kind() string {
+	return "ubuntu"
+}
+
+// ImageDirectory isn't prefixed by the kind, it was the only distribution
+func (u *UbuntuDistribution) ImageDirectory() string {
+	return fmt.Sprintf("%s/%s", baseImageDirectory(), u.ReleaseName)
+}
+
+func (u *UbuntuDistribution) fileName(suffix string) string {
+	return fmt.Sprintf("%s-server-cloudimg-%s%s", u.ReleaseName, u.Architecture, suffix)
+}
+
+// checksums returns the signed SHA256SUMS of a directory of the current release
+func (u *UbuntuDistribution) checksums(directory string) *Checksums {
+	url := fmt.Sprintf("%s/%s/current/%sSHA256SUMS", ubuntuImagesUrl, u.ReleaseName, directory)
+	return &Checksums{URL: url, SignatureURL: url + ".gpg"}
+}
+
+func (u *UbuntuDistribution) unpacked(suffix string) Artifact {
+	return Artifact{
+		URL:       fmt.Sprintf("%s/%s/current/unpacked/%s", ubuntuImagesUrl, u.ReleaseName, u.fileName(suffix)),
+		Path:      fmt.Sprintf("%s/%s", u.ImageDirectory(), u.fileName(suffix)),
+		Checksums: u.checksums("unpacked/"),
+	}
+}
+
+// Kernel is gzipped, it's prepared by prepareKernel
+func (u *UbuntuDistribution) Kernel() Artifact {
+	return u.unpacked("-vmlinuz-generic")
+}
+
+func (u *UbuntuDistribution) InitRd() Artifact {
+	return u.unpacked("-initrd-generic")
+}
+
+func (u *UbuntuDistribution) Image() Artifact {
+	return Artifact{
+		URL:         fmt.Sprintf("%s/%s/current/%s", ubuntuImagesUrl, u.ReleaseName, u.fileName(".tar.gz")),
+		Path:        fmt.Sprintf("%s/%s", u.ImageDirectory(), u.fileName(".img")),
+		Member:      u.fileName(".img"),
+		Compression: CompressionGzip,
+		Checksums:   u.checksums(utils.Empty),
+	}
+}
+
+// Layout boots the image, an unpartitioned ext4 filesystem.
+func (u *UbuntuDistribution) Layout() BootLayout {
+	return BootLayout{
+		CommandLine: []string{"console=hvc0", "root=/dev/vda"},
+		Commands:    debianFamilyCommands,
+	}
+}
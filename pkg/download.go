@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MirrorEnv is the variable pointing the downloads at a mirror, an http(s) or a file:// URL.
+	// The mirror is laid out like the directories of `wget -x`: <mirror>/<host>/<path of the published file>.
+	MirrorEnv = "MACHINA_MIRROR"
+
+	partialSuffix = ".partial"
+)
+
+// mirroredURL returns the URL the published file is downloaded from, the file itself without mirror
+func mirroredURL(published string) (string, error) {
+	mirror := FromEnvWithDefault(MirrorEnv, utils.Empty)
+	if mirror == utils.Empty {
+		return published, nil
+	}
+	u, err := url.Parse(published)
+	if err != nil {
+		return utils.Empty, err
+	}
+	mirrored := fmt.Sprintf("%s/%s%s", strings.TrimSuffix(mirror, "/"), u.Host, u.EscapedPath())
+	if u.RawQuery != utils.Empty {
+		mirrored += "?" + u.RawQuery
+	}
+	return mirrored, nil
+}
+
+// download fetches the published file to dst, from the mirror when there is one.
+// The content goes to dst.partial, an interrupted download is resumed from it by the next one, and dst appears once complete.
+// The progress is written to output, nothing is reported when nil.
+func download(published, dst string, output io.Writer) error {
+	source, err := mirroredURL(published)
+	if err != nil {
+		return err
+	}
+	partial := dst + partialSuffix
+	var offset int64
+	if info, err := os.Stat(partial); err == nil {
+		offset = info.Size()
+	}
+	body, size, resumed, err := openURL(source, offset)
+	if err != nil {
+		return fmt.Errorf("cannot download %s: %v", source, err)
+	}
+	defer body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if !resumed {
+		flags, offset = os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0
+	} else {
+		utils.Logger.Infof("Resuming the download of %s at %s", source, HumanBytes(offset))
+	}
+	file, err := os.OpenFile(partial, flags, 0644)
+	if err != nil {
+		return err
+	}
+	report := newProgress(output, path.Base(published), size)
+	report.start(offset)
+	_, err = io.Copy(io.MultiWriter(file, report), body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	report.done()
+	if err != nil {
+		return fmt.Errorf("the download of %s was interrupted, it's resumed by the next one: %v", source, err)
+	}
+	if size >= 0 && report.current != size {
+		return fmt.Errorf("the download of %s is incomplete, %d bytes of %d, it's resumed by the next one", source, report.current, size)
+	}
+	return os.Rename(partial, dst)
+}
+
+// openURL opens an http(s) or a file:// URL from offset. It returns the size of the whole content, -1 when it's unknown,
+// and whether the content starts at offset: a server ignoring the range sends it from the start.
+func openURL(rawURL string, offset int64) (body io.ReadCloser, size int64, resumed bool, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if u.Scheme == "file" {
+		return openFile(u.Path, offset)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		return response.Body, response.ContentLength, false, nil
+	case http.StatusPartialContent:
+		size = -1
+		if response.ContentLength >= 0 {
+			size = offset + response.ContentLength
+		}
+		// Content-Range: bytes <first>-<last>/<size>
+		if i := strings.LastIndex(response.Header.Get("Content-Range"), "/"); i >= 0 {
+			if total, err := strconv.ParseInt(response.Header.Get("Content-Range")[i+1:], 10, 64); err == nil {
+				size = total
+			}
+		}
+		return response.Body, size, true, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file isn't smaller than the published one, which changed since
+		response.Body.Close()
+		return openURL(rawURL, 0)
+	}
+	response.Body.Close()
+	return nil, 0, false, fmt.Errorf("%s", response.Status)
+}
+
+func openFile(filePath string, offset int64) (io.ReadCloser, int64, bool, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, false, err
+	}
+	if offset <= 0 || offset > info.Size() {
+		return file, info.Size(), false, nil
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, 0, false, err
+	}
+	return file, info.Size(), true, nil
+}
+
+// fetchContent reads a small published file, like a checksum list, from the mirror when there is one
+func fetchContent(published string) ([]byte, error) {
+	source, err := mirroredURL(published)
+	if err != nil {
+		return nil, err
+	}
+	body, _, _, err := openURL(source, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download %s: %v", source, err)
+	}
+	defer body.Close()
+	return ioutil.ReadAll(io.LimitReader(body, maxChecksumSize))
+}
+
+// progressOutput returns stderr when it's a terminal, the progress isn't written to the logs of the daemons
+func progressOutput() io.Writer {
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return os.Stderr
+	}
+	return nil
+}
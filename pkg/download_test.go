@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("machina "), 4096)
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		switch r.URL.Path {
+		case "/image.img":
+			http.ServeContent(w, r, "image.img", time.Time{}, bytes.NewReader(content))
+		case "/norange.img":
+			w.Write(content)
+		case "/truncated.img":
+			w.Header().Set("Content-Length", "100")
+			w.Write(content[:50])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	t.Run("should download to dst and report the progress", func(t *testing.T) {
+		ranges = nil
+		dst := filepath.Join(t.TempDir(), "image.img")
+		var output bytes.Buffer
+
+		assert.NoError(t, download(server.URL+"/image.img", dst, &output))
+		downloaded, _ := os.ReadFile(dst)
+		assert.Equal(t, content, downloaded)
+		assert.NoFileExists(t, dst+partialSuffix)
+		assert.Equal(t, []string{""}, ranges)
+		assert.Contains(t, output.String(), "image.img 100% 32.0KiB/32.0KiB\n")
+	})
+
+	t.Run("should resume a partial download", func(t *testing.T) {
+		ranges = nil
+		dst := filepath.Join(t.TempDir(), "image.img")
+		assert.NoError(t, os.WriteFile(dst+partialSuffix, content[:1000], 0644))
+
+		assert.NoError(t, download(server.URL+"/image.img", dst, nil))
+		downloaded, _ := os.ReadFile(dst)
+		assert.Equal(t, content, downloaded)
+		assert.Equal(t, []string{"bytes=1000-"}, ranges)
+	})
+
+	t.Run("should restart when the server ignores the range", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "image.img")
+		assert.NoError(t, os.WriteFile(dst+partialSuffix, content[:1000], 0644))
+
+		assert.NoError(t, download(server.URL+"/norange.img", dst, nil))
+		downloaded, _ := os.ReadFile(dst)
+		assert.Equal(t, content, downloaded)
+	})
+
+	t.Run("should restart when the partial file is too large", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "image.img")
+		assert.NoError(t, os.WriteFile(dst+partialSuffix, append(content, "more"...), 0644))
+
+		assert.NoError(t, download(server.URL+"/image.img", dst, nil))
+		downloaded, _ := os.ReadFile(dst)
+		assert.Equal(t, content, downloaded)
+	})
+
+	t.Run("should keep the partial file of an interrupted download", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "image.img")
+
+		assert.Error(t, download(server.URL+"/truncated.img", dst, nil))
+		assert.NoFileExists(t, dst)
+		partial, _ := os.ReadFile(dst + partialSuffix)
+		assert.Equal(t, content[:50], partial)
+	})
+
+	t.Run("should fail on a missing file", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "image.img")
+
+		assert.Error(t, download(server.URL+"/missing.img", dst, nil))
+		assert.NoFileExists(t, dst)
+	})
+}
+
+func TestDownloadFromMirror(t *testing.T) {
+	mirror := t.TempDir()
+	published := filepath.Join(mirror, "cloud-images.ubuntu.com", "focal", "current")
+	assert.NoError(t, os.MkdirAll(published, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(published, "image.img"), []byte("offline image"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(published, "SHA256SUMS"), []byte("sums"), 0644))
+	setTestEnv(t, MirrorEnv, "file://"+mirror+"/")
+
+	t.Run("should map the published file to the mirror", func(t *testing.T) {
+		source, err := mirroredURL("https://cloud-images.ubuntu.com/focal/current/image.img")
+		assert.NoError(t, err)
+		assert.Equal(t, "file://"+mirror+"/cloud-images.ubuntu.com/focal/current/image.img", source)
+	})
+
+	t.Run("should download from a directory", func(t *testing.T) {
+		dst := filepath.Join(t.TempDir(), "image.img")
+		assert.NoError(t, os.WriteFile(dst+partialSuffix, []byte("offline"), 0644))
+
+		assert.NoError(t, download("https://cloud-images.ubuntu.com/focal/current/image.img", dst, nil))
+		downloaded, _ := os.ReadFile(dst)
+		assert.Equal(t, "offline image", string(downloaded))
+	})
+
+	t.Run("should fetch the checksums from the mirror", func(t *testing.T) {
+		content, err := fetchContent("https://cloud-images.ubuntu.com/focal/current/SHA256SUMS")
+		assert.NoError(t, err)
+		assert.Equal(t, "sums", string(content))
+	})
+
+	t.Run("should download from an http mirror", func(t *testing.T) {
+		server := httptest.NewServer(http.FileServer(http.Dir(mirror)))
+		defer server.Close()
+		setTestEnv(t, MirrorEnv, server.URL)
+		dst := filepath.Join(t.TempDir(), "image.img")
+
+		assert.NoError(t, download("https://cloud-images.ubuntu.com/focal/current/image.img", dst, nil))
+		downloaded, _ := os.ReadFile(dst)
+		assert.Equal(t, "offline image", string(downloaded))
+	})
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"errors"
+	"os"
+)
+
+// VMState represents the execution state of a virtual machine as reported by a Driver.
+// The values follow the Virtualization framework ordering so the vz states can be converted directly.
+type VMState int
+
+const (
+	// VMStateStopped Initial state before the virtual machine is started.
+	VMStateStopped VMState = iota
+	// VMStateRunning Running virtual machine.
+	VMStateRunning
+	// VMStatePaused A started virtual machine is paused.
+	VMStatePaused
+	// VMStateError The virtual machine has encountered an internal error.
+	VMStateError
+	// VMStateStarting The virtual machine is configuring the hardware and starting.
+	VMStateStarting
+	// VMStatePausing The virtual machine is being paused.
+	VMStatePausing
+	// VMStateResuming The virtual machine is being resumed.
+	VMStateResuming
+)
+
+var vmStateNames = map[VMState]string{
+	VMStateStopped:  "stopped",
+	VMStateRunning:  "running",
+	VMStatePaused:   "paused",
+	VMStateError:    "error",
+	VMStateStarting: "starting",
+	VMStatePausing:  "pausing",
+	VMStateResuming: "resuming",
+}
+
+func (s VMState) String() string {
+	if name, ok := vmStateNames[s]; ok {
+		return name
+	}
+	return Machine_state_error
+}
+
+// ErrNoDriver is returned when no hypervisor driver is available on the current platform
+var ErrNoDriver = errors.New("no hypervisor driver available on this platform")
+
+// DefaultDriver is the driver used by machines that don't define one.
+// It is set by the platform specific driver implementation (vz on darwin).
+var DefaultDriver Driver
+
+// ConsoleConfig describes the serial console of a virtual machine.
+// When Input and Output are set, the console is attached to these file handles,
+// otherwise the console output is appended to LogPath.
+type ConsoleConfig struct {
+	LogPath string
+	Input   *os.File
+	Output  *os.File
+}
+
+// DiskConfig describes a block device attached to a virtual machine.
+// Disks are attached in order, the first one is /dev/vda.
+type DiskConfig struct {
+	Path     string
+	ReadOnly bool
+}
+
+// VMConfig is the hypervisor agnostic description of a virtual machine.
+type VMConfig struct {
+	Kernel        string
+	Initrd        string
+	CommandLine   []string
+	Cpu           uint
+	Memory        uint64
+	MacAddress    string
+	Console       ConsoleConfig
+	Disks         []DiskConfig
+	MemoryBalloon bool
+}
+
+// Driver creates virtual machines on a hypervisor.
+type Driver interface {
+	// Create validates the configuration and returns a stopped virtual machine.
+	Create(config *VMConfig) (VM, error)
+}
+
+// VM is a virtual machine created by a Driver.
+type VM interface {
+	// Start boots the virtual machine, fn is called with nil once it started or with the failure cause.
+	Start(fn func(error))
+	// Pause suspends the execution of a running virtual machine, fn is called with the result.
+	Pause(fn func(error))
+	// Resume continues the execution of a paused virtual machine, fn is called with the result.
+	Resume(fn func(error))
+	// RequestStop asks the guest to turn itself off, it returns true if the request was made.
+	RequestStop() (bool, error)
+	// State returns the current execution state.
+	State() VMState
+	// StateChangedNotify notifies every execution state change.
+	StateChangedNotify() <-chan VMState
+}
+
+func (m *Machine) driver() (Driver, error) {
+	if m.Driver != nil {
+		return m.Driver, nil
+	}
+	if DefaultDriver != nil {
+		return DefaultDriver, nil
+	}
+	return nil, ErrNoDriver
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+)
+
+// FakeDriver is an in-memory Driver, it allows to exercise the machine lifecycle
+// without an hypervisor by scripting the state transitions of the created machines.
+type FakeDriver struct {
+	// CreateError is returned by Create when set
+	CreateError error
+	// StartError makes every started machine fail with this error
+	StartError error
+	// IgnoreStopRequest makes the guest ignore RequestStop, like a guest without ACPI support
+	IgnoreStopRequest bool
+	// OnStart is called in a dedicated goroutine once a machine reached the running state
+	OnStart func(vm *FakeVM)
+	// AsyncStart starts the machines in a dedicated goroutine, like the hypervisor does
+	AsyncStart bool
+
+	mu  sync.Mutex
+	vms []*FakeVM
+}
+
+// FakeVM is a virtual machine created by a FakeDriver.
+type FakeVM struct {
+	Config *VMConfig
+
+	driver       *FakeDriver
+	mu           sync.RWMutex
+	state        VMState
+	stopRequests int
+	notify       chan VMState
+}
+
+func NewFakeDriver() *FakeDriver {
+	return &FakeDriver{}
+}
+
+func (d *FakeDriver) Create(config *VMConfig) (VM, error) {
+	if d.CreateError != nil {
+		return nil, d.CreateError
+	}
+	vm := &FakeVM{
+		Config: config,
+		driver: d,
+		state:  VMStateStopped,
+		notify: make(chan VMState, 64),
+	}
+	d.mu.Lock()
+	d.vms = append(d.vms, vm)
+	d.mu.Unlock()
+	return vm, nil
+}
+
+// VMs returns every machine created by the driver, in creation order
+func (d *FakeDriver) VMs() []*FakeVM {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*FakeVM{}, d.vms...)
+}
+
+func (vm *FakeVM) Start(fn func(error)) {
+	if vm.driver.AsyncStart {
+		go vm.start(fn)
+		return
+	}
+	vm.start(fn)
+}
+
+func (vm *FakeVM) start(fn func(error)) {
+	vm.SetState(VMStateStarting)
+	if vm.driver.StartError != nil {
+		vm.SetState(VMStateError)
+		fn(vm.driver.StartError)
+		return
+	}
+	vm.SetState(VMStateRunning)
+	fn(nil)
+	if vm.driver.OnStart != nil {
+		go vm.driver.OnStart(vm)
+	}
+}
+
+func (vm *FakeVM) Pause(fn func(error)) {
+	if state := vm.State(); state != VMStateRunning {
+		fn(fmt.Errorf("cannot pause a machine %s", state))
+		return
+	}
+	vm.SetState(VMStatePausing)
+	vm.SetState(VMStatePaused)
+	fn(nil)
+}
+
+func (vm *FakeVM) Resume(fn func(error)) {
+	if state := vm.State(); state != VMStatePaused {
+		fn(fmt.Errorf("cannot resume a machine %s", state))
+		return
+	}
+	vm.SetState(VMStateResuming)
+	vm.SetState(VMStateRunning)
+	fn(nil)
+}
+
+func (vm *FakeVM) RequestStop() (bool, error) {
+	vm.mu.Lock()
+	vm.stopRequests++
+	vm.mu.Unlock()
+	if vm.driver.IgnoreStopRequest {
+		return false, nil
+	}
+	vm.SetState(VMStateStopped)
+	return true, nil
+}
+
+// StopRequests returns how many times the guest was asked to stop
+func (vm *FakeVM) StopRequests() int {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	return vm.stopRequests
+}
+
+func (vm *FakeVM) State() VMState {
+	vm.mu.RLock()
+	defer vm.mu.RUnlock()
+	return vm.state
+}
+
+func (vm *FakeVM) StateChangedNotify() <-chan VMState {
+	return vm.notify
+}
+
+// SetState moves the machine to the given state and notifies the change,
+// it's used by tests to script transitions like a guest powering off.
+func (vm *FakeVM) SetState(state VMState) {
+	vm.mu.Lock()
+	vm.state = state
+	vm.mu.Unlock()
+	select {
+	case vm.notify <- state:
+	default:
+		// nobody listens, drop the notification like a full hypervisor queue
+	}
+}
+
+// FakeGuest is an OnStart script emulating a guest: when its console is attached,
+// it prints the final message of cloud-init, then it powers off.
+func FakeGuest(vm *FakeVM) {
+	if output := vm.Config.Console.Output; output != nil {
+		fmt.Fprintln(output, "[  OK  ] Reached target Multi-User System.")
+		fmt.Fprintln(output, "Cloud-init v. 23.1 finished at Mon, 01 May 2023 10:00:00 +0000. Up 12.34 seconds")
+	}
+	vm.SetState(VMStateStopped)
+}
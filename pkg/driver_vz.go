@@ -0,0 +1,134 @@
+//go:build darwin
+// +build darwin
+
+package internal
+
+import (
+	"fmt"
+	"github.com/Code-Hex/vz"
+	"net"
+	"strings"
+)
+import "C"
+
+func init() {
+	DefaultDriver = &VzDriver{}
+}
+
+// VzDriver runs virtual machines with the Apple Virtualization Framework.
+type VzDriver struct{}
+
+type vzVM struct {
+	vm     *vz.VirtualMachine
+	notify chan VMState
+}
+
+func (d *VzDriver) Create(config *VMConfig) (VM, error) {
+	bootLoader := vz.NewLinuxBootLoader(
+		config.Kernel,
+		vz.WithCommandLine(strings.Join(config.CommandLine, " ")),
+		vz.WithInitrd(config.Initrd),
+	)
+
+	vzConfig := vz.NewVirtualMachineConfiguration(
+		bootLoader,
+		config.Cpu,
+		config.Memory,
+	)
+
+	// console
+	var serialPortAttachment vz.SerialPortAttachment
+	if config.Console.Input != nil && config.Console.Output != nil {
+		serialPortAttachment = vz.NewFileHandleSerialPortAttachment(config.Console.Input, config.Console.Output)
+	} else {
+		fileAttachment, err := vz.NewFileSerialPortAttachment(config.Console.LogPath, true)
+		if err != nil {
+			return nil, fmt.Errorf("error during serial port attachment (file: %s): %v", config.Console.LogPath, err)
+		}
+		serialPortAttachment = fileAttachment
+	}
+	consoleConfig := vz.NewVirtioConsoleDeviceSerialPortConfiguration(serialPortAttachment)
+	vzConfig.SetSerialPortsVirtualMachineConfiguration([]*vz.VirtioConsoleDeviceSerialPortConfiguration{
+		consoleConfig,
+	})
+
+	// network
+	natAttachment := vz.NewNATNetworkDeviceAttachment()
+	networkConfig := vz.NewVirtioNetworkDeviceConfiguration(natAttachment)
+
+	mac, err := net.ParseMAC(config.MacAddress)
+	if err != nil {
+		return nil, err
+	}
+	networkConfig.SetMACAddress(vz.NewMACAddress(mac))
+	vzConfig.SetNetworkDevicesVirtualMachineConfiguration([]*vz.VirtioNetworkDeviceConfiguration{
+		networkConfig,
+	})
+
+	// entropy
+	entropyConfig := vz.NewVirtioEntropyDeviceConfiguration()
+	vzConfig.SetEntropyDevicesVirtualMachineConfiguration([]*vz.VirtioEntropyDeviceConfiguration{
+		entropyConfig,
+	})
+
+	// storage
+	storageDevices := make([]vz.StorageDeviceConfiguration, 0, len(config.Disks))
+	for _, disk := range config.Disks {
+		diskImageAttachment, err := vz.NewDiskImageStorageDeviceAttachment(
+			disk.Path,
+			disk.ReadOnly,
+		)
+		if err != nil {
+			return nil, err
+		}
+		storageDevices = append(storageDevices, vz.NewVirtioBlockDeviceConfiguration(diskImageAttachment))
+	}
+	vzConfig.SetStorageDevicesVirtualMachineConfiguration(storageDevices)
+
+	// traditional memory balloon device which allows for managing guest memory. (optional)
+	if config.MemoryBalloon {
+		vzConfig.SetMemoryBalloonDevicesVirtualMachineConfiguration([]vz.MemoryBalloonDeviceConfiguration{
+			vz.NewVirtioTraditionalMemoryBalloonDeviceConfiguration(),
+		})
+	}
+
+	validated, err := vzConfig.Validate()
+	if !validated || err != nil {
+		return nil, fmt.Errorf("validation failed: %v", err)
+	}
+
+	vm := &vzVM{
+		vm:     vz.NewVirtualMachine(vzConfig),
+		notify: make(chan VMState),
+	}
+	go func() {
+		for state := range vm.vm.StateChangedNotify() {
+			vm.notify <- VMState(state)
+		}
+	}()
+	return vm, nil
+}
+
+func (v *vzVM) Start(fn func(error)) {
+	v.vm.Start(fn)
+}
+
+func (v *vzVM) Pause(fn func(error)) {
+	v.vm.Pause(fn)
+}
+
+func (v *vzVM) Resume(fn func(error)) {
+	v.vm.Resume(fn)
+}
+
+func (v *vzVM) RequestStop() (bool, error) {
+	return v.vm.RequestStop()
+}
+
+func (v *vzVM) State() VMState {
+	return VMState(v.vm.State())
+}
+
+func (v *vzVM) StateChangedNotify() <-chan VMState {
+	return v.notify
+}
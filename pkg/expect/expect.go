@@ -0,0 +1,258 @@
+// Package expect drives an interactive console, like the serial console of a guest:
+// it waits for expected output, sends input and fails on known failure output.
+package expect
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultStepTimeout bounds a step without timeout
+	DefaultStepTimeout = 30 * time.Second
+	// maxPending is the output kept while nothing is expected, the oldest output is dropped beyond
+	maxPending = 64 * 1024
+)
+
+// ErrClosed is returned when the output ends before the expected output
+var ErrClosed = errors.New("the console output is closed")
+
+// TimeoutError is returned when the expected output didn't come in time
+type TimeoutError struct {
+	Expected string
+	Timeout  time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s not received after %s", e.Expected, e.Timeout)
+}
+
+// FailureError is returned when a failure pattern is found in the output
+type FailureError struct {
+	Pattern string
+	// Line is the output line holding the failure
+	Line string
+}
+
+func (e *FailureError) Error() string {
+	return fmt.Sprintf("failure %q found in the output: %s", e.Pattern, e.Line)
+}
+
+// Matcher finds an expected output
+type Matcher interface {
+	// Match returns the start and the end of the first match in output, nil when not found
+	Match(output []byte) []int
+	String() string
+}
+
+type literal string
+
+// Literal matches the text as is
+func Literal(text string) Matcher {
+	return literal(text)
+}
+
+func (l literal) Match(output []byte) []int {
+	index := bytes.Index(output, []byte(l))
+	if index < 0 {
+		return nil
+	}
+	return []int{index, index + len(l)}
+}
+
+func (l literal) String() string {
+	return fmt.Sprintf("%q", string(l))
+}
+
+type pattern struct {
+	*regexp.Regexp
+}
+
+// Regexp matches the regular expression, it panics when the expression is invalid
+func Regexp(expression string) Matcher {
+	return pattern{regexp.MustCompile(expression)}
+}
+
+func (p pattern) Match(output []byte) []int {
+	return p.FindIndex(output)
+}
+
+func (p pattern) String() string {
+	return "/" + p.Regexp.String() + "/"
+}
+
+// Step waits for Expect then sends Send, an empty Expect or Send is skipped
+type Step struct {
+	Expect Matcher
+	Send   string
+	// Timeout bounds the wait of Expect, Options.StepTimeout when zero
+	Timeout time.Duration
+}
+
+// Options configures a Session
+type Options struct {
+	// Timeout bounds the whole session, no limit when zero
+	Timeout time.Duration
+	// StepTimeout bounds each step, DefaultStepTimeout when zero
+	StepTimeout time.Duration
+	// SendDelay is waited before sending, consoles often drop input sent right after their prompt
+	SendDelay time.Duration
+	// Failures fail the session as soon as one of them is found in the output
+	Failures []Matcher
+	// Transcript receives everything read and sent
+	Transcript io.Writer
+}
+
+// Session reads the output in the background until it's closed, the output is recorded in the transcript
+// even when nothing is expected.
+type Session struct {
+	output  io.Reader
+	input   io.Writer
+	options Options
+
+	mu       sync.Mutex
+	pending  []byte
+	err      error
+	updated  chan struct{}
+	deadline time.Time
+}
+
+// NewSession starts reading output, input receives what is sent
+func NewSession(output io.Reader, input io.Writer, options Options) *Session {
+	if options.StepTimeout <= 0 {
+		options.StepTimeout = DefaultStepTimeout
+	}
+	s := &Session{output: output, input: input, options: options, updated: make(chan struct{})}
+	if options.Timeout > 0 {
+		s.deadline = time.Now().Add(options.Timeout)
+	}
+	go s.read()
+	return s
+}
+
+func (s *Session) read() {
+	buffer := make([]byte, 4096)
+	for {
+		n, err := s.output.Read(buffer)
+		s.mu.Lock()
+		if n > 0 {
+			s.record(buffer[:n])
+			s.pending = append(s.pending, buffer[:n]...)
+			if len(s.pending) > maxPending {
+				s.pending = s.pending[len(s.pending)-maxPending:]
+			}
+		}
+		if err != nil {
+			s.err = ErrClosed
+			if !errors.Is(err, io.EOF) {
+				s.err = fmt.Errorf("%w: %v", ErrClosed, err)
+			}
+		}
+		// wake up the waiting Expect
+		close(s.updated)
+		s.updated = make(chan struct{})
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// record writes to the transcript, the lock must be held
+func (s *Session) record(content []byte) {
+	if s.options.Transcript != nil {
+		s.options.Transcript.Write(content)
+	}
+}
+
+// Expect waits for the matcher within the timeout, Options.StepTimeout when zero.
+// The output is consumed up to the end of the match, which is returned.
+func (s *Session) Expect(matcher Matcher, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		timeout = s.options.StepTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if !s.deadline.IsZero() && s.deadline.Before(deadline) {
+		deadline = s.deadline
+		timeout = time.Until(deadline)
+	}
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		if err := s.failure(); err != nil {
+			s.mu.Unlock()
+			return "", err
+		}
+		if location := matcher.Match(s.pending); location != nil {
+			match := string(s.pending[location[0]:location[1]])
+			s.pending = s.pending[location[1]:]
+			s.mu.Unlock()
+			return match, nil
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return "", fmt.Errorf("waiting for %s: %w", matcher, err)
+		}
+		updated := s.updated
+		s.mu.Unlock()
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return "", &TimeoutError{Expected: matcher.String(), Timeout: timeout}
+		}
+	}
+}
+
+// failure returns a FailureError when a failure pattern is in the pending output, the lock must be held
+func (s *Session) failure() error {
+	for _, failure := range s.options.Failures {
+		if location := failure.Match(s.pending); location != nil {
+			start := bytes.LastIndexByte(s.pending[:location[0]], '\n') + 1
+			end := bytes.IndexByte(s.pending[location[1]:], '\n')
+			if end < 0 {
+				end = len(s.pending)
+			} else {
+				end += location[1]
+			}
+			return &FailureError{Pattern: failure.String(), Line: strings.TrimSpace(string(s.pending[start:end]))}
+		}
+	}
+	return nil
+}
+
+// Send writes text to the input after the send delay
+func (s *Session) Send(text string) error {
+	time.Sleep(s.options.SendDelay)
+	s.mu.Lock()
+	s.record([]byte(text))
+	s.mu.Unlock()
+	_, err := io.WriteString(s.input, text)
+	return err
+}
+
+// Run runs the steps in order and stops at the first failing one
+func (s *Session) Run(steps ...Step) error {
+	for i, step := range steps {
+		if step.Expect != nil {
+			if _, err := s.Expect(step.Expect, step.Timeout); err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+		}
+		if step.Send != "" {
+			if err := s.Send(step.Send); err != nil {
+				return fmt.Errorf("step %d: %w", i+1, err)
+			}
+		}
+	}
+	return nil
+}
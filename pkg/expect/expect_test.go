@@ -0,0 +1,125 @@
+package expect
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newConsole returns a session over in-memory pipes along with the guest side of the console
+func newConsole(t *testing.T, options Options) (*Session, io.WriteCloser, *bufio.Reader) {
+	outputReader, outputWriter := io.Pipe()
+	inputReader, inputWriter := io.Pipe()
+	t.Cleanup(func() {
+		outputWriter.Close()
+		inputReader.Close()
+	})
+	return NewSession(outputReader, inputWriter, options), outputWriter, bufio.NewReader(inputReader)
+}
+
+func TestSession_Expect(t *testing.T) {
+	t.Run("should match a literal", func(t *testing.T) {
+		session, guest, _ := newConsole(t, Options{})
+		go io.WriteString(guest, "booting\nlogin: ")
+
+		match, err := session.Expect(Literal("login:"), time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "login:", match)
+	})
+
+	t.Run("should match a regexp across writes", func(t *testing.T) {
+		session, guest, _ := newConsole(t, Options{})
+		go func() {
+			io.WriteString(guest, "Cloud-init v. 23")
+			io.WriteString(guest, ".1 finished at Mon\n")
+		}()
+
+		match, err := session.Expect(Regexp(`Cloud-init v\. \S+ finished`), time.Second)
+		assert.NoError(t, err)
+		assert.Equal(t, "Cloud-init v. 23.1 finished", match)
+	})
+
+	t.Run("should consume the output up to the match", func(t *testing.T) {
+		session, guest, _ := newConsole(t, Options{})
+		go io.WriteString(guest, "# # ")
+
+		for i := 0; i < 2; i++ {
+			_, err := session.Expect(Literal("#"), time.Second)
+			assert.NoError(t, err)
+		}
+		_, err := session.Expect(Literal("#"), 50*time.Millisecond)
+		assert.Error(t, err)
+	})
+
+	t.Run("should time out a step", func(t *testing.T) {
+		session, _, _ := newConsole(t, Options{StepTimeout: 50 * time.Millisecond})
+
+		_, err := session.Expect(Literal("login:"), 0)
+		var timeout *TimeoutError
+		assert.True(t, errors.As(err, &timeout))
+		assert.Equal(t, `"login:"`, timeout.Expected)
+	})
+
+	t.Run("should time out the session", func(t *testing.T) {
+		session, _, _ := newConsole(t, Options{Timeout: 50 * time.Millisecond})
+
+		start := time.Now()
+		_, err := session.Expect(Literal("login:"), time.Minute)
+		var timeout *TimeoutError
+		assert.True(t, errors.As(err, &timeout))
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	})
+
+	t.Run("should fail on a failure pattern", func(t *testing.T) {
+		session, guest, _ := newConsole(t, Options{Failures: []Matcher{Literal("Kernel panic")}})
+		go io.WriteString(guest, "[    1.2] Kernel panic - not syncing: VFS\n[    1.3] ---[ end")
+
+		_, err := session.Expect(Literal("login:"), time.Second)
+		var failure *FailureError
+		assert.True(t, errors.As(err, &failure))
+		assert.Equal(t, "[    1.2] Kernel panic - not syncing: VFS", failure.Line)
+	})
+
+	t.Run("should fail when the output is closed", func(t *testing.T) {
+		session, guest, _ := newConsole(t, Options{})
+		guest.Close()
+
+		_, err := session.Expect(Literal("login:"), time.Second)
+		assert.True(t, errors.Is(err, ErrClosed))
+	})
+}
+
+func TestSession_Run(t *testing.T) {
+	t.Run("should answer the prompts and record the transcript", func(t *testing.T) {
+		var transcript bytes.Buffer
+		session, guest, input := newConsole(t, Options{Transcript: &transcript, SendDelay: 10 * time.Millisecond})
+		go func() {
+			io.WriteString(guest, "(initramfs) ")
+			command, _ := input.ReadString('\n')
+			io.WriteString(guest, "ran "+command+"(initramfs) ")
+			input.ReadString('\n')
+		}()
+
+		start := time.Now()
+		err := session.Run(
+			Step{Expect: Literal("(initramfs)"), Send: "mount\n"},
+			Step{Expect: Regexp(`ran \w+`)},
+			Step{Expect: Literal("(initramfs)"), Send: "poweroff\n", Timeout: time.Second},
+		)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+		assert.Equal(t, "(initramfs) mount\nran mount\n(initramfs) poweroff\n", transcript.String())
+	})
+
+	t.Run("should report the failing step", func(t *testing.T) {
+		session, _, _ := newConsole(t, Options{StepTimeout: 20 * time.Millisecond})
+
+		err := session.Run(Step{Send: ""}, Step{Expect: Literal("never")})
+		assert.EqualError(t, err, `step 2: "never" not received after 20ms`)
+	})
+}
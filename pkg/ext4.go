@@ -0,0 +1,313 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// A minimal read-only ext4 reader, enough to find the kernel and the initramfs in the /boot of a cloud image:
+// the partitions of a GPT disk, the directories and the files stored in extents. See the ext4 disk layout
+// in Documentation/filesystems/ext4 of Linux.
+
+const (
+	gptSectorSize   = 512
+	ext4SuperOffset = 1024
+	ext4Magic       = 0xef53
+	ext4RootInode   = 2
+
+	ext4Incompat64Bit    = 0x80
+	ext4IncompatExtents  = 0x40
+	ext4ExtentsFlag      = 0x80000
+	ext4InlineDataFlag   = 0x10000000
+	ext4ExtentMagic      = 0xf30a
+	ext4UninitializedLen = 32768
+
+	ext4ModeMask    = 0xf000
+	ext4ModeDir     = 0x4000
+	ext4ModeRegular = 0x8000
+)
+
+type ext4FS struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodeSize      int64
+	inodesPerGroup int64
+	descSize       int64
+	descOffset     int64
+}
+
+type ext4Inode struct {
+	mode  uint16
+	size  int64
+	flags uint32
+	block []byte
+}
+
+type ext4DirEntry struct {
+	name  string
+	inode uint32
+}
+
+// diskPartitions returns the partitions of a GPT disk, the whole disk when it isn't partitioned
+func diskPartitions(disk io.ReaderAt, size int64) ([]*io.SectionReader, error) {
+	header := make([]byte, 92)
+	if _, err := disk.ReadAt(header, gptSectorSize); err != nil || string(header[:8]) != "EFI PART" {
+		return []*io.SectionReader{io.NewSectionReader(disk, 0, size)}, nil
+	}
+	entriesLBA := int64(binary.LittleEndian.Uint64(header[0x48:]))
+	count := int64(binary.LittleEndian.Uint32(header[0x50:]))
+	entrySize := int64(binary.LittleEndian.Uint32(header[0x54:]))
+	if entrySize < 0x30 || count > 1024 {
+		return nil, fmt.Errorf("invalid GPT header")
+	}
+	entries := make([]byte, count*entrySize)
+	if _, err := disk.ReadAt(entries, entriesLBA*gptSectorSize); err != nil {
+		return nil, fmt.Errorf("cannot read the GPT partitions: %v", err)
+	}
+	var partitions []*io.SectionReader
+	for i := int64(0); i < count; i++ {
+		entry := entries[i*entrySize : (i+1)*entrySize]
+		if bytes.Equal(entry[:16], make([]byte, 16)) {
+			continue
+		}
+		first := int64(binary.LittleEndian.Uint64(entry[0x20:]))
+		last := int64(binary.LittleEndian.Uint64(entry[0x28:]))
+		if last < first || (last+1)*gptSectorSize > size {
+			return nil, fmt.Errorf("the partition %d is out of the disk", i+1)
+		}
+		partitions = append(partitions, io.NewSectionReader(disk, first*gptSectorSize, (last-first+1)*gptSectorSize))
+	}
+	return partitions, nil
+}
+
+// openExt4 reads the superblock of the filesystem, found is false when it isn't an ext4 filesystem
+func openExt4(r io.ReaderAt) (fs *ext4FS, found bool, err error) {
+	super := make([]byte, 1024)
+	if _, err := r.ReadAt(super, ext4SuperOffset); err != nil || binary.LittleEndian.Uint16(super[0x38:]) != ext4Magic {
+		return nil, false, nil
+	}
+	fs = &ext4FS{
+		r:              r,
+		blockSize:      1024 << binary.LittleEndian.Uint32(super[0x18:]),
+		inodeSize:      128,
+		inodesPerGroup: int64(binary.LittleEndian.Uint32(super[0x28:])),
+		descSize:       32,
+	}
+	if binary.LittleEndian.Uint32(super[0x4c:]) > 0 {
+		fs.inodeSize = int64(binary.LittleEndian.Uint16(super[0x58:]))
+	}
+	incompat := binary.LittleEndian.Uint32(super[0x60:])
+	if incompat&ext4Incompat64Bit != 0 {
+		fs.descSize = int64(binary.LittleEndian.Uint16(super[0xfe:]))
+	}
+	if incompat&ext4IncompatExtents == 0 {
+		return nil, true, fmt.Errorf("the filesystem doesn't use extents")
+	}
+	if fs.blockSize > 64*1024 || fs.inodeSize < 128 || fs.inodesPerGroup == 0 || fs.descSize < 32 {
+		return nil, true, fmt.Errorf("invalid ext4 superblock")
+	}
+	fs.descOffset = (int64(binary.LittleEndian.Uint32(super[0x14:])) + 1) * fs.blockSize
+	return fs, true, nil
+}
+
+func (fs *ext4FS) inode(number uint32) (*ext4Inode, error) {
+	if number == 0 {
+		return nil, fmt.Errorf("invalid inode 0")
+	}
+	group, index := int64(number-1)/fs.inodesPerGroup, int64(number-1)%fs.inodesPerGroup
+	desc := make([]byte, fs.descSize)
+	if _, err := fs.r.ReadAt(desc, fs.descOffset+group*fs.descSize); err != nil {
+		return nil, fmt.Errorf("cannot read the group of inode %d: %v", number, err)
+	}
+	table := int64(binary.LittleEndian.Uint32(desc[0x8:]))
+	if fs.descSize >= 64 {
+		table |= int64(binary.LittleEndian.Uint32(desc[0x28:])) << 32
+	}
+	raw := make([]byte, 128)
+	if _, err := fs.r.ReadAt(raw, table*fs.blockSize+index*fs.inodeSize); err != nil {
+		return nil, fmt.Errorf("cannot read inode %d: %v", number, err)
+	}
+	return &ext4Inode{
+		mode:  binary.LittleEndian.Uint16(raw[0x0:]),
+		size:  int64(binary.LittleEndian.Uint32(raw[0x4:])) | int64(binary.LittleEndian.Uint32(raw[0x6c:]))<<32,
+		flags: binary.LittleEndian.Uint32(raw[0x20:]),
+		block: raw[0x28:0x64],
+	}, nil
+}
+
+// readFile returns the content of the inode, the unwritten extents read as zeros
+func (fs *ext4FS) readFile(inode *ext4Inode) ([]byte, error) {
+	if inode.flags&ext4InlineDataFlag != 0 || inode.flags&ext4ExtentsFlag == 0 {
+		return nil, fmt.Errorf("only the files stored in extents are supported")
+	}
+	if inode.size > maxKernelSize {
+		return nil, fmt.Errorf("the file is larger than %s", HumanBytes(maxKernelSize))
+	}
+	content := make([]byte, inode.size)
+	return content, fs.readExtents(inode.block, content, 0)
+}
+
+// readExtents reads the extents of the tree node into content, depth bounds the recursion on a corrupted tree
+func (fs *ext4FS) readExtents(node, content []byte, depth int) error {
+	if len(node) < 12 || binary.LittleEndian.Uint16(node) != ext4ExtentMagic || depth > 5 {
+		return fmt.Errorf("invalid extent tree")
+	}
+	entries := int(binary.LittleEndian.Uint16(node[2:]))
+	if 12+entries*12 > len(node) {
+		return fmt.Errorf("invalid extent tree")
+	}
+	leaf := binary.LittleEndian.Uint16(node[6:]) == 0
+	for i := 0; i < entries; i++ {
+		entry := node[12+i*12 : 24+i*12]
+		if !leaf {
+			child := make([]byte, fs.blockSize)
+			block := int64(binary.LittleEndian.Uint32(entry[4:])) | int64(binary.LittleEndian.Uint16(entry[8:]))<<32
+			if _, err := fs.r.ReadAt(child, block*fs.blockSize); err != nil {
+				return err
+			}
+			if err := fs.readExtents(child, content, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		logical := int64(binary.LittleEndian.Uint32(entry[0:])) * fs.blockSize
+		length := int64(binary.LittleEndian.Uint16(entry[4:]))
+		if length > ext4UninitializedLen {
+			// unwritten extent, its blocks are zeros
+			continue
+		}
+		physical := (int64(binary.LittleEndian.Uint16(entry[6:]))<<32 | int64(binary.LittleEndian.Uint32(entry[8:]))) * fs.blockSize
+		if logical >= int64(len(content)) {
+			continue
+		}
+		end := logical + length*fs.blockSize
+		if end > int64(len(content)) {
+			end = int64(len(content))
+		}
+		if _, err := fs.r.ReadAt(content[logical:end], physical); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *ext4FS) readDir(inode *ext4Inode) ([]ext4DirEntry, error) {
+	if inode.mode&ext4ModeMask != ext4ModeDir {
+		return nil, fmt.Errorf("not a directory")
+	}
+	content, err := fs.readFile(inode)
+	if err != nil {
+		return nil, err
+	}
+	var entries []ext4DirEntry
+	// the hashed directories are readable as linear ones, their index is hidden in empty entries
+	for offset := 0; offset+8 <= len(content); {
+		number := binary.LittleEndian.Uint32(content[offset:])
+		recordLength := int(binary.LittleEndian.Uint16(content[offset+4:]))
+		nameLength := int(content[offset+6])
+		if recordLength < 8 || offset+recordLength > len(content) || 8+nameLength > recordLength {
+			return nil, fmt.Errorf("invalid directory entry")
+		}
+		if number != 0 {
+			entries = append(entries, ext4DirEntry{name: string(content[offset+8 : offset+8+nameLength]), inode: number})
+		}
+		offset += recordLength
+	}
+	return entries, nil
+}
+
+// lookup returns the inode of the slash separated path, relative to the root directory
+func (fs *ext4FS) lookup(filePath string) (*ext4Inode, error) {
+	inode, err := fs.inode(ext4RootInode)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range strings.Split(strings.Trim(filePath, "/"), "/") {
+		if name == utils.Empty || name == "." {
+			continue
+		}
+		entries, err := fs.readDir(inode)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filePath, err)
+		}
+		found := false
+		for _, entry := range entries {
+			if entry.name == name {
+				if inode, err = fs.inode(entry.inode); err != nil {
+					return nil, err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s not found", filePath)
+		}
+	}
+	return inode, nil
+}
+
+// glob returns the regular files matching the pattern, a path.Match pattern of the last element only, sorted by name
+func (fs *ext4FS) glob(pattern string) (map[string]*ext4Inode, []string, error) {
+	directory, filePattern := path.Split(pattern)
+	dir, err := fs.lookup(directory)
+	if err != nil {
+		// a filesystem without the directory has no match
+		return nil, nil, nil
+	}
+	entries, err := fs.readDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	matches := map[string]*ext4Inode{}
+	var names []string
+	for _, entry := range entries {
+		if matched, _ := path.Match(filePattern, entry.name); !matched {
+			continue
+		}
+		inode, err := fs.inode(entry.inode)
+		if err != nil {
+			return nil, nil, err
+		}
+		if inode.mode&ext4ModeMask == ext4ModeRegular {
+			name := path.Join(directory, entry.name)
+			matches[name] = inode
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return matches, names, nil
+}
+
+// readImageFile returns the last file in lexical order matching the pattern in the ext4 filesystems of the raw disk image
+func readImageFile(disk io.ReaderAt, size int64, pattern string) (name string, content []byte, err error) {
+	partitions, err := diskPartitions(disk, size)
+	if err != nil {
+		return utils.Empty, nil, err
+	}
+	for _, partition := range partitions {
+		fs, found, err := openExt4(partition)
+		if !found {
+			continue
+		} else if err != nil {
+			return utils.Empty, nil, err
+		}
+		matches, names, err := fs.glob(pattern)
+		if err != nil {
+			return utils.Empty, nil, err
+		}
+		if len(names) == 0 {
+			continue
+		}
+		name = names[len(names)-1]
+		content, err = fs.readFile(matches[name])
+		return name, content, err
+	}
+	return utils.Empty, nil, fmt.Errorf("no file matches %s in the image", pattern)
+}
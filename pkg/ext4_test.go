@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testExt4BlockSize = 4096
+
+// newTestExt4 builds an ext4 filesystem of a single group holding the files, the directories of their paths are created
+func newTestExt4(files map[string]string) []byte {
+	// block 0 holds the superblock, block 1 the group descriptor, block 2 the inode table
+	const inodesPerGroup, inodeSize = 16, 256
+	blocks := [][]byte{make([]byte, testExt4BlockSize), make([]byte, testExt4BlockSize), make([]byte, testExt4BlockSize)}
+	inodes := blocks[2]
+	next := uint32(ext4RootInode)
+	writeInode := func(number uint32, mode uint16, content []byte) {
+		first := len(blocks)
+		for offset := 0; offset < len(content); offset += testExt4BlockSize {
+			block := make([]byte, testExt4BlockSize)
+			copy(block, content[offset:])
+			blocks = append(blocks, block)
+		}
+		raw := inodes[(number-1)*inodeSize:]
+		binary.LittleEndian.PutUint16(raw[0x0:], mode)
+		binary.LittleEndian.PutUint32(raw[0x4:], uint32(len(content)))
+		binary.LittleEndian.PutUint32(raw[0x20:], ext4ExtentsFlag)
+		binary.LittleEndian.PutUint16(raw[0x28:], ext4ExtentMagic)
+		binary.LittleEndian.PutUint16(raw[0x2a:], 1)
+		binary.LittleEndian.PutUint16(raw[0x2c:], 4)
+		binary.LittleEndian.PutUint16(raw[0x34+4:], uint16(len(blocks)-first))
+		binary.LittleEndian.PutUint32(raw[0x34+8:], uint32(first))
+	}
+	var writeDir func(number uint32, dir string)
+	writeDir = func(number uint32, dir string) {
+		children := map[string]bool{}
+		for name := range files {
+			if rest := strings.TrimPrefix(name, dir); rest != name || dir == "" {
+				children[strings.SplitN(rest, "/", 2)[0]] = strings.Contains(rest, "/")
+			}
+		}
+		names := make([]string, 0, len(children))
+		for name := range children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		content := make([]byte, testExt4BlockSize)
+		offset := 0
+		for i, name := range names {
+			next++
+			child := next
+			recordLength := 8 + (len(name)+3)/4*4
+			if i == len(names)-1 {
+				recordLength = testExt4BlockSize - offset
+			}
+			binary.LittleEndian.PutUint32(content[offset:], child)
+			binary.LittleEndian.PutUint16(content[offset+4:], uint16(recordLength))
+			content[offset+6] = byte(len(name))
+			copy(content[offset+8:], name)
+			offset += recordLength
+			if children[name] {
+				writeDir(child, dir+name+"/")
+			} else {
+				writeInode(child, ext4ModeRegular|0644, []byte(files[dir+name]))
+			}
+		}
+		writeInode(number, ext4ModeDir|0755, content)
+	}
+	writeDir(ext4RootInode, "")
+
+	super := blocks[0][ext4SuperOffset:]
+	binary.LittleEndian.PutUint32(super[0x18:], 2)
+	binary.LittleEndian.PutUint32(super[0x28:], inodesPerGroup)
+	binary.LittleEndian.PutUint16(super[0x38:], ext4Magic)
+	binary.LittleEndian.PutUint32(super[0x4c:], 1)
+	binary.LittleEndian.PutUint16(super[0x58:], inodeSize)
+	binary.LittleEndian.PutUint32(super[0x60:], ext4IncompatExtents)
+	binary.LittleEndian.PutUint32(blocks[1][0x8:], 2)
+	return bytes.Join(blocks, nil)
+}
+
+// newTestGPTDisk builds a GPT disk of the partitions
+func newTestGPTDisk(partitions ...[]byte) []byte {
+	const firstLBA = 34
+	disk := make([]byte, firstLBA*gptSectorSize)
+	header := disk[gptSectorSize:]
+	copy(header, "EFI PART")
+	binary.LittleEndian.PutUint64(header[0x48:], 2)
+	binary.LittleEndian.PutUint32(header[0x50:], uint32(len(partitions)))
+	binary.LittleEndian.PutUint32(header[0x54:], 128)
+	for i, partition := range partitions {
+		entry := disk[2*gptSectorSize+i*128:]
+		copy(entry, "partition type")
+		first := len(disk) / gptSectorSize
+		binary.LittleEndian.PutUint64(entry[0x20:], uint64(first))
+		binary.LittleEndian.PutUint64(entry[0x28:], uint64(first+len(partition)/gptSectorSize-1))
+		disk = append(disk, partition...)
+	}
+	return disk
+}
+
+func TestReadImageFile(t *testing.T) {
+	kernel := strings.Repeat("kernel", 2*testExt4BlockSize)
+
+	t.Run("should read the last matching file of the filesystem", func(t *testing.T) {
+		disk := newTestExt4(map[string]string{
+			"boot/vmlinuz-6.1.0-17-arm64": "old kernel",
+			"boot/vmlinuz-6.1.0-18-arm64": kernel,
+			"boot/initrd.img-6.1.0-18":    "initrd",
+			"etc/hostname":                "debian",
+		})
+
+		name, content, err := readImageFile(bytes.NewReader(disk), int64(len(disk)), "boot/vmlinuz-*")
+		assert.NoError(t, err)
+		assert.Equal(t, "boot/vmlinuz-6.1.0-18-arm64", name)
+		assert.Equal(t, kernel, string(content))
+	})
+
+	t.Run("should look for the file in the partitions of the disk", func(t *testing.T) {
+		disk := newTestGPTDisk(make([]byte, testExt4BlockSize), newTestExt4(map[string]string{
+			"vmlinuz-0-rescue-0123456789": "rescue",
+			"vmlinuz-6.8.5-301.fc40":      kernel,
+		}), newTestExt4(map[string]string{"etc/hostname": "fedora"}))
+
+		name, content, err := readImageFile(bytes.NewReader(disk), int64(len(disk)), "vmlinuz-[1-9]*")
+		assert.NoError(t, err)
+		assert.Equal(t, "vmlinuz-6.8.5-301.fc40", name)
+		assert.Equal(t, kernel, string(content))
+	})
+
+	t.Run("should fail when no file matches", func(t *testing.T) {
+		disk := newTestGPTDisk(newTestExt4(map[string]string{"etc/hostname": "debian"}))
+
+		_, _, err := readImageFile(bytes.NewReader(disk), int64(len(disk)), "boot/vmlinuz-*")
+		assert.EqualError(t, err, "no file matches boot/vmlinuz-* in the image")
+	})
+}
+
+func TestExtractImageFile(t *testing.T) {
+	newTestMachine(t, nil)
+	directory := baseImageDirectory()
+	disk := newTestExt4(map[string]string{"boot/initrd.img-6.1.0-18": "initrd"})
+
+	for _, authenticated := range []bool{true, false} {
+		image := path.Join(directory, "image")
+		assert.NoError(t, os.WriteFile(image, disk, 0644))
+		assert.NoError(t, recordChecksum(image, image, authenticated))
+		artifact := Artifact{Path: path.Join(directory, "initrd"), ImageFile: "boot/initrd.img-*"}
+
+		assert.NoError(t, extractImageFile(image, artifact))
+		content, err := os.ReadFile(artifact.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, "initrd", string(content))
+		// the extracted file is as verified as the image
+		status, err := VerifyArtifact(artifact.Path)
+		assert.NoError(t, err)
+		assert.Equal(t, map[bool]string{true: Artifact_verified, false: Artifact_unverified}[authenticated], status)
+		os.Remove(artifact.Path)
+	}
+}
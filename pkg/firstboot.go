@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/pkg/expect"
+	"github.com/efortin/machina/utils"
+	"os"
+	"time"
+)
+
+// FirstBootTimeout is the expected duration of the first boot, until cloud-init finished to configure the guest.
+// A longer first boot is only reported, the guest may still be provisioning.
+var FirstBootTimeout = 10 * time.Minute
+
+var (
+	// cloudInitFinished is the final message of cloud-init on the console
+	cloudInitFinished = expect.Regexp(`Cloud-init v\. \S+ finished`)
+	// firstBootFailures are console outputs of a boot which won't succeed
+	firstBootFailures = []expect.Matcher{
+		expect.Literal("Kernel panic"),
+		expect.Literal("Dropping to a shell"),
+		expect.Literal("You are in emergency mode"),
+	}
+)
+
+// firstBoot watches the console of the first boot of a machine, it's marked provisioned once cloud-init finished.
+type firstBoot struct {
+	// console is attached to the guest, its output is recorded in the console log
+	console ConsoleConfig
+	files   []*os.File
+	// failed receives the failure of the first boot
+	failed chan error
+	done   chan struct{}
+}
+
+func (m *Machine) watchFirstBoot() (*firstBoot, error) {
+	log, err := os.OpenFile(m.OutputLogPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	outputReader, outputWriter, err := os.Pipe()
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	inputReader, inputWriter, err := os.Pipe()
+	if err != nil {
+		log.Close()
+		outputReader.Close()
+		outputWriter.Close()
+		return nil, err
+	}
+
+	boot := &firstBoot{
+		console: ConsoleConfig{Input: inputReader, Output: outputWriter},
+		// the guest side is closed first to end the session
+		files:  []*os.File{outputWriter, inputReader, outputReader, inputWriter, log},
+		failed: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+	session := expect.NewSession(outputReader, inputWriter, expect.Options{
+		Failures:   firstBootFailures,
+		Transcript: log,
+	})
+	go func() {
+		defer close(boot.done)
+		if err := m.waitCloudInit(session); err != nil {
+			boot.failed <- fmt.Errorf("the first boot of machine %s failed: %v", m.Name, err)
+			return
+		}
+		utils.Logger.Info("The machine", m.Name, "has been configured by cloud-init")
+		if err := m.markProvisioned(); err != nil {
+			utils.Logger.Warn(err)
+		}
+	}()
+	return boot, nil
+}
+
+// waitCloudInit waits until cloud-init finished, a warning is logged each time FirstBootTimeout elapses.
+// It only fails on a failure output or when the console is closed.
+func (m *Machine) waitCloudInit(session *expect.Session) error {
+	for elapsed := FirstBootTimeout; ; elapsed += FirstBootTimeout {
+		err := session.Run(expect.Step{Expect: cloudInitFinished, Timeout: FirstBootTimeout})
+		var timeout *expect.TimeoutError
+		if !errors.As(err, &timeout) {
+			return err
+		}
+		utils.Logger.Warnf("cloud-init hasn't finished to configure the machine %s after %s, it keeps running", m.Name, elapsed)
+	}
+}
+
+// close ends the watch once the machine stopped, the output already written is still watched
+func (b *firstBoot) close() {
+	b.files[0].Close()
+	<-b.done
+	for _, file := range b.files[1:] {
+		file.Close()
+	}
+	select {
+	case err := <-b.failed:
+		utils.Logger.Warn(err, ", cloud-init runs again at the next start")
+	default:
+	}
+}
@@ -0,0 +1,326 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// forwardKeepAlive is the interval of the keepalive requests detecting a dead ssh connection,
+// like the one of a guest which rebooted
+const forwardKeepAlive = 15 * time.Second
+
+// ForwardStatus is a port forward served by a machine daemon
+type ForwardStatus struct {
+	PortForward
+	// Connections is the number of tunneled connections
+	Connections int `json:"connections"`
+	// Auto is true for a guest port forwarded automatically
+	Auto bool `json:"auto,omitempty"`
+	// Error is the reason why the host port isn't listening
+	Error string `json:"error,omitempty"`
+}
+
+func (s ForwardStatus) String() string {
+	return fmt.Sprintf("%d->%d", s.Host, s.Guest)
+}
+
+// ResolvePortForwards parses the host:guest port forwards, a host port is forwarded once
+func ResolvePortForwards(values []string) ([]PortForward, error) {
+	forwards := make([]PortForward, 0, len(values))
+	hosts := map[int]PortForward{}
+	for _, value := range values {
+		forward, err := ParsePortForward(value)
+		if err != nil {
+			return nil, err
+		}
+		if other, found := hosts[forward.Host]; found {
+			return nil, fmt.Errorf("the host port %d is forwarded twice: %s and %s", forward.Host, other, forward)
+		}
+		hosts[forward.Host] = forward
+		forwards = append(forwards, forward)
+	}
+	return forwards, nil
+}
+
+// ActiveForwards returns the port forwards served by the daemon of the machine
+func (m *Machine) ActiveForwards() ([]ForwardStatus, error) {
+	response, err := m.Control(ControlForwards)
+	if err != nil {
+		return nil, err
+	}
+	return response.Forwards, nil
+}
+
+// portForwarder listens on localhost and tunnels the connections to the guest over ssh.
+// The ssh connection is opened on demand and opened again once it's lost.
+type portForwarder struct {
+	name string
+	// address resolves the ssh address of the guest, it may change when the guest reboots
+	address func() (string, error)
+
+	mu        sync.Mutex
+	client    *ssh.Client
+	listeners map[PortForward]*forwardListener
+	failures  map[PortForward]error
+	// autoForward forwards the guest ports automatically when set
+	autoForward *AutoForward
+	stop        chan struct{}
+}
+
+type forwardListener struct {
+	net.Listener
+	// guestHost is the address the guest port listens on
+	guestHost   string
+	auto        bool
+	connections int32
+}
+
+func newPortForwarder(name string, address func() (string, error)) *portForwarder {
+	f := &portForwarder{
+		name:      name,
+		address:   address,
+		listeners: map[PortForward]*forwardListener{},
+		failures:  map[PortForward]error{},
+		stop:      make(chan struct{}),
+	}
+	go f.keepAlive(forwardKeepAlive)
+	go f.watchGuestPorts(autoForwardInterval)
+	return f
+}
+
+// startForwards serves the port forwards of the spec
+func (m *Machine) startForwards() *portForwarder {
+	forwarder := newPortForwarder(m.Name, m.SshAddress)
+	forwarder.setAutoForward(m.Spec.AutoForward)
+	if err := forwarder.sync(m.Spec.Ports); err != nil {
+		utils.Logger.Warn(err)
+	}
+	return forwarder
+}
+
+// sync listens for the forwards of values and closes the other listeners, but the automatic ones.
+// A forward which can't listen is reported and the others are served.
+func (f *portForwarder) sync(values []string) error {
+	forwards, err := ResolvePortForwards(values)
+	if err != nil {
+		return fmt.Errorf("machine %s: %v", f.name, err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	wanted := map[PortForward]bool{}
+	for _, forward := range forwards {
+		wanted[forward] = true
+	}
+	hosts := map[int]bool{}
+	for _, forward := range forwards {
+		hosts[forward.Host] = true
+	}
+	for forward, listener := range f.listeners {
+		// an automatic forward gives its host port up to the spec
+		if listener.auto && hosts[forward.Host] || !listener.auto && !wanted[forward] {
+			listener.Close()
+			delete(f.listeners, forward)
+		}
+	}
+	f.failures = map[PortForward]error{}
+	var failures []string
+	for _, forward := range forwards {
+		if _, found := f.listeners[forward]; found {
+			continue
+		}
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(forward.Host)))
+		if err != nil {
+			f.failures[forward] = err
+			failures = append(failures, fmt.Sprintf("%s: %v", forward, err))
+			continue
+		}
+		utils.Logger.Infof("Forwarding localhost:%d to port %d of machine %s", forward.Host, forward.Guest, f.name)
+		f.listeners[forward] = &forwardListener{Listener: listener, guestHost: "127.0.0.1"}
+		go f.serve(f.listeners[forward], forward.Guest)
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("machine %s: cannot forward %v", f.name, failures)
+	}
+	return nil
+}
+
+func (f *portForwarder) serve(listener *forwardListener, guest int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			atomic.AddInt32(&listener.connections, 1)
+			defer atomic.AddInt32(&listener.connections, -1)
+			if err := f.tunnel(conn, listener.guestHost, guest); err != nil {
+				utils.Logger.Debugf("the connection to port %d of machine %s failed: %v", guest, f.name, err)
+			}
+		}()
+	}
+}
+
+// tunnel copies the connection to the guest port and back until both sides are closed
+func (f *portForwarder) tunnel(conn net.Conn, guestHost string, guest int) error {
+	defer conn.Close()
+	remote, err := f.dial(guestHost, guest)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(remote, conn)
+		if closer, ok := remote.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(conn, remote)
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok {
+		closer.CloseWrite()
+	}
+	<-done
+	return nil
+}
+
+// dial opens a channel to the guest port, the ssh connection is opened again when it's broken
+func (f *portForwarder) dial(guestHost string, guest int) (net.Conn, error) {
+	target := net.JoinHostPort(guestHost, strconv.Itoa(guest))
+	for attempt := 0; ; attempt++ {
+		client, err := f.sshClient()
+		if err != nil {
+			return nil, err
+		}
+		conn, err := client.Dial("tcp", target)
+		var rejected *ssh.OpenChannelError
+		if err == nil || errors.As(err, &rejected) || attempt > 0 {
+			return conn, err
+		}
+		f.reset(client)
+	}
+}
+
+// sshClient returns the ssh connection, it's dialed without holding the lock so that the status and the syncs don't wait for the guest.
+// When two connections are dialed at once, the first published one is kept.
+func (f *portForwarder) sshClient() (*ssh.Client, error) {
+	f.mu.Lock()
+	client := f.client
+	f.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+	address, err := f.address()
+	if err != nil {
+		return nil, err
+	}
+	client, err = dialHost(DefaultSshUser, address)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.stop:
+		client.Close()
+		return nil, fmt.Errorf("the port forwards of machine %s are closed", f.name)
+	default:
+	}
+	if f.client != nil {
+		client.Close()
+		return f.client, nil
+	}
+	f.client = client
+	go func() {
+		client.Wait()
+		f.reset(client)
+	}()
+	return client, nil
+}
+
+// reset closes client, the next connection opens a new one
+func (f *portForwarder) reset(client *ssh.Client) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.client == client {
+		f.client = nil
+	}
+	client.Close()
+}
+
+// keepAlive closes the ssh connection once the guest stops answering
+func (f *portForwarder) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+		f.mu.Lock()
+		client := f.client
+		f.mu.Unlock()
+		if client == nil {
+			continue
+		}
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+		select {
+		case err := <-answered:
+			if err == nil {
+				continue
+			}
+		case <-time.After(interval):
+		}
+		utils.Logger.Debugf("the ssh connection to machine %s is lost", f.name)
+		f.reset(client)
+	}
+}
+
+// status returns the forwards sorted by host port
+func (f *portForwarder) status() []ForwardStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	statuses := make([]ForwardStatus, 0, len(f.listeners)+len(f.failures))
+	for forward, listener := range f.listeners {
+		statuses = append(statuses, ForwardStatus{PortForward: forward, Auto: listener.auto, Connections: int(atomic.LoadInt32(&listener.connections))})
+	}
+	for forward, err := range f.failures {
+		statuses = append(statuses, ForwardStatus{PortForward: forward, Error: err.Error()})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Host < statuses[j].Host
+	})
+	return statuses
+}
+
+// close stops the listeners and the ssh connection, the tunneled connections end with it
+func (f *portForwarder) close() {
+	close(f.stop)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for forward, listener := range f.listeners {
+		listener.Close()
+		delete(f.listeners, forward)
+	}
+	if f.client != nil {
+		f.client.Close()
+		f.client = nil
+	}
+}
@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestGuestPort serves an echo on localhost, it returns its port
+func startTestGuestPort(t *testing.T) int {
+	return startTestGuestPortOn(t, "127.0.0.1:0")
+}
+
+// startTestGuestPortOn serves an echo on address, it returns its port
+func startTestGuestPortOn(t *testing.T, address string) int {
+	listener, err := net.Listen("tcp", address)
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				content, _ := ioutil.ReadAll(conn)
+				conn.Write([]byte("echo " + string(content)))
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// freeTestPort returns a port of localhost nobody listens on
+func freeTestPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// roundTrip sends content to the host port and returns the answer
+func roundTrip(t *testing.T, port int, content string) string {
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	assert.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte(content))
+	conn.(*net.TCPConn).CloseWrite()
+	answer, _ := ioutil.ReadAll(conn)
+	return string(answer)
+}
+
+func TestResolvePortForwards(t *testing.T) {
+	forwards, err := ResolvePortForwards([]string{"8080:80", "2222:22"})
+	assert.NoError(t, err)
+	assert.Equal(t, []PortForward{{Host: 8080, Guest: 80}, {Host: 2222, Guest: 22}}, forwards)
+
+	_, err = ResolvePortForwards([]string{"8080:80", "8080:81"})
+	assert.EqualError(t, err, "the host port 8080 is forwarded twice: 8080:80 and 8080:81")
+}
+
+func TestPortForwarder(t *testing.T) {
+	newTestMachine(t, nil)
+	address := startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 { return 0 })
+	guest := startTestGuestPort(t)
+
+	t.Run("should tunnel the connections to the guest port", func(t *testing.T) {
+		forwarder := newPortForwarder("test", func() (string, error) { return address, nil })
+		defer forwarder.close()
+		host := freeTestPort(t)
+
+		assert.NoError(t, forwarder.sync([]string{PortForward{Host: host, Guest: guest}.String()}))
+		assert.Equal(t, "echo ping", roundTrip(t, host, "ping"))
+		assert.Equal(t, []ForwardStatus{{PortForward: PortForward{Host: host, Guest: guest}}}, forwarder.status())
+	})
+
+	t.Run("should open the ssh connection again once it's lost", func(t *testing.T) {
+		forwarder := newPortForwarder("test", func() (string, error) { return address, nil })
+		defer forwarder.close()
+		host := freeTestPort(t)
+		assert.NoError(t, forwarder.sync([]string{PortForward{Host: host, Guest: guest}.String()}))
+		assert.Equal(t, "echo first", roundTrip(t, host, "first"))
+
+		forwarder.mu.Lock()
+		forwarder.client.Close()
+		forwarder.mu.Unlock()
+		assert.Equal(t, "echo second", roundTrip(t, host, "second"))
+	})
+
+	t.Run("should serve the status while the ssh connection is opened", func(t *testing.T) {
+		dialing, release := make(chan struct{}), make(chan struct{})
+		forwarder := newPortForwarder("test", func() (string, error) {
+			close(dialing)
+			<-release
+			return address, nil
+		})
+		defer forwarder.close()
+		connected := make(chan error)
+		go func() {
+			_, err := forwarder.sshClient()
+			connected <- err
+		}()
+		<-dialing
+
+		served := make(chan struct{})
+		go func() {
+			forwarder.status()
+			forwarder.sync(nil)
+			close(served)
+		}()
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the status waited for the ssh connection")
+		}
+		close(release)
+		assert.NoError(t, <-connected)
+	})
+
+	t.Run("should close the connection when the guest port is closed", func(t *testing.T) {
+		forwarder := newPortForwarder("test", func() (string, error) { return address, nil })
+		defer forwarder.close()
+		host := freeTestPort(t)
+		assert.NoError(t, forwarder.sync([]string{PortForward{Host: host, Guest: freeTestPort(t)}.String()}))
+
+		assert.Equal(t, "", roundTrip(t, host, "ping"))
+	})
+
+	t.Run("should follow the forwards and report the failing ones", func(t *testing.T) {
+		forwarder := newPortForwarder("test", func() (string, error) { return address, nil })
+		defer forwarder.close()
+		busy, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(t, err)
+		defer busy.Close()
+		busyPort, host := busy.Addr().(*net.TCPAddr).Port, freeTestPort(t)
+
+		assert.NoError(t, forwarder.sync([]string{PortForward{Host: host, Guest: guest}.String()}))
+		assert.Error(t, forwarder.sync([]string{PortForward{Host: busyPort, Guest: guest}.String()}))
+		statuses := forwarder.status()
+		assert.Len(t, statuses, 1)
+		assert.Equal(t, busyPort, statuses[0].Host)
+		assert.NotEmpty(t, statuses[0].Error)
+		_, err = net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(host)))
+		assert.Error(t, err)
+	})
+}
+
+func TestMachine_reloadForwards(t *testing.T) {
+	machine := newTestMachine(t, nil)
+	machine.forwarder = newPortForwarder(machine.Name, machine.SshAddress)
+	defer machine.forwarder.close()
+	vm, _ := NewFakeDriver().Create(&VMConfig{})
+	host := freeTestPort(t)
+
+	machine.BaseDirectory()
+	saved := *machine
+	saved.Spec.Ports = []string{PortForward{Host: host, Guest: 80}.String()}
+	assert.NoError(t, saved.ExportMachineSpecification())
+	response, _ := machine.control(vm, ControlRequest{Command: ControlReloadForwards})
+	assert.Empty(t, response.Error)
+
+	response, _ = machine.control(vm, ControlRequest{Command: ControlForwards})
+	assert.Equal(t, []ForwardStatus{{PortForward: PortForward{Host: host, Guest: 80}}}, response.Forwards)
+}
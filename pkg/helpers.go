@@ -1,7 +1,6 @@
 package internal
 
 import (
-	"compress/gzip"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
@@ -10,15 +9,10 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"github.com/cavaliergopher/grab/v3"
 	"github.com/efortin/machina/utils"
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/sys/unix"
-	"io"
 	"io/ioutil"
-	"log"
 	"os"
-	"os/exec"
 	"os/user"
 	"strconv"
 	"strings"
@@ -30,11 +24,6 @@ const (
 	GB                 = 1024 * 1024 * 1024
 )
 
-type UbuntuDistribution struct {
-	ReleaseName  string `json:"release"`
-	Architecture string `json:"arch"`
-}
-
 func FromEnvWithDefault(key, fallback string) string {
 	value := os.Getenv(key)
 	if len(value) == 0 {
@@ -65,22 +54,18 @@ func readPidFromFile(filename string) (int, error) {
 	content := strings.TrimSpace(string(bs))
 	pid, err := strconv.Atoi(content)
 	if err != nil {
-		return 0, fmt.Errorf("%v parsing %s", filename)
+		return 0, fmt.Errorf("%v parsing %s", err, filename)
 	}
 
 	return pid, nil
 }
 
-func (release *UbuntuDistribution) ImageDirectory() string {
-	return fmt.Sprintf("%s/%s", baseImageDirectory(), release.ReleaseName)
-}
-
-func (release *UbuntuDistribution) cloneIfNotExist(srcFilePath string, dstFilePath string) (err error) {
+func cloneIfNotExist(srcFilePath string, dstFilePath string) (err error) {
 	if _, err := os.Stat(dstFilePath); err == nil {
 		utils.Logger.Infof("Machine files %s exists, ignore copy", dstFilePath)
 		return err
 	}
-	err = unix.Clonefile(srcFilePath, dstFilePath, 0)
+	err = cloneFile(srcFilePath, dstFilePath)
 	return
 }
 
@@ -96,6 +81,20 @@ func baseImageDirectory() string {
 	return imageDirectory
 }
 
+// baseDiskDirectory is the store of the data disks shared by the machines
+func baseDiskDirectory() string {
+	diskDirectory := fmt.Sprintf("%s/disks", GetWorkingDirectory())
+	DirectoryCreateIfAbsent(diskDirectory)
+	return diskDirectory
+}
+
+// baseKernelDirectory is the cache of the kernels prepared for booting, named after the hash of their published file and their architecture
+func baseKernelDirectory() string {
+	kernelDirectory := fmt.Sprintf("%s/kernels", GetWorkingDirectory())
+	DirectoryCreateIfAbsent(kernelDirectory)
+	return kernelDirectory
+}
+
 func ListExistingMachines() *utils.Set {
 	files, err := os.ReadDir(baseMachineDirectory())
 	directoryNameStrings := make([]string, 0)
@@ -122,103 +121,6 @@ func FromFileSpec(name string) (*Machine, error) {
 	return &machine, err
 }
 
-// DownloadDistro will download a url to a local file. It's efficient because it will
-// write as it downloads and not load the whole file into memory.
-func (r *UbuntuDistribution) DownloadDistro() (err error) {
-	DirectoryCreateIfAbsent(r.ImageDirectory())
-	err = r.downloadInitRd()
-	err = r.downloadKernel()
-	err = r.downloadImage()
-	return err
-
-}
-
-func (release *UbuntuDistribution) InitRdPath() string {
-	return release.ImageDirectory() + fmt.Sprintf("/%s-server-cloudimg-%s-initrd-generic", release.ReleaseName, release.Architecture)
-}
-
-func (release *UbuntuDistribution) KernelPath() string {
-	return release.ImageDirectory() + fmt.Sprintf("/%s-server-cloudimg-%s-vmlinuz-generic", release.ReleaseName, release.Architecture)
-}
-
-func (release *UbuntuDistribution) KernelPathGZIP() string {
-	return release.ImageDirectory() + fmt.Sprintf("/%s-server-cloudimg-%s-vmlinuz-generic.gz", release.ReleaseName, release.Architecture)
-}
-
-func (release *UbuntuDistribution) ImagePath() string {
-	return release.ImageDirectory() + fmt.Sprintf("/%s-server-cloudimg-%s.img", release.ReleaseName, release.Architecture)
-}
-
-func (release *UbuntuDistribution) downloadInitRd() (err error) {
-	_, err = os.Stat(release.InitRdPath())
-	if err == nil {
-		utils.Logger.Infof("InitRD %s at %s already exists", release.ReleaseName, release.InitRdPath())
-		return
-	}
-	_, err = grab.Get(release.ImageDirectory(), fmt.Sprintf("https://cloud-images.ubuntu.com/%s/current/unpacked/%s-server-cloudimg-%s-initrd-generic", release.ReleaseName, release.ReleaseName, release.Architecture))
-	return err
-}
-
-func (release *UbuntuDistribution) downloadKernel() (err error) {
-	_, err = os.Stat(release.KernelPath())
-	if err == nil {
-		utils.Logger.Infof("Kernel %s at %s already exists", release.ReleaseName, release.KernelPath())
-		return
-	}
-	_, err = grab.Get(release.KernelPathGZIP(), fmt.Sprintf("https://cloud-images.ubuntu.com/%s/current/unpacked/%s-server-cloudimg-%s-vmlinuz-generic", release.ReleaseName, release.ReleaseName, release.Architecture))
-
-	if err != nil {
-		fmt.Println("ERRRRR", err)
-	}
-	// Open compressed file
-	gzipFile, err := os.Open(release.KernelPathGZIP())
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Create a gzip reader on top of the file reader
-	// Again, it could be any type reader though
-	gzipReader, err := gzip.NewReader(gzipFile)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer gzipReader.Close()
-
-	// Uncompress to a writer. We'll use a file writer
-	outfileWriter, err := os.Create(release.KernelPath())
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer outfileWriter.Close()
-
-	// Copy contents of gzipped file to output file
-	_, err = io.Copy(outfileWriter, gzipReader)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	return err
-}
-
-func (release *UbuntuDistribution) downloadImage() (err error) {
-
-	_, err = os.Stat(release.ImagePath())
-	if err == nil {
-		utils.Logger.Debugf("Image %s at %s already exists", release.ReleaseName, release.ImagePath())
-		return
-	}
-	_, err = grab.Get(release.ImageDirectory(), fmt.Sprintf("https://cloud-images.ubuntu.com/%s/current/%s-server-cloudimg-%s.tar.gz", release.ReleaseName, release.ReleaseName, release.Architecture))
-
-	fmt.Println(err)
-	cmd := exec.Command("/usr/bin/tar", "xf", release.ImageDirectory()+"/"+release.ReleaseName+"-server-cloudimg-arm64.tar.gz")
-	cmd.Dir = release.ImageDirectory() + "/"
-	utils.Logger.Info("cmd directory", cmd.Dir)
-	err = cmd.Run()
-	cmd.Wait()
-
-	return
-}
-
 func DirectoryCreateIfAbsent(path string) (err error) {
 	_, err = os.Stat(path)
 	if err != nil {
@@ -231,8 +133,7 @@ func DirectoryCreateIfAbsent(path string) (err error) {
 func GetWorkingDirectory() string {
 	user, err := user.Current()
 	if err != nil {
-		fmt.Errorf("%s", err)
-		os.Exit(1)
+		utils.Logger.Fatal(err)
 	}
 	vmctldir := FromEnvWithDefault("VMCTLDIR", fmt.Sprint(user.HomeDir, "/.vm"))
 	DirectoryCreateIfAbsent(vmctldir)
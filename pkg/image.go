@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// imageArchs are the architectures looked for in the image cache
+var imageArchs = []string{"arm64", "amd64"}
+
+// leftoverSuffixes are the intermediate files of the downloads: published archives and interrupted downloads
+var leftoverSuffixes = []string{".tar.gz", ".gz", ".xz", ".tar", ".qcow2", ".download", partialSuffix, ".tmp"}
+
+// pruneGracePeriod protects the recent files from PruneImages, they may belong to a download in progress
+const pruneGracePeriod = time.Hour
+
+// CachedImage is a downloaded distribution release
+type CachedImage struct {
+	Distribution Distribution
+	// Files are the artifacts found in the cache along with their checksum
+	Files []string
+	Size  int64
+	// DownloadedAt is the time the last artifact was unpacked
+	DownloadedAt time.Time
+	// Machines are the machines created from the image, they need it to be started again
+	Machines []string
+}
+
+// artifactPaths returns the unpacked artifacts of the distribution, found or not
+func artifactPaths(d Distribution) []string {
+	return []string{d.Kernel().Path, d.InitRd().Path, d.Image().Path}
+}
+
+// ListImages returns the downloaded images sorted by distribution, release and architecture
+func ListImages() ([]*CachedImage, error) {
+	entries, err := os.ReadDir(baseImageDirectory())
+	if err != nil {
+		return nil, err
+	}
+	users := imageUsers()
+	var images []*CachedImage
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		for _, d := range imageDistributions(entry.Name()) {
+			image, err := cachedImage(d)
+			if err != nil {
+				return nil, err
+			}
+			if len(image.Files) == 0 {
+				continue
+			}
+			image.Machines = users[d.Image().Path]
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		a, b := images[i].Distribution, images[j].Distribution
+		if a.Kind() != b.Kind() {
+			return a.Kind() < b.Kind()
+		}
+		if a.Release() != b.Release() {
+			return a.Release() < b.Release()
+		}
+		return a.Arch() < b.Arch()
+	})
+	return images, nil
+}
+
+// imageDistributions returns the distributions whose images may be stored in the directory name
+func imageDistributions(name string) []Distribution {
+	var candidates []Distribution
+	for _, kind := range DistributionKinds() {
+		release := strings.TrimPrefix(name, kind+"-")
+		for _, arch := range imageArchs {
+			d, err := NewDistribution(kind, release, arch)
+			if err == nil && filepath.Base(d.ImageDirectory()) == name {
+				candidates = append(candidates, d)
+			}
+		}
+	}
+	return candidates
+}
+
+func cachedImage(d Distribution) (*CachedImage, error) {
+	image := &CachedImage{Distribution: d}
+	for _, artifact := range artifactPaths(d) {
+		for _, path := range []string{artifact, artifact + checksumSuffix} {
+			info, err := os.Stat(path)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			image.Files = append(image.Files, path)
+			image.Size += info.Size()
+			if path == artifact && info.ModTime().After(image.DownloadedAt) {
+				image.DownloadedAt = info.ModTime()
+			}
+		}
+	}
+	return image, nil
+}
+
+// imageUsers maps the image path of the distributions to the machines created from them
+func imageUsers() map[string][]string {
+	users := map[string][]string{}
+	machines := ListExistingMachines().List()
+	sort.Strings(machines)
+	for _, name := range machines {
+		machine, err := FromFileSpec(name)
+		if err != nil || machine.Distribution == nil {
+			continue
+		}
+		path := machine.Distribution.Image().Path
+		users[path] = append(users[path], name)
+	}
+	return users
+}
+
+// RemoveImage deletes the artifacts of the distribution from the cache.
+// An image used by a machine is only removed with force, it's downloaded again at the next start of the machine.
+func RemoveImage(d Distribution, force bool) error {
+	image, err := cachedImage(d)
+	if err != nil {
+		return err
+	}
+	if len(image.Files) == 0 {
+		return fmt.Errorf("the image %s %s %s isn't downloaded", d.Kind(), d.Release(), d.Arch())
+	}
+	if machines := imageUsers()[d.Image().Path]; len(machines) > 0 && !force {
+		return fmt.Errorf("the image %s %s %s is used by the machines %v", d.Kind(), d.Release(), d.Arch(), machines)
+	}
+	for _, path := range image.Files {
+		if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// the directory is left when another architecture or files unknown to machina remain
+	os.Remove(d.ImageDirectory())
+	return nil
+}
+
+// PrunedFile is a file of the image cache deleted by PruneImages
+type PrunedFile struct {
+	Path string
+	Size int64
+}
+
+// PruneImages deletes the images no machine was created from, the leftovers of the downloads
+// and the kernels prepared from no kept image. The leftovers of the images of the active machines
+// and the files modified within pruneGracePeriod are kept, they may be downloading. With dryRun, the files are only listed.
+func PruneImages(dryRun bool) ([]PrunedFile, error) {
+	entries, err := os.ReadDir(baseImageDirectory())
+	if err != nil {
+		return nil, err
+	}
+	users := imageUsers()
+	// kernels holds the prepared kernels of the kept images
+	kernels := map[string]bool{}
+	var pruned []PrunedFile
+	prune := func(path string, size int64) error {
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < pruneGracePeriod {
+			return nil
+		}
+		pruned = append(pruned, PrunedFile{Path: path, Size: size})
+		if dryRun {
+			return nil
+		}
+		return os.RemoveAll(path)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		directory := filepath.Join(baseImageDirectory(), entry.Name())
+		// artifacts holds the artifacts of the directory, like the initrd.gz of Debian which isn't a leftover
+		artifacts := map[string]bool{}
+		downloading := false
+		for _, d := range imageDistributions(entry.Name()) {
+			for _, path := range artifactPaths(d) {
+				artifacts[path], artifacts[path+checksumSuffix] = true, true
+			}
+			image, err := cachedImage(d)
+			if err != nil {
+				return nil, err
+			}
+			machines := users[d.Image().Path]
+			for _, name := range machines {
+				downloading = downloading || (&Machine{Name: name}).IsActive()
+			}
+			if len(machines) > 0 || time.Since(image.DownloadedAt) < pruneGracePeriod {
+				if content, err := ioutil.ReadFile(d.Kernel().Path); err == nil {
+					kernels[preparedKernelPath(content, d.Arch())] = true
+				}
+				continue
+			}
+			for _, path := range image.Files {
+				if err = prune(path, fileSize(path)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if downloading {
+			continue
+		}
+
+		files, err := os.ReadDir(directory)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			path := filepath.Join(directory, file.Name())
+			// the directories are the leftovers of the extractions with tar of the previous versions
+			if artifacts[path] || !file.IsDir() && !hasLeftoverSuffix(file.Name()) || file.IsDir() && !strings.HasPrefix(file.Name(), ".extract") {
+				continue
+			}
+			if err = prune(path, fileSize(path)); err != nil {
+				return nil, err
+			}
+		}
+		if !dryRun {
+			// only an empty directory is removed
+			os.Remove(directory)
+		}
+	}
+
+	// the machines have their own copy of the kernel, a prepared kernel is only needed to create them
+	files, err := os.ReadDir(baseKernelDirectory())
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		path := filepath.Join(baseKernelDirectory(), file.Name())
+		if kernels[path] {
+			continue
+		}
+		if err = prune(path, fileSize(path)); err != nil {
+			return nil, err
+		}
+	}
+	return pruned, nil
+}
+
+func hasLeftoverSuffix(name string) bool {
+	for _, suffix := range leftoverSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileSize returns the size of the file, or of the files of a directory
+func fileSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
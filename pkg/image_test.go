@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestImage writes the artifacts of the release in the image cache
+func newTestImage(t *testing.T, kind, release, arch string) Distribution {
+	d, err := NewDistribution(kind, release, arch)
+	assert.NoError(t, err)
+	assert.NoError(t, DirectoryCreateIfAbsent(d.ImageDirectory()))
+	for _, path := range artifactPaths(d) {
+		assert.NoError(t, os.WriteFile(path, []byte("artifact"), 0644))
+	}
+	return d
+}
+
+// ageFiles makes the files of the working directory older than pruneGracePeriod
+func ageFiles(t *testing.T) {
+	old := time.Now().Add(-2 * pruneGracePeriod)
+	assert.NoError(t, filepath.Walk(GetWorkingDirectory(), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(path, old, old)
+	}))
+}
+
+func TestListImages(t *testing.T) {
+	m := newTestMachine(t, nil)
+	m.BaseDirectory()
+	assert.NoError(t, m.ExportMachineSpecification())
+	newTestImage(t, "debian", "bookworm", "amd64")
+
+	images, err := ListImages()
+	assert.NoError(t, err)
+	assert.Len(t, images, 2)
+	assert.Equal(t, "debian", images[0].Distribution.Kind())
+	assert.Equal(t, "amd64", images[0].Distribution.Arch())
+	assert.Empty(t, images[0].Machines)
+	assert.Equal(t, int64(3*len("artifact")), images[0].Size)
+	assert.Equal(t, "ubuntu", images[1].Distribution.Kind())
+	assert.Equal(t, "focal", images[1].Distribution.Release())
+	assert.Equal(t, []string{"test"}, images[1].Machines)
+	assert.False(t, images[1].DownloadedAt.IsZero())
+}
+
+func TestPruneImages(t *testing.T) {
+	m := newTestMachine(t, nil)
+	m.BaseDirectory()
+	assert.NoError(t, m.ExportMachineSpecification())
+	debian := newTestImage(t, "debian", "bookworm", "arm64")
+	leftovers := []string{
+		filepath.Join(m.Distribution.ImageDirectory(), "focal-server-cloudimg-arm64.tar.gz"),
+		filepath.Join(m.Distribution.ImageDirectory(), "focal-server-cloudimg-arm64.img.download"),
+	}
+	for _, path := range leftovers {
+		assert.NoError(t, os.WriteFile(path, []byte("leftover"), 0644))
+	}
+	assert.NoError(t, os.Mkdir(filepath.Join(m.Distribution.ImageDirectory(), ".extract123"), 0755))
+	kernel, err := prepareKernel(m.Distribution.Kernel().Path, m.Distribution.Arch())
+	assert.NoError(t, err)
+	staleKernel := filepath.Join(baseKernelDirectory(), "0123-arm64")
+	assert.NoError(t, os.WriteFile(staleKernel, newTestKernel("arm64"), 0644))
+	ageFiles(t)
+	fedora := newTestImage(t, "fedora", "39", "arm64")
+	partial := filepath.Join(m.Distribution.ImageDirectory(), "focal-server-cloudimg-arm64.img.download"+partialSuffix)
+	assert.NoError(t, os.WriteFile(partial, []byte("downloading"), 0644))
+
+	t.Run("should only list the files with dry-run", func(t *testing.T) {
+		pruned, err := PruneImages(true)
+		assert.NoError(t, err)
+		// the Debian initrd is named initrd.gz, it's not a leftover
+		assert.Len(t, pruned, 3+len(leftovers)+2)
+		for _, file := range pruned {
+			_, err := os.Stat(file.Path)
+			assert.NoError(t, err)
+		}
+	})
+
+	t.Run("should delete the unused images and the leftovers", func(t *testing.T) {
+		_, err := PruneImages(false)
+		assert.NoError(t, err)
+		assert.NoDirExists(t, debian.ImageDirectory())
+		for _, path := range leftovers {
+			assert.NoFileExists(t, path)
+		}
+		assert.NoDirExists(t, filepath.Join(m.Distribution.ImageDirectory(), ".extract123"))
+		assert.NoFileExists(t, staleKernel)
+		assert.FileExists(t, kernel)
+	})
+
+	t.Run("should keep the files of a download in progress", func(t *testing.T) {
+		assert.FileExists(t, partial)
+		for _, path := range artifactPaths(fedora) {
+			assert.FileExists(t, path)
+		}
+		for _, path := range artifactPaths(m.Distribution) {
+			assert.FileExists(t, path)
+		}
+	})
+}
+
+func TestRemoveImage(t *testing.T) {
+	m := newTestMachine(t, nil)
+	m.BaseDirectory()
+	assert.NoError(t, m.ExportMachineSpecification())
+
+	assert.Error(t, RemoveImage(m.Distribution, false))
+	assert.NoError(t, RemoveImage(m.Distribution, true))
+	assert.NoDirExists(t, m.Distribution.ImageDirectory())
+	assert.Error(t, RemoveImage(m.Distribution, true))
+}
@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/efortin/machina/utils"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// A minimal ISO9660 writer: the files are stored in the root directory, with a Joliet tree
+// holding their names as is since the primary tree only allows upper case letters, digits and _.
+
+const (
+	isoSectorSize = 2048
+	// the volume descriptors start after the 16 sectors of the system area
+	isoDescriptorSector = 16
+	isoDirectoryFlag    = 2
+)
+
+type isoRecord struct {
+	identifier []byte
+	sector     uint32
+	size       uint32
+	flags      byte
+}
+
+// writeISO9660 writes an image labelled volume holding the files at its root
+func writeISO9660(w io.Writer, volume string, files map[string][]byte, modified time.Time) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// descriptors: primary, joliet and terminator, then a little and a big endian path table
+	// for each tree, a root directory for each tree and the content of the files
+	const (
+		primaryPathSector = isoDescriptorSector + 3
+		jolietPathSector  = primaryPathSector + 2
+		primaryRootSector = jolietPathSector + 2
+		jolietRootSector  = primaryRootSector + 1
+		firstFileSector   = jolietRootSector + 1
+	)
+	var primary, joliet []isoRecord
+	sector := uint32(firstFileSector)
+	for _, name := range names {
+		size := uint32(len(files[name]))
+		primary = append(primary, isoRecord{identifier: []byte(isoPrimaryName(name)), sector: sector, size: size})
+		joliet = append(joliet, isoRecord{identifier: ucs2(name), sector: sector, size: size})
+		sector += (size + isoSectorSize - 1) / isoSectorSize
+	}
+	totalSectors := sector
+	sortRecords(primary)
+	sortRecords(joliet)
+
+	image := &bytes.Buffer{}
+	image.Write(make([]byte, isoDescriptorSector*isoSectorSize))
+	primaryRoot := isoRecord{identifier: []byte{0}, sector: primaryRootSector, size: isoSectorSize, flags: isoDirectoryFlag}
+	jolietRoot := isoRecord{identifier: []byte{0}, sector: jolietRootSector, size: isoSectorSize, flags: isoDirectoryFlag}
+	image.Write(isoVolumeDescriptor(1, volume, totalSectors, primaryPathSector, primaryRoot, modified))
+	image.Write(isoVolumeDescriptor(2, volume, totalSectors, jolietPathSector, jolietRoot, modified))
+	terminator := make([]byte, isoSectorSize)
+	copy(terminator, []byte{255, 'C', 'D', '0', '0', '1', 1})
+	image.Write(terminator)
+
+	for _, root := range []uint32{primaryRootSector, jolietRootSector} {
+		image.Write(sectorOf(isoPathTable(root, binary.LittleEndian)))
+		image.Write(sectorOf(isoPathTable(root, binary.BigEndian)))
+	}
+	for _, tree := range []struct {
+		root    isoRecord
+		records []isoRecord
+	}{{primaryRoot, primary}, {jolietRoot, joliet}} {
+		directory := &bytes.Buffer{}
+		directory.Write(isoDirectoryRecord(tree.root, modified))
+		parent := tree.root
+		parent.identifier = []byte{1}
+		directory.Write(isoDirectoryRecord(parent, modified))
+		for _, record := range tree.records {
+			directory.Write(isoDirectoryRecord(record, modified))
+		}
+		image.Write(sectorOf(directory.Bytes()))
+	}
+	for _, name := range names {
+		image.Write(files[name])
+		if padding := len(files[name]) % isoSectorSize; padding > 0 {
+			image.Write(make([]byte, isoSectorSize-padding))
+		}
+	}
+	_, err := image.WriteTo(w)
+	return err
+}
+
+// isoVolumeDescriptor returns a primary (1) or a Joliet supplementary (2) volume descriptor
+func isoVolumeDescriptor(kind byte, volume string, totalSectors, pathTableSector uint32, root isoRecord, modified time.Time) []byte {
+	descriptor := make([]byte, isoSectorSize)
+	copy(descriptor, []byte{kind, 'C', 'D', '0', '0', '1', 1})
+	text := func(offset, length int, value string) {
+		if kind == 1 {
+			copy(descriptor[offset:offset+length], value+strings.Repeat(" ", length))
+			return
+		}
+		copy(descriptor[offset:offset+length], append(ucs2(value), ucs2(strings.Repeat(" ", length))...))
+	}
+	text(8, 32, utils.Empty)
+	text(40, 32, volume)
+	bothEndian32(descriptor[80:], totalSectors)
+	if kind == 2 {
+		// UCS-2 level 3
+		copy(descriptor[88:], "%/E")
+	}
+	bothEndian16(descriptor[120:], 1)
+	bothEndian16(descriptor[124:], 1)
+	bothEndian16(descriptor[128:], isoSectorSize)
+	bothEndian32(descriptor[132:], uint32(len(isoPathTable(0, binary.LittleEndian))))
+	binary.LittleEndian.PutUint32(descriptor[140:], pathTableSector)
+	binary.BigEndian.PutUint32(descriptor[148:], pathTableSector+1)
+	copy(descriptor[156:], isoDirectoryRecord(root, modified))
+	text(190, 128, utils.Empty)
+	text(318, 128, utils.Empty)
+	text(446, 128, utils.Empty)
+	text(574, 128, commandPrefix)
+	text(702, 37, utils.Empty)
+	text(739, 37, utils.Empty)
+	text(776, 37, utils.Empty)
+	date := []byte(modified.UTC().Format("20060102150405") + "00\x00")
+	copy(descriptor[813:], date)
+	copy(descriptor[830:], date)
+	copy(descriptor[847:], "0000000000000000")
+	copy(descriptor[864:], "0000000000000000")
+	descriptor[881] = 1
+	return descriptor
+}
+
+func isoDirectoryRecord(record isoRecord, modified time.Time) []byte {
+	length := 33 + len(record.identifier)
+	length += length % 2
+	entry := make([]byte, length)
+	entry[0] = byte(length)
+	bothEndian32(entry[2:], record.sector)
+	bothEndian32(entry[10:], record.size)
+	modified = modified.UTC()
+	copy(entry[18:], []byte{byte(modified.Year() - 1900), byte(modified.Month()), byte(modified.Day()),
+		byte(modified.Hour()), byte(modified.Minute()), byte(modified.Second()), 0})
+	entry[25] = record.flags
+	bothEndian16(entry[28:], 1)
+	entry[32] = byte(len(record.identifier))
+	copy(entry[33:], record.identifier)
+	return entry
+}
+
+// isoPathTable lists the root directory only
+func isoPathTable(rootSector uint32, order binary.ByteOrder) []byte {
+	table := make([]byte, 10)
+	table[0] = 1
+	order.PutUint32(table[2:], rootSector)
+	order.PutUint16(table[6:], 1)
+	return table
+}
+
+// isoPrimaryName turns a name into the d-characters of the primary tree, with a file version
+func isoPrimaryName(name string) string {
+	mapped := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, name)
+	if len(mapped) > 30 {
+		mapped = mapped[:30]
+	}
+	return mapped + ".;1"
+}
+
+func ucs2(value string) []byte {
+	encoded := utf16.Encode([]rune(value))
+	content := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.BigEndian.PutUint16(content[2*i:], r)
+	}
+	return content
+}
+
+func sortRecords(records []isoRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		return bytes.Compare(records[i].identifier, records[j].identifier) < 0
+	})
+}
+
+func sectorOf(content []byte) []byte {
+	sector := make([]byte, isoSectorSize)
+	copy(sector, content)
+	return sector
+}
+
+func bothEndian16(b []byte, value uint16) {
+	binary.LittleEndian.PutUint16(b, value)
+	binary.BigEndian.PutUint16(b[2:], value)
+}
+
+func bothEndian32(b []byte, value uint32) {
+	binary.LittleEndian.PutUint32(b, value)
+	binary.BigEndian.PutUint32(b[4:], value)
+}
@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// maxKernelSize bounds the decompressed kernel
+	maxKernelSize = 512 * 1024 * 1024
+	// maxKernelLayers bounds the nested containers and compressions of a kernel, like a compressed zboot
+	maxKernelLayers = 4
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic   = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	// lz4Magic and lz4LegacyMagic start the lz4 frames, the kernel is built with the legacy one
+	lz4Magic       = []byte{0x04, 0x22, 0x4d, 0x18}
+	lz4LegacyMagic = []byte{0x02, 0x21, 0x4c, 0x18}
+)
+
+// prepareKernel returns the kernel of the published file at src as booted by the hypervisor: an arm64 Image or an x86_64 bzImage.
+// The published file is either one, compressed or wrapped in an EFI zboot. The prepared kernel is cached under the hash of src and arch.
+func prepareKernel(src, arch string) (string, error) {
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return utils.Empty, err
+	}
+	path := preparedKernelPath(content, arch)
+	if _, err = os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	for layer := 0; !isKernelImage(content, arch); layer++ {
+		for _, other := range imageArchs {
+			if other != arch && isKernelImage(content, other) {
+				return utils.Empty, fmt.Errorf("%s is an %s kernel, the machine is %s", src, other, arch)
+			}
+		}
+		if layer == maxKernelLayers {
+			return utils.Empty, fmt.Errorf("%s isn't an %s Linux kernel", src, arch)
+		}
+		if content, err = unwrapKernel(content); err != nil {
+			return utils.Empty, fmt.Errorf("cannot prepare the kernel %s: %v", src, err)
+		}
+	}
+	tmpPath := path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return utils.Empty, err
+	}
+	return path, os.Rename(tmpPath, path)
+}
+
+// preparedKernelPath returns the cached kernel prepared from the published kernel content for arch
+func preparedKernelPath(content []byte, arch string) string {
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("%s/%s-%s", baseKernelDirectory(), hex.EncodeToString(sum[:]), arch)
+}
+
+// isKernelImage checks the header of a kernel booted by the hypervisor of arch, see Documentation/arm64/booting.rst
+// and Documentation/x86/boot.rst of Linux
+func isKernelImage(content []byte, arch string) bool {
+	switch arch {
+	case "arm64":
+		return len(content) >= 64 && string(content[56:60]) == "ARM\x64"
+	case "amd64":
+		return len(content) >= 0x206 && binary.LittleEndian.Uint16(content[0x1fe:]) == 0xaa55 && string(content[0x202:0x206]) == "HdrS"
+	}
+	return false
+}
+
+// unwrapKernel removes a layer of the kernel, a compression or an EFI zboot container, identified by its magic bytes
+func unwrapKernel(content []byte) ([]byte, error) {
+	if zboot, found, err := unwrapZboot(content); found || err != nil {
+		return zboot, err
+	}
+	var reader io.Reader
+	switch {
+	case bytes.HasPrefix(content, gzipMagic):
+		gzipReader, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		// the kernel may be followed by padding
+		gzipReader.Multistream(false)
+		reader = gzipReader
+	case bytes.HasPrefix(content, zstdMagic):
+		decoder, err := zstd.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	case bytes.HasPrefix(content, xzMagic):
+		xzReader, err := xz.ReaderConfig{SingleStream: true}.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		reader = xzReader
+	case bytes.HasPrefix(content, lz4Magic), bytes.HasPrefix(content, lz4LegacyMagic):
+		reader = lz4.NewReader(bytes.NewReader(content))
+	default:
+		return nil, fmt.Errorf("unknown kernel format")
+	}
+	kernel, err := ioutil.ReadAll(io.LimitReader(reader, maxKernelSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(kernel) > maxKernelSize {
+		return nil, fmt.Errorf("the kernel is larger than %s", HumanBytes(maxKernelSize))
+	}
+	return kernel, nil
+}
+
+// unwrapZboot returns the compressed kernel of an EFI zboot, the PE image decompressing it when booted by a firmware.
+// Its header is described in drivers/firmware/efi/libstub/zboot-header.S of Linux.
+func unwrapZboot(content []byte) (payload []byte, found bool, err error) {
+	if len(content) < 56 || string(content[0:2]) != "MZ" || string(content[4:8]) != "zimg" {
+		return nil, false, nil
+	}
+	offset := binary.LittleEndian.Uint32(content[8:])
+	size := binary.LittleEndian.Uint32(content[12:])
+	if uint64(offset)+uint64(size) > uint64(len(content)) {
+		return nil, true, fmt.Errorf("the zboot payload is out of the kernel")
+	}
+	return content[offset : offset+size], true, nil
+}
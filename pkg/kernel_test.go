@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+// newTestKernel returns a kernel with the header of arch
+func newTestKernel(arch string) []byte {
+	kernel := make([]byte, 4096)
+	copy(kernel, "MZ")
+	switch arch {
+	case "arm64":
+		copy(kernel[56:], "ARM\x64")
+	case "amd64":
+		binary.LittleEndian.PutUint16(kernel[0x1fe:], 0xaa55)
+		copy(kernel[0x202:], "HdrS")
+	}
+	copy(kernel[1024:], "Linux version")
+	return kernel
+}
+
+// newTestZboot wraps the compressed kernel in an EFI zboot, followed by the size of the kernel
+func newTestZboot(compressed []byte) []byte {
+	zboot := make([]byte, 256)
+	copy(zboot, "MZ")
+	copy(zboot[4:], "zimg")
+	binary.LittleEndian.PutUint32(zboot[8:], uint32(len(zboot)))
+	binary.LittleEndian.PutUint32(zboot[12:], uint32(len(compressed)))
+	copy(zboot[24:], "zstd")
+	return append(append(zboot, compressed...), 0, 0, 0x10, 0)
+}
+
+func TestPrepareKernel(t *testing.T) {
+	newTestMachine(t, nil)
+	kernel := newTestKernel("arm64")
+	compress := func(newWriter func(io.Writer) (io.WriteCloser, error), content []byte) []byte {
+		var buffer bytes.Buffer
+		writer, err := newWriter(&buffer)
+		assert.NoError(t, err)
+		writer.Write(content)
+		assert.NoError(t, writer.Close())
+		return buffer.Bytes()
+	}
+	newGzipWriter := func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil }
+	gzipped := compress(newGzipWriter, kernel)
+	zstded := compress(func(w io.Writer) (io.WriteCloser, error) { return zstd.NewWriter(w) }, kernel)
+	xzipped := compress(func(w io.Writer) (io.WriteCloser, error) { return xz.NewWriter(w) }, kernel)
+	lz4ed := compress(func(w io.Writer) (io.WriteCloser, error) {
+		writer := lz4.NewWriter(w)
+		return writer, writer.Apply(lz4.LegacyOption(true))
+	}, kernel)
+
+	for _, test := range []struct {
+		name      string
+		published []byte
+	}{
+		{"an Image", kernel},
+		{"a gzipped Image followed by padding", append(append([]byte{}, gzipped...), make([]byte, 512)...)},
+		{"a zstd Image", zstded},
+		{"an xz Image", xzipped},
+		{"an lz4 Image", lz4ed},
+		{"a zboot", newTestZboot(zstded)},
+	} {
+		test := test
+		t.Run("should prepare "+test.name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "vmlinuz")
+			assert.NoError(t, os.WriteFile(src, test.published, 0644))
+
+			path, err := prepareKernel(src, "arm64")
+			assert.NoError(t, err)
+			assert.Equal(t, baseKernelDirectory(), filepath.Dir(path))
+			prepared, _ := os.ReadFile(path)
+			assert.Equal(t, kernel, prepared)
+		})
+	}
+
+	t.Run("should reuse the kernel prepared from the same file", func(t *testing.T) {
+		src := filepath.Join(t.TempDir(), "vmlinuz")
+		assert.NoError(t, os.WriteFile(src, gzipped, 0644))
+		path, err := prepareKernel(src, "arm64")
+		assert.NoError(t, err)
+		assert.NoError(t, os.WriteFile(path, []byte("cached"), 0644))
+
+		cached, err := prepareKernel(src, "arm64")
+		assert.NoError(t, err)
+		assert.Equal(t, path, cached)
+		content, _ := os.ReadFile(cached)
+		assert.Equal(t, "cached", string(content))
+	})
+
+	t.Run("should keep an x86_64 bzImage", func(t *testing.T) {
+		src := filepath.Join(t.TempDir(), "vmlinuz")
+		assert.NoError(t, os.WriteFile(src, newTestKernel("amd64"), 0644))
+
+		_, err := prepareKernel(src, "amd64")
+		assert.NoError(t, err)
+	})
+
+	for _, test := range []struct {
+		name      string
+		published []byte
+	}{
+		{"a kernel of another architecture", newTestKernel("amd64")},
+		{"an unknown format", []byte("#!/bin/sh\necho not a kernel\n")},
+		{"a compressed file which isn't a kernel", compress(newGzipWriter, []byte("initrd"))},
+		{"a zboot with a payload out of the file", newTestZboot(zstded)[:300]},
+	} {
+		test := test
+		t.Run("should refuse "+test.name, func(t *testing.T) {
+			src := filepath.Join(t.TempDir(), "vmlinuz")
+			assert.NoError(t, os.WriteFile(src, test.published, 0644))
+
+			_, err := prepareKernel(src, "arm64")
+			assert.Error(t, err)
+		})
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/Code-Hex/vz"
 	"github.com/efortin/machina/utils"
 	"github.com/hpcloud/tail"
 	"github.com/mitchellh/go-ps"
@@ -13,7 +12,6 @@ import (
 	"golang.org/x/sys/unix"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"os/signal"
 	"strconv"
@@ -21,11 +19,9 @@ import (
 	"syscall"
 	"time"
 )
-import "C"
 
 const (
 	default_disk_size = 15 * 1024 * 1024 * 1024
-	default_mem_size  = 2 * 1024 * 1024 * 1024
 	max_mem_size      = 8 * 1024 * 1024 * 1024
 	pidFileName       = "vmz.pid"
 	infoFileName      = "spec.json"
@@ -36,18 +32,35 @@ const (
 	Machine_state_stop    = "stopped"
 	Machine_state_error   = "unknown"
 
-	TimeoutStart = 5 * time.Second
+	TimeoutStart = 15 * time.Second
 )
 
 type MachineSpec struct {
 	Cpu uint   `json:"cpu"`
 	Ram uint64 `json:"memory"`
+	// Disk is the size of the root disk, default_disk_size when zero
+	Disk  uint64   `json:"disk,omitempty"`
+	Ports []string `json:"ports,omitempty"`
+	// DataDisks are attached after the root disk and the seed image, in this order
+	DataDisks []DataDisk `json:"data_disks,omitempty"`
+	// AutoForward forwards the ports opened in the guest, it's disabled when nil
+	AutoForward *AutoForward `json:"auto_forward,omitempty"`
+	// CloudInit is a cloud-init user-data document merged into the generated one
+	CloudInit string            `json:"cloud_init,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
 }
 
 type Machine struct {
-	Name         string              `json:"name"`
-	Distribution *UbuntuDistribution `json:"distribution"`
-	Spec         MachineSpec         `json:"specs"`
+	Name         string       `json:"name"`
+	Distribution Distribution `json:"distribution"`
+	Spec         MachineSpec  `json:"specs"`
+	// Driver overrides the DefaultDriver, mainly for tests
+	Driver Driver `json:"-"`
+
+	// forwarder serves the port forwards while the daemon runs
+	forwarder *portForwarder
+	// diskLocks are the shared disks the daemon writes, locked while it runs
+	diskLocks []*os.File
 }
 
 func (d *Machine) PidFilePath() string {
@@ -115,44 +128,25 @@ func (d *Machine) findVfkitProcess() (ps.Process, string, error) {
 	return p, Machine_state_running, nil
 }
 
-// Stop stops a host forcefully
-func (d *Machine) Stop() {
-
-	//ip, err := d.IpAddress()
-	/*if err == nil {
-		client, session, err := connectToHost("root", ip+":22")
-		// Could not connect
-		if err != nil {
-			d.sendSignal()
-			return
+// Delete removes every file of the machine: its directory with the disk and the state,
+// and the console logs. An active machine must be stopped first.
+func (m *Machine) Delete() error {
+	if m.IsActive() {
+		return fmt.Errorf("machine %s is %s, stop it first", m.Name, m.State())
+	}
+	// the input log is left by the primary boot of the machines provisioned from the initramfs
+	for _, path := range []string{m.OutputLogPath(), m.inputLogPath()} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
 		}
-		session.Run("poweroff")
-		session.Close()
-		client.Close()
-		utils.Logger.Info("Sleeping")
 	}
-	time.Sleep(10 * time.Second)*/
-	d.sendSignal()
-
+	return os.RemoveAll(MachineDirectory(m.Name))
 }
 
 func (m *Machine) cleanBeforeExit() {
 	os.Remove(m.PidFilePath())
-}
-
-func (m *Machine) sendSignal() {
-	psProc, machinestate, err := m.findVfkitProcess()
-	if machinestate != Machine_state_running {
-		return
-	}
-	utils.Logger.Info("try to kill", psProc.Pid())
-	proc, err := os.FindProcess(psProc.Pid())
-	if err == nil {
-		proc.Kill()
-	} else {
-		utils.Logger.Info("Error during kill", err)
-	}
-	return
+	os.Remove(m.ControlSocketPath())
+	m.unlockDataDisks()
 }
 
 // IpAddress Return VM ip address if already available
@@ -187,287 +181,172 @@ func (m *Machine) BaseDirectory() string {
 
 func (m *Machine) InitRdDirectory() (path string) {
 	path = fmt.Sprintf("%s/%s", m.BaseDirectory(), "initrd")
-	err := m.Distribution.cloneIfNotExist(m.Distribution.InitRdPath(), path)
+	err := cloneIfNotExist(m.Distribution.InitRd().Path, path)
 	if err != nil {
 		utils.Logger.Fatal(err)
 	}
 	return
 }
 
-func (m *Machine) KernelDirectory() (path string) {
+// KernelDirectory returns the kernel of the machine, prepared from the one of the distribution at its first start
+func (m *Machine) KernelDirectory() (path string, err error) {
 	path = fmt.Sprintf("%s/%s", m.BaseDirectory(), "vmlinuz")
-	err := m.Distribution.cloneIfNotExist(m.Distribution.KernelPath(), path)
+	if _, err = os.Stat(path); err == nil {
+		return path, nil
+	}
+	prepared, err := prepareKernel(m.Distribution.Kernel().Path, m.Distribution.Arch())
 	if err != nil {
-		utils.Logger.Fatal(err)
+		return utils.Empty, err
 	}
-	return
+	return path, cloneFile(prepared, path)
 }
 
 func (m *Machine) RootDirectory() (path string, err error) {
-	path = fmt.Sprintf("%s/%s", m.BaseDirectory(), "root.img")
-	err = m.Distribution.cloneIfNotExist(m.Distribution.ImagePath(), path)
+	path = fmt.Sprintf("%s/%s", m.BaseDirectory(), rootDiskFileName)
+	err = cloneIfNotExist(m.Distribution.Image().Path, path)
 	if err != nil {
 		return
 	}
 	disk, err := os.Stat(path)
+	if err != nil {
+		return
+	}
 
-	if default_disk_size > disk.Size() {
-		utils.Logger.Info("Resizing disk", disk.Size(), "to", default_disk_size)
-		os.Truncate(path, default_disk_size)
+	if size := int64(m.DiskSize()); size > disk.Size() {
+		utils.Logger.Info("Resizing disk", disk.Size(), "to", size)
+		err = os.Truncate(path, size)
 	}
 
 	return
 }
 
-func (m *Machine) ExportMachineSpecification() {
-	specContent, _ := json.MarshalIndent(m, "", "\t")
-	_ = ioutil.WriteFile(m.InfoFilePath(), specContent, 0644)
-}
-
-func (m *Machine) hasAlreadyBeenConfigured() bool {
-	// Find something else like check config or ip
-	//_, err := os.Stat(m.InfoFilePath())
-	return false
+// DiskSize is the size of the root disk of the spec
+func (m *Machine) DiskSize() uint64 {
+	if m.Spec.Disk == 0 {
+		return default_disk_size
+	}
+	return m.Spec.Disk
 }
 
-func (m *Machine) Run() {
-	var err error
-	switch m.State() {
-	case Machine_state_running:
-		utils.Logger.Info("Machine", m.Name, "has already been start by another process...")
-		os.Exit(1)
-	default:
-
-		if !m.hasAlreadyBeenConfigured() {
-			m.launchPrimaryBoot()
-		}
-		if err == nil {
-			m.launch()
+// MarshalJSON records the kind of the distribution along with it
+func (m *Machine) MarshalJSON() ([]byte, error) {
+	type machine Machine
+	spec := struct {
+		*machine
+		Distribution json.RawMessage `json:"distribution"`
+	}{machine: (*machine)(m)}
+	if m.Distribution != nil {
+		distribution, err := marshalDistribution(m.Distribution)
+		if err != nil {
+			return nil, err
 		}
+		spec.Distribution = distribution
 	}
+	return json.Marshal(spec)
 }
 
-func (m *Machine) State() string {
-	_, state, _ := m.findVfkitProcess()
-	return state
-}
-
-func (m *Machine) launch() {
-
-	kernelCommandLineArguments := []string{"console=hvc0", "root=/dev/vda"}
-
-	bootLoader := vz.NewLinuxBootLoader(
-		m.KernelDirectory(),
-		vz.WithCommandLine(strings.Join(kernelCommandLineArguments, " ")),
-		vz.WithInitrd(m.InitRdDirectory()),
-	)
-
-	config := vz.NewVirtualMachineConfiguration(
-		bootLoader,
-		m.Spec.Cpu,
-		m.Spec.Ram,
-	)
-
-	// console
-	serialPortAttachment, err := vz.NewFileSerialPortAttachment(m.OutputLogPath(), true)
+// UnmarshalJSON decodes the distribution according to its kind, see unmarshalDistribution
+func (m *Machine) UnmarshalJSON(content []byte) error {
+	type machine Machine
+	spec := struct {
+		*machine
+		Distribution json.RawMessage `json:"distribution"`
+	}{machine: (*machine)(m)}
+	if err := json.Unmarshal(content, &spec); err != nil {
+		return err
+	}
+	distribution, err := unmarshalDistribution(spec.Distribution)
 	if err != nil {
-		utils.Logger.Errorf("Error during serial port attachment (file: %s): %v", m.OutputLogPath(), err)
-		os.Exit(1)
+		return err
 	}
-	consoleConfig := vz.NewVirtioConsoleDeviceSerialPortConfiguration(serialPortAttachment)
-	config.SetSerialPortsVirtualMachineConfiguration([]*vz.VirtioConsoleDeviceSerialPortConfiguration{
-		consoleConfig,
-	})
-
-	// network
-	natAttachment := vz.NewNATNetworkDeviceAttachment()
-	networkConfig := vz.NewVirtioNetworkDeviceConfiguration(natAttachment)
-
-	mac, err := net.ParseMAC(GenerateAlmostUniqueMac(m.Name))
-	networkConfig.SetMACAddress(vz.NewMACAddress(mac))
-	config.SetNetworkDevicesVirtualMachineConfiguration([]*vz.VirtioNetworkDeviceConfiguration{
-		networkConfig,
-	})
-
-	// entropy
-	entropyConfig := vz.NewVirtioEntropyDeviceConfiguration()
-	config.SetEntropyDevicesVirtualMachineConfiguration([]*vz.VirtioEntropyDeviceConfiguration{
-		entropyConfig,
-	})
+	m.Distribution = distribution
+	return nil
+}
 
-	diskPath, err := m.RootDirectory()
+func (m *Machine) ExportMachineSpecification() error {
+	specContent, err := json.MarshalIndent(m, "", "\t")
 	if err != nil {
-		return
+		return err
 	}
-	diskImageAttachment, err := vz.NewDiskImageStorageDeviceAttachment(
-		diskPath,
-		false,
-	)
+	return ioutil.WriteFile(m.InfoFilePath(), specContent, 0644)
+}
 
+func (m *Machine) Run() error {
+	status, err := m.Status()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	storageDeviceConfig := vz.NewVirtioBlockDeviceConfiguration(diskImageAttachment)
-	config.SetStorageDevicesVirtualMachineConfiguration([]vz.StorageDeviceConfiguration{
-		storageDeviceConfig,
-	})
-
-	// traditional memory balloon device which allows for managing guest memory. (optional)
-	/*config.SetMemoryBalloonDevicesVirtualMachineConfiguration([]vz.MemoryBalloonDeviceConfiguration{
-		vz.NewVirtioTraditionalMemoryBalloonDeviceConfiguration(),
-	})*/
-
-	//config.SetSocketDevicesVirtualMachineConfiguration([]vz.SocketDeviceConfiguration{
-	//	vz.NewVirtioSocketDeviceConfiguration(),
-	//})
-	validated, err := config.Validate()
-	if !validated || err != nil {
-		log.Fatal("validation failed", err)
+	if status.State != Machine_state_downloading && processStates.Contains(status.State) && status.Pid != os.Getpid() {
+		return fmt.Errorf("machine %s is already %s in process %d", m.Name, status.State, status.Pid)
 	}
 
-	vm := vz.NewVirtualMachine(config)
-
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGKILL)
+	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signalCh)
 
-	errCh := make(chan error, 1)
-
-	vm.Start(func(err error) {
-		if err != nil {
-			errCh <- err
-		} else {
-			_ = os.WriteFile(m.PidFilePath(), []byte(strconv.Itoa(os.Getpid())), 0600)
+	if !m.hasAlreadyBeenConfigured() {
+		if err := m.provision(); err != nil {
+			return m.Fail(err)
 		}
-	})
-
-	err = m.waitForVMState(vm, vz.VirtualMachineStateRunning)
-	if err != nil {
-		utils.Logger.Error(err)
-		m.cleanBeforeExit()
-		os.Exit(1)
 	}
-	m.ExportMachineSpecification()
-	m.waitTermination(vm, signalCh)
-
-}
-
-func (m *Machine) waitTermination(vm *vz.VirtualMachine, signalCh chan os.Signal) {
-	for {
-		select {
-		case sig := <-signalCh:
-			utils.Logger.Info("Receiving a termination signal", sig, "... Bye")
-			result, err := vm.RequestStop()
-			if err != nil {
-				utils.Logger.Warn("The machine", m.Name, "was not stop properly: ", err)
-			} else if result {
-				utils.Logger.Warn("The machine", m.Name, "was stopped successfully")
-			} else {
-				utils.Logger.Info("The machine", m.Name, "was not stopped")
-			}
-			m.cleanBeforeExit()
-			os.Exit(0)
-		}
+	if err := m.launch(signalCh); err != nil {
+		return m.Fail(err)
 	}
+	return nil
 }
 
-func (m *Machine) launchPrimaryBoot() {
-
-	err := m.Distribution.DownloadDistro()
+// State returns the lifecycle state of the machine, see Status
+func (m *Machine) State() string {
+	status, err := m.Status()
 	if err != nil {
-		utils.Logger.Fatal(err)
+		utils.Logger.Debug(err)
+		return Machine_state_error
 	}
+	return status.State
+}
 
+// vmConfig builds the hypervisor configuration, the root disk is /dev/vda, the seed image /dev/vdb
+// and the data disks follow from /dev/vdc
+func (m *Machine) vmConfig(cpu uint, memory uint64, kernelCommandLineArguments ...string) (*VMConfig, error) {
+	diskPath, err := m.RootDirectory()
 	if err != nil {
-		utils.Logger.Error(err)
+		return nil, err
 	}
-
-	kernelCommandLineArguments := []string{"console=hvc0"}
-
-	bootLoader := vz.NewLinuxBootLoader(
-		m.KernelDirectory(),
-		vz.WithCommandLine(strings.Join(kernelCommandLineArguments, " ")),
-		vz.WithInitrd(m.InitRdDirectory()),
-	)
-
-	log.Println("bootLoader:", bootLoader)
-
-	config := vz.NewVirtualMachineConfiguration(
-		bootLoader,
-		Default_cpu_number,
-		default_mem_size,
-	)
-
-	os.Remove(m.inputLogPath())
-	os.Remove(m.OutputLogPath())
-	input, err := os.OpenFile(m.inputLogPath(), os.O_RDONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	dataDisks, err := m.dataDiskConfigs()
 	if err != nil {
-		utils.Logger.Error("Error during openning %s file: %v", m.inputLogPath(), err)
-		os.Exit(1)
+		return nil, err
 	}
-	defer input.Close()
-	output, err := os.OpenFile(m.OutputLogPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	kernel, err := m.KernelDirectory()
 	if err != nil {
-		utils.Logger.Error("Error during openning %s file: %v", output, err)
-		os.Exit(1)
-	}
-	defer input.Close()
-	defer output.Close()
-	serialPortAttachment := vz.NewFileHandleSerialPortAttachment(input, output)
-	consoleConfig := vz.NewVirtioConsoleDeviceSerialPortConfiguration(serialPortAttachment)
-	config.SetSerialPortsVirtualMachineConfiguration([]*vz.VirtioConsoleDeviceSerialPortConfiguration{
-		consoleConfig,
-	})
-
-	// network
-	natAttachment := vz.NewNATNetworkDeviceAttachment()
-	networkConfig := vz.NewVirtioNetworkDeviceConfiguration(natAttachment)
-
-	mac, err := net.ParseMAC(GenerateAlmostUniqueMac(m.Name))
-	networkConfig.SetMACAddress(vz.NewMACAddress(mac))
-	config.SetNetworkDevicesVirtualMachineConfiguration([]*vz.VirtioNetworkDeviceConfiguration{
-		networkConfig,
-	})
-
-	// entropy
-	entropyConfig := vz.NewVirtioEntropyDeviceConfiguration()
-	config.SetEntropyDevicesVirtualMachineConfiguration([]*vz.VirtioEntropyDeviceConfiguration{
-		entropyConfig,
-	})
+		return nil, err
+	}
+	if err = m.writeSeed(); err != nil {
+		return nil, fmt.Errorf("cannot write the cloud-init seed of machine %s: %v", m.Name, err)
+	}
+	return &VMConfig{
+		Kernel:      kernel,
+		Initrd:      m.InitRdDirectory(),
+		CommandLine: kernelCommandLineArguments,
+		Cpu:         cpu,
+		Memory:      memory,
+		MacAddress:  GenerateAlmostUniqueMac(m.Name),
+		Console:     ConsoleConfig{LogPath: m.OutputLogPath()},
+		Disks:       append([]DiskConfig{{Path: diskPath}, {Path: m.SeedPath(), ReadOnly: true}}, dataDisks...),
+	}, nil
+}
 
-	diskPath, err := m.RootDirectory()
+// start creates the virtual machine with the driver and waits until it runs
+func (m *Machine) start(config *VMConfig) (VM, error) {
+	driver, err := m.driver()
 	if err != nil {
-		return
+		return nil, err
 	}
-	diskImageAttachment, err := vz.NewDiskImageStorageDeviceAttachment(
-		diskPath,
-		false,
-	)
-
+	vm, err := driver.Create(config)
 	if err != nil {
-		log.Fatal(err)
-	}
-	storageDeviceConfig := vz.NewVirtioBlockDeviceConfiguration(diskImageAttachment)
-	config.SetStorageDevicesVirtualMachineConfiguration([]vz.StorageDeviceConfiguration{
-		storageDeviceConfig,
-	})
-
-	// traditional memory balloon device which allows for managing guest memory. (optional)
-	config.SetMemoryBalloonDevicesVirtualMachineConfiguration([]vz.MemoryBalloonDeviceConfiguration{
-		vz.NewVirtioTraditionalMemoryBalloonDeviceConfiguration(),
-	})
-
-	validated, err := config.Validate()
-	if !validated || err != nil {
-		log.Fatal("validation failed", err)
+		return nil, err
 	}
 
-	vm := vz.NewVirtualMachine(config)
-
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGTERM, syscall.SIGKILL)
-
 	errCh := make(chan error, 1)
-
 	vm.Start(func(err error) {
 		if err != nil {
 			errCh <- err
@@ -475,91 +354,158 @@ func (m *Machine) launchPrimaryBoot() {
 			_ = os.WriteFile(m.PidFilePath(), []byte(strconv.Itoa(os.Getpid())), 0600)
 		}
 	})
-
-	err = m.waitForVMState(vm, vz.VirtualMachineStateRunning)
-
-	if err != nil {
-		utils.Logger.Error(err)
-		os.Exit(1)
+	// the driver reports a failure asynchronously, it's awaited along with the running state
+	if err = m.waitForVMState(vm, VMStateRunning, TimeoutStart, errCh); err != nil {
+		return nil, err
 	}
-	m.prepareFirstBoot()
-	m.ExportMachineSpecification()
-	err = m.waitForVMState(vm, vz.VirtualMachineStateStopped)
-
+	return vm, nil
 }
 
-func (m *Machine) prepareFirstBoot() {
-	input, err := os.OpenFile(m.inputLogPath(), os.O_WRONLY|os.O_TRUNC, 0666)
-	defer input.Close()
-	//homedir, _ := os.UserHomeDir()
-	//sshkey, err := os.ReadFile(fmt.Sprint(homedir, "/.ssh/id_rsa.pub"))
-	key, err := GetMachinaPublicKey()
+func (m *Machine) launch(signalCh <-chan os.Signal) error {
+	if err := m.Transition(Machine_state_starting); err != nil {
+		return err
+	}
+	config, err := m.vmConfig(m.Spec.Cpu, m.Spec.Ram, m.Distribution.Layout().CommandLine...)
 	if err != nil {
-		utils.Logger.Fatal("No machina ssh key found, please use `machina init`")
-		os.Exit(1)
+		return err
 	}
-
-	cloudinitContent := fmt.Sprintf(cloudinit, key)
-
-	type Expect struct {
-		expect  string
-		command string
+	var failedCh <-chan error
+	if !m.hasAlreadyBeenConfigured() {
+		boot, err := m.watchFirstBoot()
+		if err != nil {
+			return err
+		}
+		defer boot.close()
+		config.Console = boot.console
+		failedCh = boot.failed
 	}
 
-	expectations := []Expect{
-		{"Enter 'help' for a list of built-in commands.", utils.Empty},
-		{"(initramfs)", "mkdir /mnt"},
-		{"(initramfs)", "mount /dev/vda /mnt"},
-		{"(initramfs)", "cat << EOF > /mnt/etc/cloud/cloud.cfg.d/99_user.cfg\r" + cloudinitContent + "\rEOF"},
-		{"(initramfs)", "poweroff"},
+	vm, err := m.start(config)
+	if err != nil {
+		m.cleanBeforeExit()
+		return err
+	}
+	if err = m.Transition(Machine_state_running); err != nil {
+		m.cleanBeforeExit()
+		return err
 	}
+	// the forwards saved while the machine started are served too
+	if err = m.readSavedForwards(); err != nil {
+		utils.Logger.Debug(err)
+	}
+	m.ExportMachineSpecification()
+	m.forwarder = m.startForwards()
+	defer m.forwarder.close()
 
-	t, err := tail.TailFile(m.OutputLogPath(), tail.Config{Follow: true})
-	expectIndex := 0
-	skipNextLine := false
-	for line := range t.Lines {
-		if expectIndex == len(expectations) {
-			t.Stop()
-		}
-		if skipNextLine {
-			skipNextLine = false
-		} else {
-			utils.Logger.Debug("\t" + line.Text)
+	listener, controlCh, err := m.listenControl()
+	if err != nil {
+		utils.Logger.Warnf("the machine %s cannot be controlled, its control socket failed: %v", m.Name, err)
+	} else {
+		defer listener.Close()
+	}
+	return m.waitTermination(vm, signalCh, controlCh, failedCh)
+}
 
-			if strings.Contains(line.Text, expectations[expectIndex].expect) {
-				skipNextLine = true
-				input.WriteString(expectations[expectIndex].command + "\r\n")
-				expectIndex++
+// waitTermination blocks until the guest stops while serving the control requests.
+// A first termination signal asks the guest to stop, a second one leaves without waiting.
+// It returns an error when the machine ended in error state or its first boot failed.
+func (m *Machine) waitTermination(vm VM, signalCh <-chan os.Signal, controlCh <-chan *controlCall, failedCh <-chan error) error {
+	defer m.cleanBeforeExit()
+	stopRequested := false
+	for {
+		select {
+		case sig := <-signalCh:
+			if stopRequested {
+				utils.Logger.Warn("Receiving", sig, "again, leaving without waiting for the guest")
+				return m.Transition(Machine_state_stop)
+			}
+			utils.Logger.Info("Receiving a termination signal", sig, ", asking the guest to stop")
+			stopRequested = true
+			if _, err := m.requestStop(vm); err != nil {
+				return err
 			}
+		case call := <-controlCh:
+			response, exit := m.control(vm, call.request)
+			call.reply <- response
+			if exit {
+				utils.Logger.Warn("The machine", m.Name, "is forced to stop")
+				return m.Transition(Machine_state_stop)
+			}
+			stopRequested = stopRequested || call.request.Command == ControlRequestStop
+		case err := <-failedCh:
+			return err
+		case state := <-vm.StateChangedNotify():
+			switch state {
+			case VMStateStopped:
+				utils.Logger.Info("The machine", m.Name, "has been stopped by the guest")
+				return m.Transition(Machine_state_stop)
+			case VMStateError:
+				return fmt.Errorf("the machine %s has encountered an internal error", m.Name)
+			}
+			continue
+		}
+		if vm.State() == VMStateStopped {
+			return m.Transition(Machine_state_stop)
 		}
-
 	}
+}
 
+// provision downloads the distribution of a new machine, cloud-init configures the guest
+// from the seed image during its first boot, see watchFirstBoot.
+func (m *Machine) provision() error {
+	err := m.Transition(Machine_state_downloading)
+	if err != nil {
+		return err
+	}
+	if err = DownloadDistro(m.Distribution); err != nil {
+		return err
+	}
+	return m.Transition(Machine_state_provisioning)
 }
 
-func (machine *Machine) waitForVMState(vm *vz.VirtualMachine, state vz.VirtualMachineState) error {
+// waitForVMState waits until the machine reaches the state, it fails with the error received from errCh
+func (machine *Machine) waitForVMState(vm VM, state VMState, timeout time.Duration, errCh <-chan error) error {
+	if vm.State() == state {
+		return nil
+	}
 	for {
 		select {
+		case err := <-errCh:
+			return fmt.Errorf("machine %s failed to start: %v", machine.Name, err)
 		case newState := <-vm.StateChangedNotify():
 			if newState == state {
 				utils.Logger.Infof("Machine %s reached state %v", machine.Name, state)
 				return nil
 			}
-		case <-time.After(15 * time.Second):
-			return fmt.Errorf("Machine %s failed to reached state %v after %v", machine.Name, state, TimeoutStart)
+		case <-time.After(timeout):
+			return fmt.Errorf("Machine %s failed to reached state %v after %v", machine.Name, state, timeout)
 		}
 	}
 }
 
 func connectToHost(user, host string) (*ssh.Client, *ssh.Session, error) {
+	client, err := dialHost(user, host)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, nil, err
+	}
+
+	return client, session, nil
+}
+
+func dialHost(user, host string) (*ssh.Client, error) {
 	pemBytes, err := ioutil.ReadFile(getMachinaPrivateKeyPath())
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("no machina ssh key found, please use `machina init`: %v", err)
 	}
 	signer, err := ssh.ParsePrivateKey(pemBytes)
 	if err != nil {
-		log.Fatalf("parse key failed:%v", err)
+		return nil, fmt.Errorf("parse key failed: %v", err)
 	}
 
 	sshConfig := &ssh.ClientConfig{
@@ -571,61 +517,25 @@ func connectToHost(user, host string) (*ssh.Client, *ssh.Session, error) {
 		Timeout:         10 * time.Second,
 	}
 
-	sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
-
-	utils.Logger.Infof("Trying to connect to %s", host)
-
-	client, err := ssh.Dial("tcp", host, sshConfig)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	utils.Logger.Infof("Trying to connect to %s", host)
+	utils.Logger.Debugf("Trying to connect to %s", host)
 
-	session, err := client.NewSession()
-	if err != nil {
-		client.Close()
-		return nil, nil, err
-	}
-
-	return client, session, nil
+	return ssh.Dial("tcp", host, sshConfig)
 }
 
-const cloudinit = `
-#cloud-config
-disable_root: 0
-
-users:
-  - name: root
-    sudo: ['ALL=(ALL) NOPASSWD:ALL']
-    lock_passwd: false
-    ssh-authorized-keys: 
-      - %s
-
-power_state:
-    delay: now
-    mode: reboot
-    message: Rebooting machine
-	condition: true
-
-runcmd:
-- [ cp, /usr/bin/true, /usr/sbin/flash-kernel ]
-- [ apt, remove, --purge, irqbalance, -y ]
-
-
-
-`
-
-func setRawMode(f *os.File) {
+// setRawMode puts the terminal in raw mode and returns its previous settings
+func setRawMode(f *os.File) (*unix.Termios, error) {
 	var attr unix.Termios
 
 	// Get settings for terminal
-	termios.Tcgetattr(f.Fd(), &attr)
+	if err := termios.Tcgetattr(f.Fd(), &attr); err != nil {
+		return nil, err
+	}
+	previous := attr
 
 	// Put stdin into raw mode, disabling local echo, input canonicalization,
-	// and CR-NL mapping.
-	attr.Iflag &^= syscall.ICRNL
-	attr.Lflag &^= syscall.ICANON | syscall.ECHO
+	// signals and CR-NL mapping, every key stroke goes to the guest.
+	attr.Iflag &^= syscall.ICRNL | syscall.IXON
+	attr.Lflag &^= syscall.ICANON | syscall.ECHO | syscall.ISIG | syscall.IEXTEN
 
 	// Set minimum characters when reading = 1 char
 	attr.Cc[syscall.VMIN] = 1
@@ -634,5 +544,16 @@ func setRawMode(f *os.File) {
 	attr.Cc[syscall.VTIME] = 0
 
 	// reflects the changed settings
-	termios.Tcsetattr(f.Fd(), termios.TCSANOW, &attr)
+	return &previous, termios.Tcsetattr(f.Fd(), termios.TCSANOW, &attr)
+}
+
+// restoreMode restores the terminal settings saved by setRawMode
+func restoreMode(f *os.File, attr *unix.Termios) error {
+	return termios.Tcsetattr(f.Fd(), termios.TCSANOW, attr)
+}
+
+// IsTerminal returns true when the file is a terminal
+func IsTerminal(f *os.File) bool {
+	var attr unix.Termios
+	return termios.Tcgetattr(f.Fd(), &attr) == nil
 }
@@ -0,0 +1,349 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setTestEnv sets the variable for the duration of the test
+func setTestEnv(t *testing.T, key, value string) {
+	previous, found := os.LookupEnv(key)
+	os.Setenv(key, value)
+	t.Cleanup(func() {
+		if found {
+			os.Setenv(key, previous)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+// newTestMachine creates a machine in a temporary working directory with a fake driver
+// and an already downloaded distribution.
+func newTestMachine(t *testing.T, driver Driver) *Machine {
+	dir := t.TempDir()
+	// an empty TMPDIR makes the console files land in the working directory
+	for key, value := range map[string]string{"VMCTLDIR": dir, "TMPDIR": ""} {
+		setTestEnv(t, key, value)
+	}
+
+	distribution, _ := NewDistribution("ubuntu", "focal", "arm64")
+	DirectoryCreateIfAbsent(distribution.ImageDirectory())
+	for _, path := range []string{distribution.InitRd().Path, distribution.Image().Path} {
+		assert.NoError(t, os.WriteFile(path, []byte(path), 0644))
+	}
+	assert.NoError(t, os.WriteFile(distribution.Kernel().Path, newTestKernel("arm64"), 0644))
+	assert.NoError(t, GenerateMachinaKeypair())
+
+	return &Machine{
+		Name:         "test",
+		Distribution: distribution,
+		Spec:         MachineSpec{Cpu: 2, Ram: 2 * GB},
+		Driver:       driver,
+	}
+}
+
+// moveTo walks the machine through the given lifecycle states
+func moveTo(t *testing.T, m *Machine, states ...string) {
+	m.BaseDirectory()
+	assert.NoError(t, m.InitStatus())
+	for _, state := range states {
+		assert.NoError(t, m.Transition(state))
+	}
+}
+
+func TestMachine_waitForVMState(t *testing.T) {
+	t.Run("should return once the state is reached", func(t *testing.T) {
+		vm, _ := NewFakeDriver().Create(&VMConfig{})
+		go func() {
+			vm.(*FakeVM).SetState(VMStateStarting)
+			vm.(*FakeVM).SetState(VMStateRunning)
+		}()
+
+		assert.NoError(t, (&Machine{Name: "test"}).waitForVMState(vm, VMStateRunning, time.Second, nil))
+	})
+
+	t.Run("should return immediately when the machine is already in the state", func(t *testing.T) {
+		vm, _ := NewFakeDriver().Create(&VMConfig{})
+
+		assert.NoError(t, (&Machine{Name: "test"}).waitForVMState(vm, VMStateStopped, time.Millisecond, nil))
+	})
+
+	t.Run("should fail when the state isn't reached in time", func(t *testing.T) {
+		vm, _ := NewFakeDriver().Create(&VMConfig{})
+		vm.(*FakeVM).SetState(VMStateStarting)
+
+		assert.Error(t, (&Machine{Name: "test"}).waitForVMState(vm, VMStateRunning, 10*time.Millisecond, nil))
+	})
+}
+
+func TestMachine_waitTermination(t *testing.T) {
+	t.Run("should request the guest to stop on signal", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+		vm, _ := NewFakeDriver().Create(&VMConfig{})
+		vm.(*FakeVM).SetState(VMStateRunning)
+		<-vm.StateChangedNotify()
+		signalCh := make(chan os.Signal, 1)
+		signalCh <- syscall.SIGTERM
+
+		assert.NoError(t, m.waitTermination(vm, signalCh, nil, nil))
+		assert.Equal(t, 1, vm.(*FakeVM).StopRequests())
+		assert.Equal(t, VMStateStopped, vm.State())
+		assert.Equal(t, Machine_state_stop, m.State())
+	})
+
+	t.Run("should keep waiting when the guest ignores the stop request", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+		driver := NewFakeDriver()
+		driver.IgnoreStopRequest = true
+		vm, _ := driver.Create(&VMConfig{})
+		vm.(*FakeVM).SetState(VMStateRunning)
+		<-vm.StateChangedNotify()
+		signalCh := make(chan os.Signal, 1)
+		signalCh <- syscall.SIGTERM
+		go func() {
+			for vm.(*FakeVM).StopRequests() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+			vm.(*FakeVM).SetState(VMStateStopped)
+		}()
+
+		assert.NoError(t, m.waitTermination(vm, signalCh, nil, nil))
+		assert.Equal(t, 1, vm.(*FakeVM).StopRequests())
+		assert.Equal(t, Machine_state_stop, m.State())
+	})
+
+	t.Run("should leave on a second signal", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+		driver := NewFakeDriver()
+		driver.IgnoreStopRequest = true
+		vm, _ := driver.Create(&VMConfig{})
+		vm.(*FakeVM).SetState(VMStateRunning)
+		<-vm.StateChangedNotify()
+		signalCh := make(chan os.Signal, 2)
+		signalCh <- syscall.SIGTERM
+		signalCh <- syscall.SIGINT
+
+		assert.NoError(t, m.waitTermination(vm, signalCh, nil, nil))
+		assert.Equal(t, VMStateRunning, vm.State())
+		assert.Equal(t, Machine_state_stop, m.State())
+	})
+
+	t.Run("should return when the guest powers off", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+		vm, _ := NewFakeDriver().Create(&VMConfig{})
+		go vm.(*FakeVM).SetState(VMStateStopped)
+
+		assert.NoError(t, m.waitTermination(vm, make(chan os.Signal), nil, nil))
+		assert.Equal(t, 0, vm.(*FakeVM).StopRequests())
+	})
+
+	t.Run("should fail when the machine ends in error", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+		vm, _ := NewFakeDriver().Create(&VMConfig{})
+		go vm.(*FakeVM).SetState(VMStateError)
+
+		assert.Error(t, m.waitTermination(vm, make(chan os.Signal), nil, nil))
+		assert.Equal(t, Machine_state_running, m.State())
+	})
+}
+
+func TestMachine_launch(t *testing.T) {
+	t.Run("should configure the machine and clean the pid file on exit", func(t *testing.T) {
+		driver := NewFakeDriver()
+		driver.OnStart = FakeGuest
+		m := newTestMachine(t, driver)
+
+		assert.NoError(t, m.launch(make(chan os.Signal)))
+
+		vms := driver.VMs()
+		assert.Len(t, vms, 1)
+		config := vms[0].Config
+		assert.Equal(t, []string{"console=hvc0", "root=/dev/vda"}, config.CommandLine)
+		assert.Equal(t, uint(2), config.Cpu)
+		assert.Equal(t, uint64(2*GB), config.Memory)
+		assert.Equal(t, GenerateAlmostUniqueMac(m.Name), config.MacAddress)
+		assert.Equal(t, []DiskConfig{{Path: m.BaseDirectory() + "/root.img"}, {Path: m.SeedPath(), ReadOnly: true}}, config.Disks)
+		assert.FileExists(t, m.SeedPath())
+		assert.FileExists(t, m.InfoFilePath())
+		assert.NoFileExists(t, m.PidFilePath())
+		assert.Equal(t, Machine_state_stop, m.State())
+	})
+
+	t.Run("should keep the forwards saved while the machine starts", func(t *testing.T) {
+		driver := NewFakeDriver()
+		driver.OnStart = FakeGuest
+		m := newTestMachine(t, driver)
+		m.BaseDirectory()
+		saved := *m
+		saved.Spec.Ports = []string{PortForward{Host: freeTestPort(t), Guest: 80}.String()}
+		assert.NoError(t, saved.ExportMachineSpecification())
+
+		assert.NoError(t, m.launch(make(chan os.Signal)))
+
+		loaded, err := FromFileSpec(m.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, saved.Spec.Ports, loaded.Spec.Ports)
+	})
+
+	t.Run("should mark the machine provisioned once cloud-init finished", func(t *testing.T) {
+		driver := NewFakeDriver()
+		driver.OnStart = FakeGuest
+		m := newTestMachine(t, driver)
+
+		assert.NoError(t, m.launch(make(chan os.Signal)))
+
+		assert.NotNil(t, driver.VMs()[0].Config.Console.Output)
+		assert.True(t, m.hasAlreadyBeenConfigured())
+		console, _ := os.ReadFile(m.OutputLogPath())
+		assert.Contains(t, string(console), "Cloud-init v. 23.1 finished")
+	})
+
+	t.Run("should log the console of a provisioned machine", func(t *testing.T) {
+		driver := NewFakeDriver()
+		driver.OnStart = FakeGuest
+		m := newTestMachine(t, driver)
+		moveTo(t, m, Machine_state_downloading)
+		assert.NoError(t, m.markProvisioned())
+
+		assert.NoError(t, m.launch(make(chan os.Signal)))
+		assert.Equal(t, ConsoleConfig{LogPath: m.OutputLogPath()}, driver.VMs()[0].Config.Console)
+	})
+
+	t.Run("should not mark the machine provisioned when it stops before cloud-init finished", func(t *testing.T) {
+		driver := NewFakeDriver()
+		m := newTestMachine(t, driver)
+		driver.OnStart = func(vm *FakeVM) {
+			vm.SetState(VMStateStopped)
+		}
+
+		assert.NoError(t, m.launch(make(chan os.Signal)))
+		assert.False(t, m.hasAlreadyBeenConfigured())
+	})
+
+	t.Run("should keep the machine running when cloud-init outlasts the first boot timeout", func(t *testing.T) {
+		timeout := FirstBootTimeout
+		FirstBootTimeout = 20 * time.Millisecond
+		defer func() { FirstBootTimeout = timeout }()
+		driver := NewFakeDriver()
+		m := newTestMachine(t, driver)
+		driver.OnStart = func(vm *FakeVM) {
+			go func() {
+				time.Sleep(5 * FirstBootTimeout)
+				FakeGuest(vm)
+			}()
+		}
+
+		assert.NoError(t, m.launch(make(chan os.Signal)))
+		assert.True(t, m.hasAlreadyBeenConfigured())
+	})
+
+	t.Run("should fail on a kernel panic during the first boot", func(t *testing.T) {
+		driver := NewFakeDriver()
+		m := newTestMachine(t, driver)
+		driver.OnStart = func(vm *FakeVM) {
+			fmt.Fprintln(vm.Config.Console.Output, "Kernel panic - not syncing: VFS: Unable to mount root fs")
+		}
+
+		err := m.launch(make(chan os.Signal))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "Unable to mount root fs")
+		assert.False(t, m.hasAlreadyBeenConfigured())
+	})
+
+	t.Run("should report a start failure", func(t *testing.T) {
+		driver := NewFakeDriver()
+		driver.StartError = errors.New("no entitlement")
+		m := newTestMachine(t, driver)
+
+		assert.Error(t, m.launch(make(chan os.Signal)))
+		assert.NoFileExists(t, m.PidFilePath())
+	})
+
+	t.Run("should report a start failure of the hypervisor", func(t *testing.T) {
+		driver := NewFakeDriver()
+		driver.StartError = errors.New("no entitlement")
+		driver.AsyncStart = true
+		m := newTestMachine(t, driver)
+
+		err := m.launch(make(chan os.Signal))
+		assert.EqualError(t, err, "machine test failed to start: no entitlement")
+	})
+}
+
+func TestMachine_Run(t *testing.T) {
+	t.Run("should provision the machine then boot it", func(t *testing.T) {
+		driver := NewFakeDriver()
+		driver.OnStart = FakeGuest
+		m := newTestMachine(t, driver)
+
+		assert.NoError(t, m.Run())
+
+		vms := driver.VMs()
+		assert.Len(t, vms, 1)
+		assert.Equal(t, []string{"console=hvc0", "root=/dev/vda"}, vms[0].Config.CommandLine)
+		assert.Equal(t, VMStateStopped, vms[0].State())
+		assert.Equal(t, Machine_state_stop, m.State())
+		assert.True(t, m.hasAlreadyBeenConfigured())
+		assert.FileExists(t, m.SeedPath())
+		assert.FileExists(t, m.UserDataPath())
+	})
+
+	t.Run("should fail without driver", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		defaultDriver := DefaultDriver
+		DefaultDriver = nil
+		defer func() { DefaultDriver = defaultDriver }()
+
+		assert.ErrorIs(t, m.Run(), ErrNoDriver)
+		status, _ := m.Status()
+		assert.Equal(t, Machine_state_failed, status.State)
+		assert.Equal(t, ErrNoDriver.Error(), status.FailureReason)
+	})
+
+	t.Run("should skip the provisioning of a configured machine", func(t *testing.T) {
+		driver := NewFakeDriver()
+		driver.OnStart = FakeGuest
+		m := newTestMachine(t, driver)
+		moveTo(t, m, Machine_state_downloading)
+		assert.NoError(t, m.markProvisioned())
+
+		assert.NoError(t, m.Run())
+		assert.Len(t, driver.VMs(), 1)
+	})
+}
+
+func TestMachine_Delete(t *testing.T) {
+	t.Run("should remove the machine directory and its console logs", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running, Machine_state_stop)
+		for _, path := range []string{m.OutputLogPath(), m.inputLogPath()} {
+			assert.NoError(t, os.WriteFile(path, []byte("console"), 0644))
+		}
+
+		assert.NoError(t, m.Delete())
+		assert.NoDirExists(t, MachineDirectory(m.Name))
+		assert.NoFileExists(t, m.OutputLogPath())
+		assert.NoFileExists(t, m.inputLogPath())
+		assert.False(t, ListExistingMachines().Contains(m.Name))
+	})
+
+	t.Run("should refuse to delete an active machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+
+		assert.Error(t, m.Delete())
+		assert.DirExists(t, MachineDirectory(m.Name))
+	})
+}
@@ -1 +1,123 @@
 package internal
+
+import (
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"os"
+	"os/exec"
+)
+
+// Create initializes the directory and the lifecycle of a new machine,
+// downloads its distribution and saves its specification. Its cloud-init is validated first.
+func (m *Machine) Create() error {
+	if err := m.ValidateCloudInit(); err != nil {
+		return err
+	}
+	m.BaseDirectory()
+	if err := m.InitStatus(); err != nil {
+		return fmt.Errorf("cannot initialize the machine %s: %v", m.Name, err)
+	}
+	if err := m.Transition(Machine_state_downloading); err != nil {
+		return err
+	}
+	if err := DownloadDistro(m.Distribution); err != nil {
+		m.Fail(err)
+		return fmt.Errorf("cannot download the distribution %s %s: %v", m.Distribution.Kind(), m.Distribution.Release(), err)
+	}
+	if _, err := m.RootDirectory(); err != nil {
+		return m.Fail(err)
+	}
+	return m.ExportMachineSpecification()
+}
+
+// Spawn runs the daemon of the machine in the background, its output goes to process.log.
+// The machine is handed over to the daemon.
+func (m *Machine) Spawn() error {
+	output, err := os.Create(m.BaseDirectory() + "/process.log")
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	cwd, _ := os.Getwd()
+
+	cmd := exec.Command(os.Args[0], "daemon", "launch", "-n", m.Name)
+	cmd.Stderr = output
+	cmd.Stdin = nil
+	cmd.Stdout = output
+	cmd.Dir = cwd
+	if err = cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start the daemon of machine %s: %v", m.Name, err)
+	}
+	utils.Logger.Debug("the daemon of machine ", m.Name, " has pid ", cmd.Process.Pid)
+	// the machine is owned by the daemon once this process exits
+	if err = m.handOver(cmd.Process.Pid); err != nil {
+		return err
+	}
+	return cmd.Process.Release()
+}
+
+// Clone creates the machine name with a copy-on-write copy of the disks, the kernel and the initrd of m.
+// The copy gets its own MAC address and instance id, cloud-init then gives the guest a new identity at its first boot:
+// hostname, machine id and ssh host keys. The host ports forwarded by m aren't forwarded by the copy.
+func (m *Machine) Clone(name string) (clone *Machine, err error) {
+	if !machineNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid machine name %q, it must match %s", name, machineNamePattern)
+	}
+	if ListExistingMachines().Contains(name) {
+		return nil, fmt.Errorf("the machine %s already exists", name)
+	}
+	if _, err = os.Stat(m.rootDiskPath()); err != nil {
+		return nil, fmt.Errorf("machine %s has no disk yet: %v", m.Name, err)
+	}
+	status, err := m.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	clone = &Machine{Name: name, Distribution: m.Distribution, Spec: m.Spec, Driver: m.Driver}
+	clone.Spec.DataDisks = append([]DataDisk(nil), m.Spec.DataDisks...)
+	if len(clone.Spec.Ports) > 0 {
+		utils.Logger.Infof("The ports %v forwarded by machine %s aren't forwarded by machine %s", clone.Spec.Ports, m.Name, name)
+		clone.Spec.Ports = nil
+	}
+	dir := clone.BaseDirectory()
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+	if _, err = m.cloneDisk(clone.rootDiskPath()); err != nil {
+		return nil, err
+	}
+	// the disks of the machine are copied along, the shared ones are attached as is
+	for _, disk := range m.Spec.DataDisks {
+		if disk.Shared {
+			continue
+		}
+		if err = DirectoryCreateIfAbsent(clone.dataDisksDirectory()); err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+		if err = cloneFile(m.dataDiskPath(disk), clone.dataDiskPath(disk)); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range []string{"vmlinuz", "initrd"} {
+		src := fmt.Sprintf("%s/%s", MachineDirectory(m.Name), file)
+		if _, err := os.Stat(src); err != nil {
+			// the machine gets the one of the distribution at its start
+			continue
+		}
+		if err = cloneFile(src, fmt.Sprintf("%s/%s", dir, file)); err != nil {
+			return nil, err
+		}
+	}
+
+	// the copy is provisioned along with the disk, it's stopped until started
+	cloneStatus := &MachineStatus{ProvisionedAt: status.ProvisionedAt}
+	cloneStatus.move(Machine_state_creating)
+	cloneStatus.move(Machine_state_stop)
+	if err = clone.saveStatus(cloneStatus); err != nil {
+		return nil, err
+	}
+	return clone, clone.ExportMachineSpecification()
+}
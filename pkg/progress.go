@@ -0,0 +1,74 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// progressInterval is the minimal delay between two progress updates
+const progressInterval = 200 * time.Millisecond
+
+// progress writes the transferred bytes of a file on a single line, it's an io.Writer counting what's written
+type progress struct {
+	output  io.Writer
+	name    string
+	total   int64
+	current int64
+	updated time.Time
+}
+
+// newProgress reports to output the transfer of name, total is its size or -1 when it's unknown.
+// A nil output disables the report.
+func newProgress(output io.Writer, name string, total int64) *progress {
+	return &progress{output: output, name: name, total: total}
+}
+
+// start sets the bytes already transferred, when a transfer is resumed
+func (p *progress) start(current int64) {
+	p.current = current
+}
+
+func (p *progress) Write(content []byte) (int, error) {
+	p.current += int64(len(content))
+	if p.output != nil && time.Since(p.updated) >= progressInterval {
+		p.updated = time.Now()
+		p.print()
+	}
+	return len(content), nil
+}
+
+func (p *progress) print() {
+	if p.total < 0 {
+		fmt.Fprintf(p.output, "\r%s %s", p.name, HumanBytes(p.current))
+		return
+	}
+	percent := int64(100)
+	if p.total > 0 {
+		percent = p.current * 100 / p.total
+	}
+	fmt.Fprintf(p.output, "\r%s %3d%% %s/%s", p.name, percent, HumanBytes(p.current), HumanBytes(p.total))
+}
+
+// done prints the final state of the transfer and ends the line
+func (p *progress) done() {
+	if p.output == nil {
+		return
+	}
+	p.print()
+	fmt.Fprintln(p.output)
+}
+
+// HumanBytes rounds a size to its largest unit
+func HumanBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%dB", size)
+	}
+	value, exponent := float64(size)/unit, 0
+	for value >= unit && exponent < 3 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f%ciB", value, "KMGT"[exponent])
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	seedFileName = "seed.iso"
+	// seedVolume is the label cloud-init looks for to find a NoCloud seed
+	seedVolume = "cidata"
+)
+
+// SeedPath is the NoCloud seed image attached as the second disk of the machine
+func (m *Machine) SeedPath() string {
+	return fmt.Sprintf("%s/%s", MachineDirectory(m.Name), seedFileName)
+}
+
+// seedFiles renders the user-data, meta-data and network-config files read by cloud-init
+func (m *Machine) seedFiles() (map[string][]byte, error) {
+	userData, err := m.RenderUserData()
+	if err != nil {
+		return nil, err
+	}
+	// cloud-init runs its per-instance modules again when the instance id changes,
+	// it's derived from the name so a copy of the disk gets its own host keys and hostname
+	metaData := fmt.Sprintf("instance-id: iid-%s\nlocal-hostname: %s\n", m.Name, m.Name)
+	networkConfig := fmt.Sprintf(seedNetworkConfig, GenerateAlmostUniqueMac(m.Name))
+	return map[string][]byte{
+		"user-data":      userData,
+		"meta-data":      []byte(metaData),
+		"network-config": []byte(networkConfig),
+	}, nil
+}
+
+// writeSeed generates the seed image of the machine, it's written at every boot to follow the spec.
+// The rendered user-data is saved next to it.
+func (m *Machine) writeSeed() error {
+	files, err := m.seedFiles()
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(m.UserDataPath(), files["user-data"], 0644); err != nil {
+		return err
+	}
+	var image bytes.Buffer
+	if err = writeISO9660(&image, seedVolume, files, time.Now()); err != nil {
+		return err
+	}
+	tmpPath := m.SeedPath() + ".tmp"
+	if err = os.WriteFile(tmpPath, image.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.SeedPath())
+}
+
+// seedNetworkConfig identifies the DHCP client by its MAC address, the default identifier derives from
+// the machine id which is shared by the clones until their first boot
+const seedNetworkConfig = `version: 2
+ethernets:
+  primary:
+    match:
+      macaddress: "%s"
+    dhcp4: true
+    dhcp-identifier: mac
+`
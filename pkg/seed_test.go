@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readISO9660 returns the volume label and the files of the Joliet root directory
+func readISO9660(t *testing.T, image []byte) (string, map[string]string) {
+	sector := func(n uint32) []byte {
+		return image[n*isoSectorSize : (n+1)*isoSectorSize]
+	}
+	primary, joliet := sector(isoDescriptorSector), sector(isoDescriptorSector+1)
+	assert.Equal(t, []byte{1, 'C', 'D', '0', '0', '1'}, primary[:6])
+	assert.Equal(t, []byte{2, 'C', 'D', '0', '0', '1'}, joliet[:6])
+	assert.Equal(t, "%/E", string(joliet[88:91]))
+	assert.Equal(t, uint32(len(image)/isoSectorSize), binary.LittleEndian.Uint32(primary[80:]))
+
+	root := sector(binary.LittleEndian.Uint32(joliet[156+2:]))
+	files := map[string]string{}
+	for offset := 0; offset < len(root) && root[offset] > 0; offset += int(root[offset]) {
+		record := root[offset:]
+		identifier := record[33 : 33+record[32]]
+		if len(identifier) == 1 {
+			// . and ..
+			continue
+		}
+		name := make([]uint16, len(identifier)/2)
+		for i := range name {
+			name[i] = binary.BigEndian.Uint16(identifier[2*i:])
+		}
+		start := binary.LittleEndian.Uint32(record[2:]) * isoSectorSize
+		files[string(utf16.Decode(name))] = string(image[start : start+binary.LittleEndian.Uint32(record[10:])])
+	}
+	return string(bytes.TrimRight(primary[40:72], " ")), files
+}
+
+func TestWriteISO9660(t *testing.T) {
+	files := map[string][]byte{
+		"user-data":      []byte("#cloud-config\n"),
+		"meta-data":      bytes.Repeat([]byte("a"), 3*isoSectorSize+1),
+		"network-config": {},
+	}
+	var image bytes.Buffer
+	assert.NoError(t, writeISO9660(&image, "cidata", files, time.Now()))
+	assert.Zero(t, image.Len()%isoSectorSize)
+
+	label, content := readISO9660(t, image.Bytes())
+	assert.Equal(t, "cidata", label)
+	assert.Equal(t, map[string]string{
+		"user-data":      "#cloud-config\n",
+		"meta-data":      string(files["meta-data"]),
+		"network-config": "",
+	}, content)
+	assert.Equal(t, "NETWORK_CONFIG.;1", isoPrimaryName("network-config"))
+}
+
+func TestMachine_writeSeed(t *testing.T) {
+	m := newTestMachine(t, nil)
+	m.BaseDirectory()
+
+	assert.NoError(t, m.writeSeed())
+	image, err := os.ReadFile(m.SeedPath())
+	assert.NoError(t, err)
+	label, files := readISO9660(t, image)
+	assert.Equal(t, seedVolume, label)
+	key, _ := GetMachinaPublicKey()
+	assert.Contains(t, files["user-data"], key)
+	assert.Equal(t, "instance-id: iid-test\nlocal-hostname: test\n", files["meta-data"])
+	assert.Contains(t, files["network-config"], GenerateAlmostUniqueMac(m.Name))
+	assert.Contains(t, files["network-config"], "dhcp-identifier: mac")
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	snapshotsDirectoryName = "snapshots"
+	snapshotInfoFileName   = "snapshot.json"
+	rootDiskFileName       = "root.img"
+)
+
+// Snapshot is a copy of the root disk and of the spec of a machine
+type Snapshot struct {
+	Name        string    `json:"name"`
+	CreatedAt   time.Time `json:"created_at"`
+	Description string    `json:"description,omitempty"`
+	// Running tells the machine was running, it's paused while its disk is cloned
+	Running bool `json:"running"`
+	// Provisioned tells cloud-init had already configured the disk
+	Provisioned bool `json:"provisioned"`
+	// Size is the size of the disk
+	Size int64 `json:"size"`
+}
+
+func (m *Machine) SnapshotsDirectory() string {
+	return fmt.Sprintf("%s/%s", MachineDirectory(m.Name), snapshotsDirectoryName)
+}
+
+func (m *Machine) snapshotDirectory(name string) string {
+	return fmt.Sprintf("%s/%s", m.SnapshotsDirectory(), name)
+}
+
+func (m *Machine) rootDiskPath() string {
+	return fmt.Sprintf("%s/%s", MachineDirectory(m.Name), rootDiskFileName)
+}
+
+// CreateSnapshot clones the root disk and copies the spec of the machine.
+// A running machine is paused during the clone so that the disk isn't written meanwhile.
+func (m *Machine) CreateSnapshot(name, description string) (snapshot *Snapshot, err error) {
+	if !machineNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name %q, it must match %s", name, machineNamePattern)
+	}
+	disk, err := os.Stat(m.rootDiskPath())
+	if err != nil {
+		return nil, fmt.Errorf("machine %s has no disk yet: %v", m.Name, err)
+	}
+	if err = DirectoryCreateIfAbsent(m.SnapshotsDirectory()); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	dir := m.snapshotDirectory(name)
+	if err = os.Mkdir(dir, os.ModePerm); os.IsExist(err) {
+		return nil, fmt.Errorf("the snapshot %s of machine %s already exists", name, m.Name)
+	} else if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	running, err := m.cloneDisk(filepath.Join(dir, rootDiskFileName))
+	if err != nil {
+		return nil, err
+	}
+	spec, err := ioutil.ReadFile(m.InfoFilePath())
+	if err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, infoFileName), spec, 0644); err != nil {
+		return nil, err
+	}
+
+	snapshot = &Snapshot{
+		Name:        name,
+		CreatedAt:   time.Now(),
+		Description: description,
+		Running:     running,
+		Provisioned: m.hasAlreadyBeenConfigured(),
+		Size:        disk.Size(),
+	}
+	content, err := json.MarshalIndent(snapshot, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, ioutil.WriteFile(filepath.Join(dir, snapshotInfoFileName), content, 0644)
+}
+
+// Snapshot returns the metadata of a snapshot of the machine
+func (m *Machine) Snapshot(name string) (*Snapshot, error) {
+	if !machineNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("invalid snapshot name %q", name)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(m.snapshotDirectory(name), snapshotInfoFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("machine %s has no snapshot %s", m.Name, name)
+	} else if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err = json.Unmarshal(content, &snapshot); err != nil {
+		return nil, fmt.Errorf("%v parsing the snapshot %s", err, name)
+	}
+	return &snapshot, nil
+}
+
+// Snapshots returns the snapshots of the machine, the oldest first
+func (m *Machine) Snapshots() ([]*Snapshot, error) {
+	entries, err := os.ReadDir(m.SnapshotsDirectory())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snapshots := make([]*Snapshot, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		snapshot, err := m.Snapshot(entry.Name())
+		if err != nil {
+			// a snapshot interrupted during its creation has no metadata
+			utils.Logger.Debug(err)
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CreatedAt.Before(snapshots[j].CreatedAt)
+	})
+	return snapshots, nil
+}
+
+// RestoreSnapshot replaces the disk and the spec of the machine by the ones of the snapshot.
+// The machine must be stopped, the snapshot is kept.
+func (m *Machine) RestoreSnapshot(name string) error {
+	if m.IsActive() {
+		return fmt.Errorf("machine %s is %s, stop it first", m.Name, m.State())
+	}
+	snapshot, err := m.Snapshot(name)
+	if err != nil {
+		return err
+	}
+	dir := m.snapshotDirectory(name)
+
+	// clone then rename so that the disk is never left half restored
+	tmpPath := m.rootDiskPath() + ".restore"
+	os.Remove(tmpPath)
+	if err = cloneFile(filepath.Join(dir, rootDiskFileName), tmpPath); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, m.rootDiskPath()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	spec, err := ioutil.ReadFile(filepath.Join(dir, infoFileName))
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(m.InfoFilePath(), spec, 0644); err != nil {
+		return err
+	}
+	if err = json.Unmarshal(spec, m); err != nil {
+		return err
+	}
+
+	// a disk restored before its provisioning is provisioned again at the next start
+	return m.updateStatus(func(status *MachineStatus) error {
+		status.ProvisionedAt = nil
+		if snapshot.Provisioned {
+			status.ProvisionedAt = &snapshot.CreatedAt
+		}
+		return nil
+	})
+}
+
+// DeleteSnapshot removes a snapshot of the machine
+func (m *Machine) DeleteSnapshot(name string) error {
+	if _, err := m.Snapshot(name); err != nil {
+		return err
+	}
+	return os.RemoveAll(m.snapshotDirectory(name))
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestDisk gives the machine a spec and a root disk holding content
+func newTestDisk(t *testing.T, m *Machine, content string) {
+	m.BaseDirectory()
+	assert.NoError(t, m.ExportMachineSpecification())
+	assert.NoError(t, os.WriteFile(m.rootDiskPath(), []byte(content), 0644))
+}
+
+func TestMachine_Snapshot(t *testing.T) {
+	t.Run("should copy the disk and the spec of a stopped machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running, Machine_state_stop)
+		newTestDisk(t, m, "disk")
+
+		snapshot, err := m.CreateSnapshot("before-upgrade", "focal")
+		assert.NoError(t, err)
+		assert.Equal(t, "focal", snapshot.Description)
+		assert.False(t, snapshot.Running)
+		assert.Equal(t, int64(4), snapshot.Size)
+		assert.FileExists(t, m.snapshotDirectory("before-upgrade")+"/"+infoFileName)
+
+		snapshots, err := m.Snapshots()
+		assert.NoError(t, err)
+		assert.Len(t, snapshots, 1)
+		assert.Equal(t, "before-upgrade", snapshots[0].Name)
+	})
+
+	t.Run("should pause a running machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		vm, _ := serveTestControl(t, m, NewFakeDriver())
+		newTestDisk(t, m, "disk")
+
+		snapshot, err := m.CreateSnapshot("live", "")
+		assert.NoError(t, err)
+		assert.True(t, snapshot.Running)
+		assert.Equal(t, VMStateRunning, vm.State())
+		assert.Equal(t, Machine_state_running, m.State())
+	})
+
+	t.Run("should refuse an existing or invalid snapshot", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		newTestDisk(t, m, "disk")
+
+		_, err := m.CreateSnapshot("snap", "")
+		assert.NoError(t, err)
+		_, err = m.CreateSnapshot("snap", "")
+		assert.Error(t, err)
+		_, err = m.CreateSnapshot("../snap", "")
+		assert.Error(t, err)
+	})
+}
+
+func TestMachine_RestoreSnapshot(t *testing.T) {
+	t.Run("should restore the disk, the spec and the provisioning", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running, Machine_state_stop)
+		newTestDisk(t, m, "provisioned")
+		assert.NoError(t, m.markProvisioned())
+		_, err := m.CreateSnapshot("snap", "")
+		assert.NoError(t, err)
+
+		m.Spec.Cpu = 4
+		newTestDisk(t, m, "changed")
+		status, _ := m.Status()
+		status.ProvisionedAt = nil
+		assert.NoError(t, m.saveStatus(status))
+
+		assert.NoError(t, m.RestoreSnapshot("snap"))
+		content, err := os.ReadFile(m.rootDiskPath())
+		assert.NoError(t, err)
+		assert.Equal(t, "provisioned", string(content))
+		restored, err := FromFileSpec(m.Name)
+		assert.NoError(t, err)
+		assert.Equal(t, uint(2), restored.Spec.Cpu)
+		assert.True(t, m.hasAlreadyBeenConfigured())
+	})
+
+	t.Run("should refuse a running machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		serveTestControl(t, m, NewFakeDriver())
+		newTestDisk(t, m, "disk")
+		_, err := m.CreateSnapshot("snap", "")
+		assert.NoError(t, err)
+
+		assert.Error(t, m.RestoreSnapshot("snap"))
+	})
+}
+
+func TestMachine_DeleteSnapshot(t *testing.T) {
+	m := newTestMachine(t, nil)
+	newTestDisk(t, m, "disk")
+	_, err := m.CreateSnapshot("snap", "")
+	assert.NoError(t, err)
+
+	assert.NoError(t, m.DeleteSnapshot("snap"))
+	assert.NoDirExists(t, m.snapshotDirectory("snap"))
+	assert.Error(t, m.DeleteSnapshot("snap"))
+}
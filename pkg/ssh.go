@@ -0,0 +1,196 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	sshPort        = 22
+	DefaultSshUser = "root"
+)
+
+// SshAddress returns the address of the machine ssh server
+func (m *Machine) SshAddress() (string, error) {
+	ip, err := m.IpAddress()
+	if err != nil {
+		return utils.Empty, fmt.Errorf("cannot find the ip address of machine %s: %v", m.Name, err)
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(sshPort)), nil
+}
+
+// Ssh runs the command on the machine as user, or opens a login shell without command.
+// When stdin is a terminal, it's put in raw mode and a PTY following the terminal size is requested.
+// It returns the exit status of the remote command.
+func (m *Machine) Ssh(user string, command []string, stdin *os.File, stdout, stderr io.Writer) (int, error) {
+	address, err := m.SshAddress()
+	if err != nil {
+		return -1, err
+	}
+	return sshInteractive(user, address, command, stdin, stdout, stderr)
+}
+
+func sshInteractive(user, address string, command []string, stdin *os.File, stdout, stderr io.Writer) (int, error) {
+	client, session, err := connectToHost(user, address)
+	if err != nil {
+		return -1, err
+	}
+	defer client.Close()
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	if IsTerminal(stdin) {
+		width, height := terminalSize(stdin)
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          1,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err = session.RequestPty(FromEnvWithDefault("TERM", "xterm-256color"), height, width, modes); err != nil {
+			return -1, fmt.Errorf("cannot allocate a pty: %v", err)
+		}
+		previous, err := setRawMode(stdin)
+		if err != nil {
+			return -1, err
+		}
+		defer restoreMode(stdin, previous)
+		stop := propagateWindowSize(stdin, session)
+		defer stop()
+	}
+
+	if len(command) == 0 {
+		err = session.Shell()
+	} else {
+		err = session.Start(strings.Join(command, " "))
+	}
+	if err != nil {
+		return -1, err
+	}
+	return exitStatus(session.Wait())
+}
+
+// exitStatus converts the result of a remote command to its exit status
+func exitStatus(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+	var exitError *ssh.ExitError
+	if errors.As(err, &exitError) {
+		return exitError.ExitStatus(), nil
+	}
+	return -1, err
+}
+
+func terminalSize(f *os.File) (width int, height int) {
+	size, err := unix.IoctlGetWinsize(int(f.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return 80, 24
+	}
+	return int(size.Col), int(size.Row)
+}
+
+// propagateWindowSize forwards the terminal resizes to the remote pty until stop is called
+func propagateWindowSize(f *os.File, session *ssh.Session) (stop func()) {
+	resizeCh := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(resizeCh, syscall.SIGWINCH)
+	go func() {
+		for {
+			select {
+			case <-resizeCh:
+				width, height := terminalSize(f)
+				if err := session.WindowChange(height, width); err != nil {
+					utils.Logger.Debug("window change failed", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(resizeCh)
+		close(done)
+	}
+}
+
+// ExecOptions configures a command run by Exec
+type ExecOptions struct {
+	User string
+	// Env holds KEY=VALUE variables set for the command
+	Env     []string
+	WorkDir string
+	// Stdin is forwarded to the command when set
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Exec runs the command on the machine without pty, its arguments are passed as is.
+// It streams stdout and stderr separately and returns the exit status of the command.
+func (m *Machine) Exec(command []string, options ExecOptions) (int, error) {
+	address, err := m.SshAddress()
+	if err != nil {
+		return -1, err
+	}
+	return execCommand(address, command, options)
+}
+
+func execCommand(address string, command []string, options ExecOptions) (int, error) {
+	commandLine, err := remoteCommandLine(command, options.Env, options.WorkDir)
+	if err != nil {
+		return -1, err
+	}
+	client, session, err := connectToHost(options.User, address)
+	if err != nil {
+		return -1, err
+	}
+	defer client.Close()
+	defer session.Close()
+
+	session.Stdin = options.Stdin
+	session.Stdout = options.Stdout
+	session.Stderr = options.Stderr
+	return exitStatus(session.Run(commandLine))
+}
+
+// remoteCommandLine builds the shell command line running command with env in workdir
+func remoteCommandLine(command []string, env []string, workdir string) (string, error) {
+	if len(command) == 0 {
+		return utils.Empty, errors.New("no command to execute")
+	}
+	var words []string
+	if workdir != utils.Empty {
+		words = append(words, "cd", shellQuote(workdir), "&&")
+	}
+	if len(env) > 0 {
+		words = append(words, "env")
+		for _, variable := range env {
+			if !strings.Contains(variable, "=") || strings.HasPrefix(variable, "=") {
+				return utils.Empty, fmt.Errorf("invalid environment variable %q, expected KEY=VALUE", variable)
+			}
+			words = append(words, shellQuote(variable))
+		}
+	}
+	for _, argument := range command {
+		words = append(words, shellQuote(argument))
+	}
+	return strings.Join(words, " "), nil
+}
+
+// shellQuote quotes s for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
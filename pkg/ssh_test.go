@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSshRequest is a session received by the test ssh server
+type testSshRequest struct {
+	User    string
+	Command string
+	// Subsystem is the requested subsystem, like sftp, Command is then empty
+	Subsystem string
+	Env       map[string]string
+	Pty       bool
+}
+
+// testSshHandler serves a session and returns its exit status
+type testSshHandler func(request *testSshRequest, channel ssh.Channel) uint32
+
+// startTestSshServer serves ssh sessions on localhost with the handler, it returns its address
+func startTestSshServer(t *testing.T, handler testSshHandler) string {
+	_, hostKey, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	assert.NoError(t, err)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveTestSshConn(conn, config, handler)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func serveTestSshConn(conn net.Conn, config *ssh.ServerConfig, handler testSshHandler) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go serveTestDirectTcpip(newChannel)
+			continue
+		}
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions and tcp forwards are supported")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			request := &testSshRequest{User: serverConn.User(), Env: map[string]string{}}
+			for channelRequest := range channelRequests {
+				switch channelRequest.Type {
+				case "env":
+					var env struct{ Name, Value string }
+					ssh.Unmarshal(channelRequest.Payload, &env)
+					request.Env[env.Name] = env.Value
+				case "pty-req", "window-change":
+					request.Pty = true
+				case "exec", "shell", "subsystem":
+					switch channelRequest.Type {
+					case "exec":
+						var exec struct{ Command string }
+						ssh.Unmarshal(channelRequest.Payload, &exec)
+						request.Command = exec.Command
+					case "subsystem":
+						var subsystem struct{ Name string }
+						ssh.Unmarshal(channelRequest.Payload, &subsystem)
+						request.Subsystem = subsystem.Name
+					}
+					channelRequest.Reply(true, nil)
+					status := make([]byte, 4)
+					binary.BigEndian.PutUint32(status, handler(request, channel))
+					channel.CloseWrite()
+					channel.SendRequest("exit-status", false, status)
+					channel.Close()
+					continue
+				}
+				if channelRequest.WantReply {
+					channelRequest.Reply(true, nil)
+				}
+			}
+		}()
+	}
+}
+
+// serveTestDirectTcpip connects a tcp forward channel to its target
+func serveTestDirectTcpip(newChannel ssh.NewChannel) {
+	var target struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	ssh.Unmarshal(newChannel.ExtraData(), &target)
+	conn, err := net.Dial("tcp", net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))))
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	go ssh.DiscardRequests(requests)
+	done := make(chan struct{})
+	go func() {
+		io.Copy(conn, channel)
+		conn.(*net.TCPConn).CloseWrite()
+		close(done)
+	}()
+	io.Copy(channel, conn)
+	channel.CloseWrite()
+	<-done
+}
+
+func TestSshInteractive(t *testing.T) {
+	newTestMachine(t, nil)
+
+	t.Run("should run the command and return its exit status", func(t *testing.T) {
+		var received *testSshRequest
+		address := startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 {
+			received = request
+			channel.Write([]byte("hello\n"))
+			channel.Stderr().Write([]byte("oops\n"))
+			return 3
+		})
+		stdin, _, _ := os.Pipe()
+		var stdout, stderr bytes.Buffer
+
+		status, err := sshInteractive("ubuntu", address, []string{"echo", "hello"}, stdin, &stdout, &stderr)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, status)
+		assert.Equal(t, "ubuntu", received.User)
+		assert.Equal(t, "echo hello", received.Command)
+		assert.False(t, received.Pty)
+		assert.Equal(t, "hello\n", stdout.String())
+		assert.Equal(t, "oops\n", stderr.String())
+	})
+
+	t.Run("should open a shell without command", func(t *testing.T) {
+		var received *testSshRequest
+		address := startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 {
+			received = request
+			return 0
+		})
+		stdin, _, _ := os.Pipe()
+
+		status, err := sshInteractive(DefaultSshUser, address, nil, stdin, &bytes.Buffer{}, &bytes.Buffer{})
+		assert.NoError(t, err)
+		assert.Equal(t, 0, status)
+		assert.Empty(t, received.Command)
+	})
+
+	t.Run("should fail when the machine is unreachable", func(t *testing.T) {
+		listener, _ := net.Listen("tcp", "127.0.0.1:0")
+		address := listener.Addr().String()
+		listener.Close()
+
+		_, err := sshInteractive(DefaultSshUser, address, nil, os.Stdin, &bytes.Buffer{}, &bytes.Buffer{})
+		assert.Error(t, err)
+	})
+}
+
+func TestExecCommand(t *testing.T) {
+	newTestMachine(t, nil)
+
+	t.Run("should forward stdin, stream outputs and return the exit status", func(t *testing.T) {
+		var received *testSshRequest
+		address := startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 {
+			received = request
+			input, _ := ioutil.ReadAll(channel)
+			channel.Write(input)
+			channel.Stderr().Write([]byte("warning\n"))
+			return 42
+		})
+		var stdout, stderr bytes.Buffer
+
+		status, err := execCommand(address, []string{"cat", "-"}, ExecOptions{
+			User:   DefaultSshUser,
+			Stdin:  strings.NewReader("from host"),
+			Stdout: &stdout,
+			Stderr: &stderr,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 42, status)
+		assert.Equal(t, "'cat' '-'", received.Command)
+		assert.Equal(t, "from host", stdout.String())
+		assert.Equal(t, "warning\n", stderr.String())
+	})
+
+	t.Run("should reject a malformed variable", func(t *testing.T) {
+		_, err := execCommand("127.0.0.1:22", []string{"true"}, ExecOptions{Env: []string{"NOVALUE"}})
+		assert.Error(t, err)
+	})
+}
+
+func TestRemoteCommandLine(t *testing.T) {
+	t.Run("should keep the arguments as is", func(t *testing.T) {
+		line, err := remoteCommandLine([]string{"echo", "it's", "a b"}, nil, "")
+		assert.NoError(t, err)
+		assert.Equal(t, `'echo' 'it'\''s' 'a b'`, line)
+	})
+
+	t.Run("should set the working directory and the environment", func(t *testing.T) {
+		line, err := remoteCommandLine([]string{"make"}, []string{"MODE=test", "EMPTY="}, "/srv/my app")
+		assert.NoError(t, err)
+		assert.Equal(t, `cd '/srv/my app' && env 'MODE=test' 'EMPTY=' 'make'`, line)
+	})
+
+	t.Run("should refuse an empty command", func(t *testing.T) {
+		_, err := remoteCommandLine(nil, nil, "")
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"github.com/mitchellh/go-ps"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	stateFileName = "state.json"
+	// stateLockFileName is locked while the state is updated
+	stateLockFileName = "state.lock"
+	maxStateHistory   = 20
+
+	Machine_state_creating     = "creating"
+	Machine_state_downloading  = "downloading"
+	Machine_state_provisioning = "provisioning"
+	Machine_state_starting     = "starting"
+	Machine_state_paused       = "paused"
+	Machine_state_stopping     = "stopping"
+	Machine_state_failed       = "failed"
+)
+
+// machineTransitions lists the states reachable from each state,
+// failed is reachable from every state and isn't listed.
+var machineTransitions = map[string]*utils.Set{
+	utils.Empty:                utils.NewSetFromSlice(Machine_state_creating),
+	Machine_state_creating:     utils.NewSetFromSlice(Machine_state_downloading),
+	Machine_state_downloading:  utils.NewSetFromSlice(Machine_state_provisioning, Machine_state_starting),
+	Machine_state_provisioning: utils.NewSetFromSlice(Machine_state_starting),
+	Machine_state_starting:     utils.NewSetFromSlice(Machine_state_running),
+	Machine_state_running:      utils.NewSetFromSlice(Machine_state_paused, Machine_state_stopping, Machine_state_stop),
+	Machine_state_paused:       utils.NewSetFromSlice(Machine_state_running, Machine_state_stopping, Machine_state_stop),
+	Machine_state_stopping:     utils.NewSetFromSlice(Machine_state_running, Machine_state_stop),
+	Machine_state_stop:         utils.NewSetFromSlice(Machine_state_downloading, Machine_state_starting),
+	Machine_state_failed:       utils.NewSetFromSlice(Machine_state_downloading, Machine_state_starting, Machine_state_stop),
+	Machine_state_error:        utils.NewSetFromSlice(Machine_state_downloading, Machine_state_starting, Machine_state_stop),
+}
+
+// processStates are the states owned by a live machina process,
+// a machine found in one of them without its process has crashed.
+var processStates = utils.NewSetFromSlice(
+	Machine_state_downloading,
+	Machine_state_provisioning,
+	Machine_state_starting,
+	Machine_state_running,
+	Machine_state_paused,
+	Machine_state_stopping,
+)
+
+// MachineTransition is a timestamped state change of a machine
+type MachineTransition struct {
+	From string    `json:"from"`
+	To   string    `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// MachineStatus is the lifecycle of a machine persisted in its directory
+type MachineStatus struct {
+	State         string              `json:"state"`
+	Since         time.Time           `json:"since"`
+	Pid           int                 `json:"pid,omitempty"`
+	FailureReason string              `json:"failure_reason,omitempty"`
+	FailedAt      *time.Time          `json:"failed_at,omitempty"`
+	ProvisionedAt *time.Time          `json:"provisioned_at,omitempty"`
+	History       []MachineTransition `json:"history"`
+}
+
+// InvalidTransitionError is returned when a state change isn't allowed by the lifecycle
+type InvalidTransitionError struct {
+	Machine string
+	From    string
+	To      string
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("machine %s cannot go from %s to %s", e.Machine, e.From, e.To)
+}
+
+func (m *Machine) StatusFilePath() string {
+	return fmt.Sprintf("%s/%s", MachineDirectory(m.Name), stateFileName)
+}
+
+// Status returns the persisted lifecycle of the machine.
+// A machine left in a process state while its process is gone is reported as failed, the failure is persisted by the next update.
+func (m *Machine) Status() (*MachineStatus, error) {
+	specContent, err := ioutil.ReadFile(m.StatusFilePath())
+	if errors.Is(err, os.ErrNotExist) {
+		// machine created before the lifecycle was persisted, fallback on the pid file
+		_, state, _ := m.findVfkitProcess()
+		return &MachineStatus{State: state}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var status MachineStatus
+	if err = json.Unmarshal(specContent, &status); err != nil {
+		return nil, fmt.Errorf("%v parsing %s", err, m.StatusFilePath())
+	}
+
+	if processStates.Contains(status.State) && !isMachinaProcessAlive(status.Pid) {
+		utils.Logger.Debugf("machine %s was %s but its process %d is gone", m.Name, status.State, status.Pid)
+		status.fail(fmt.Errorf("machina process %d exited while the machine was %s", status.Pid, status.State))
+	}
+	return &status, nil
+}
+
+// updateStatus applies update to the status of the machine and persists it, the state is locked meanwhile
+// so that the machina processes don't overwrite the updates of each other.
+func (m *Machine) updateStatus(update func(status *MachineStatus) error) error {
+	unlock, err := m.lockStatus()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	status, err := m.Status()
+	if err != nil {
+		return err
+	}
+	if err = update(status); err != nil {
+		return err
+	}
+	return m.saveStatus(status)
+}
+
+// lockStatus takes the exclusive lock of the state of the machine, it's released by unlock
+func (m *Machine) lockStatus() (unlock func(), err error) {
+	f, err := os.OpenFile(fmt.Sprintf("%s/%s", m.BaseDirectory(), stateLockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot lock the state of machine %s: %v", m.Name, err)
+	}
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// Transition validates and persists a state change of the machine.
+// Moving to the current state only refreshes the owning process.
+func (m *Machine) Transition(state string) error {
+	return m.updateStatus(func(status *MachineStatus) error {
+		if status.State != state {
+			allowed, found := machineTransitions[status.State]
+			if state != Machine_state_failed && (!found || !allowed.Contains(state)) {
+				return &InvalidTransitionError{Machine: m.Name, From: status.State, To: state}
+			}
+			status.move(state)
+		}
+		status.Pid = os.Getpid()
+		return nil
+	})
+}
+
+// handOver gives the ownership of the machine to the process pid, like the daemon spawned to run it
+func (m *Machine) handOver(pid int) error {
+	return m.updateStatus(func(status *MachineStatus) error {
+		status.Pid = pid
+		return nil
+	})
+}
+
+// Fail moves the machine to the failed state with the reason, the reason is returned as is
+func (m *Machine) Fail(reason error) error {
+	err := m.updateStatus(func(status *MachineStatus) error {
+		status.fail(reason)
+		return nil
+	})
+	if err != nil {
+		utils.Logger.Warnf("cannot record the failure of machine %s: %v", m.Name, err)
+	}
+	return reason
+}
+
+// IsActive returns true when a live machina process is working on the machine
+func (m *Machine) IsActive() bool {
+	return processStates.Contains(m.State())
+}
+
+// InitStatus starts the lifecycle of a new machine
+func (m *Machine) InitStatus() error {
+	unlock, err := m.lockStatus()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	status := &MachineStatus{}
+	status.move(Machine_state_creating)
+	status.Pid = os.Getpid()
+	return m.saveStatus(status)
+}
+
+func (m *Machine) markProvisioned() error {
+	return m.updateStatus(func(status *MachineStatus) error {
+		now := time.Now()
+		status.ProvisionedAt = &now
+		return nil
+	})
+}
+
+func (m *Machine) hasAlreadyBeenConfigured() bool {
+	status, err := m.Status()
+	return err == nil && status.ProvisionedAt != nil
+}
+
+// saveStatus writes the status, the updates of an existing status go through updateStatus
+func (m *Machine) saveStatus(status *MachineStatus) error {
+	content, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return err
+	}
+	// write then rename so that a reader never sees a partial state
+	tmpPath := m.StatusFilePath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, m.StatusFilePath())
+}
+
+func (s *MachineStatus) move(state string) {
+	now := time.Now()
+	s.History = append(s.History, MachineTransition{From: s.State, To: state, At: now})
+	if len(s.History) > maxStateHistory {
+		s.History = s.History[len(s.History)-maxStateHistory:]
+	}
+	s.State = state
+	s.Since = now
+}
+
+func (s *MachineStatus) fail(reason error) {
+	s.move(Machine_state_failed)
+	s.FailureReason = reason.Error()
+	failedAt := s.Since
+	s.FailedAt = &failedAt
+}
+
+func isMachinaProcessAlive(pid int) bool {
+	if pid == os.Getpid() {
+		return true
+	}
+	p, err := ps.FindProcess(pid)
+	return err == nil && p != nil && strings.Contains(p.Executable(), commandPrefix)
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachine_Transition(t *testing.T) {
+	t.Run("should record timestamped transitions", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_provisioning)
+
+		status, err := m.Status()
+		assert.NoError(t, err)
+		assert.Equal(t, Machine_state_provisioning, status.State)
+		assert.Len(t, status.History, 3)
+		assert.Equal(t, Machine_state_downloading, status.History[2].From)
+		assert.Equal(t, status.Since, status.History[2].At)
+		assert.False(t, status.History[2].At.Before(status.History[1].At))
+	})
+
+	t.Run("should refuse an invalid transition", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m)
+
+		err := m.Transition(Machine_state_running)
+		var transitionError *InvalidTransitionError
+		assert.True(t, errors.As(err, &transitionError))
+		assert.Equal(t, Machine_state_creating, m.State())
+	})
+
+	t.Run("should accept a transition to the current state", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading)
+
+		assert.NoError(t, m.Transition(Machine_state_downloading))
+		status, _ := m.Status()
+		assert.Len(t, status.History, 2)
+	})
+
+	t.Run("should keep the last failure reason once recovered", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading)
+
+		assert.EqualError(t, m.Fail(errors.New("disk full")), "disk full")
+		assert.Equal(t, Machine_state_failed, m.State())
+		assert.NoError(t, m.Transition(Machine_state_downloading))
+		status, _ := m.Status()
+		assert.Equal(t, "disk full", status.FailureReason)
+		assert.NotNil(t, status.FailedAt)
+		assert.True(t, status.FailedAt.Before(status.Since))
+	})
+
+	t.Run("should bound the history", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m)
+		for i := 0; i < maxStateHistory; i++ {
+			assert.NoError(t, m.Transition(Machine_state_downloading))
+			assert.Error(t, m.Fail(errors.New("network")))
+		}
+		status, _ := m.Status()
+		assert.Len(t, status.History, maxStateHistory)
+	})
+}
+
+func TestMachine_Status(t *testing.T) {
+	t.Run("should fallback on the pid file for machines without state", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		m.BaseDirectory()
+
+		assert.Equal(t, Machine_state_stop, m.State())
+	})
+
+	t.Run("should report a crashed machine as failed", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running)
+		status, _ := m.Status()
+		status.Pid = -1
+		assert.NoError(t, m.saveStatus(status))
+
+		status, err := m.Status()
+		assert.NoError(t, err)
+		assert.Equal(t, Machine_state_failed, status.State)
+		assert.Contains(t, status.FailureReason, "while the machine was running")
+		assert.False(t, m.IsActive())
+		// the failure is only persisted by the next update
+		content, _ := os.ReadFile(m.StatusFilePath())
+		assert.Contains(t, string(content), `"state": "running"`)
+		assert.NoError(t, m.Transition(Machine_state_stop))
+		status, _ = m.Status()
+		assert.Equal(t, Machine_state_failed, status.History[len(status.History)-2].To)
+	})
+
+	t.Run("should keep a machine provisioning while its process lives", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_provisioning)
+
+		assert.Equal(t, Machine_state_provisioning, m.State())
+		assert.True(t, m.IsActive())
+	})
+
+	t.Run("should keep a machine handed over to a live process", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading)
+		assert.NoError(t, m.handOver(os.Getppid()))
+
+		status, err := m.Status()
+		assert.NoError(t, err)
+		assert.Equal(t, os.Getppid(), status.Pid)
+		assert.NoError(t, m.handOver(-1))
+		assert.Equal(t, Machine_state_failed, m.State())
+	})
+
+	t.Run("should not lose concurrent updates", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				assert.NoError(t, m.updateStatus(func(status *MachineStatus) error {
+					status.move(Machine_state_downloading)
+					return nil
+				}))
+			}()
+		}
+		wg.Wait()
+
+		status, _ := m.Status()
+		assert.Len(t, status.History, 12)
+	})
+}
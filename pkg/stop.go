@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"github.com/mitchellh/go-ps"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"syscall"
+	"time"
+)
+
+// StopStage is the step of the stop escalation which stopped a machine
+type StopStage string
+
+const (
+	// StopStageNone means the machine wasn't running
+	StopStageNone StopStage = "none"
+	// StopStageRequestStop asks the guest to stop through the daemon
+	StopStageRequestStop StopStage = "request-stop"
+	// StopStagePoweroff runs poweroff in the guest over ssh
+	StopStagePoweroff StopStage = "poweroff"
+	// StopStageKill makes the daemon leave, or kills it, with the machine
+	StopStageKill StopStage = "kill"
+
+	DefaultStopTimeout = 30 * time.Second
+	killTimeout        = 5 * time.Second
+	stopPollInterval   = 200 * time.Millisecond
+)
+
+// StopOptions configures Stop
+type StopOptions struct {
+	// Timeout bounds each graceful stage, DefaultStopTimeout when zero
+	Timeout time.Duration
+	// Force skips the graceful stages and kills the machine right away
+	Force bool
+}
+
+type stopStage struct {
+	name    StopStage
+	timeout time.Duration
+	run     func() error
+}
+
+// Stop stops the machine gracefully: the guest is requested to stop by the daemon,
+// then powered off over ssh and finally killed when it's still running.
+// It returns the stage which stopped the machine.
+func (m *Machine) Stop(options StopOptions) (StopStage, error) {
+	pid, found := m.ownerPid()
+	if !found {
+		return StopStageNone, nil
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultStopTimeout
+	}
+
+	kill := stopStage{name: StopStageKill, timeout: killTimeout, run: func() error { return m.kill(pid) }}
+	stages := []stopStage{kill}
+	if !options.Force {
+		stages = []stopStage{
+			{name: StopStageRequestStop, timeout: options.Timeout, run: func() error { return m.requestDaemonStop(pid) }},
+			{name: StopStagePoweroff, timeout: options.Timeout, run: m.poweroff},
+			kill,
+		}
+	}
+	return m.runStopStages(stages, func() bool { return !isProcessAlive(pid) })
+}
+
+// ownerPid returns the machina process working on the machine: the daemon answering on the control socket,
+// the live owner recorded in the state, like a daemon still downloading or provisioning, or the process
+// of the pid file for the machines created before the state was persisted.
+func (m *Machine) ownerPid() (int, bool) {
+	if response, err := m.Control(ControlState); err == nil && response.Pid > 0 {
+		return response.Pid, true
+	}
+	if status, err := m.Status(); err == nil && processStates.Contains(status.State) && status.Pid > 0 {
+		return status.Pid, true
+	}
+	if process, _, _ := m.findVfkitProcess(); process != nil {
+		return process.Pid(), true
+	}
+	return 0, false
+}
+
+// runStopStages runs the stages in order until stopped returns true.
+// A stage failing or timing out escalates to the next one.
+func (m *Machine) runStopStages(stages []stopStage, stopped func() bool) (StopStage, error) {
+	for _, stage := range stages {
+		utils.Logger.Debugf("stopping machine %s with %s", m.Name, stage.name)
+		if err := stage.run(); err != nil {
+			utils.Logger.Warnf("cannot stop machine %s with %s: %v", m.Name, stage.name, err)
+			continue
+		}
+		if waitUntil(stopped, stage.timeout) {
+			return stage.name, nil
+		}
+		utils.Logger.Warnf("machine %s still running %s after %s", m.Name, stage.timeout, stage.name)
+	}
+	return StopStageNone, fmt.Errorf("machine %s is still running", m.Name)
+}
+
+// requestDaemonStop makes the daemon ask the guest to stop, a daemon without control socket is signaled
+func (m *Machine) requestDaemonStop(pid int) error {
+	if _, err := m.Control(ControlRequestStop); err != nil {
+		utils.Logger.Debug(err)
+		return signalProcess(pid, syscall.SIGTERM)
+	}
+	return nil
+}
+
+// poweroff runs poweroff in the guest
+func (m *Machine) poweroff() error {
+	address, err := m.SshAddress()
+	if err != nil {
+		return err
+	}
+	return poweroffCommand(address)
+}
+
+func poweroffCommand(address string) error {
+	client, session, err := connectToHost(DefaultSshUser, address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	defer session.Close()
+
+	// the guest usually drops the connection before the command returns
+	status, err := exitStatus(session.Run("poweroff"))
+	var exitMissing *ssh.ExitMissingError
+	if err != nil && !errors.As(err, &exitMissing) {
+		return err
+	}
+	if status > 0 {
+		return fmt.Errorf("poweroff exited with status %d", status)
+	}
+	return nil
+}
+
+// kill makes the daemon leave with the machine, an unresponsive daemon is killed
+// and the lifecycle is recorded here since the daemon can't do it anymore.
+func (m *Machine) kill(pid int) error {
+	if _, err := m.Control(ControlForceStop); err == nil && waitUntil(func() bool { return !isProcessAlive(pid) }, killTimeout) {
+		return nil
+	}
+	if err := m.Transition(Machine_state_stopping); err != nil {
+		utils.Logger.Warn(err)
+	}
+	if err := signalProcess(pid, syscall.SIGKILL); err != nil {
+		return err
+	}
+	if !waitUntil(func() bool { return !isProcessAlive(pid) }, killTimeout) {
+		return fmt.Errorf("process %d survived a kill", pid)
+	}
+	m.cleanBeforeExit()
+	return m.Transition(Machine_state_stop)
+}
+
+func signalProcess(pid int, sig os.Signal) error {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return process.Signal(sig)
+}
+
+func isProcessAlive(pid int) bool {
+	p, err := ps.FindProcess(pid)
+	return err == nil && p != nil
+}
+
+// waitUntil polls condition until it's true or the timeout expires, it returns the last result
+func waitUntil(condition func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(stopPollInterval)
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestMachine_runStopStages(t *testing.T) {
+	m := &Machine{Name: "test"}
+
+	t.Run("should escalate until the machine is stopped", func(t *testing.T) {
+		stopped := false
+		var ran []StopStage
+		stages := []stopStage{
+			{name: StopStageRequestStop, timeout: 10 * time.Millisecond, run: func() error {
+				ran = append(ran, StopStageRequestStop)
+				return nil
+			}},
+			{name: StopStagePoweroff, timeout: time.Second, run: func() error {
+				ran = append(ran, StopStagePoweroff)
+				stopped = true
+				return nil
+			}},
+			{name: StopStageKill, timeout: time.Second, run: func() error {
+				ran = append(ran, StopStageKill)
+				return nil
+			}},
+		}
+
+		stage, err := m.runStopStages(stages, func() bool { return stopped })
+		assert.NoError(t, err)
+		assert.Equal(t, StopStagePoweroff, stage)
+		assert.Equal(t, []StopStage{StopStageRequestStop, StopStagePoweroff}, ran)
+	})
+
+	t.Run("should skip a failing stage", func(t *testing.T) {
+		stopped := false
+		stages := []stopStage{
+			{name: StopStagePoweroff, timeout: time.Hour, run: func() error { return errors.New("unreachable") }},
+			{name: StopStageKill, timeout: time.Second, run: func() error {
+				stopped = true
+				return nil
+			}},
+		}
+
+		stage, err := m.runStopStages(stages, func() bool { return stopped })
+		assert.NoError(t, err)
+		assert.Equal(t, StopStageKill, stage)
+	})
+
+	t.Run("should fail when every stage is exhausted", func(t *testing.T) {
+		stages := []stopStage{
+			{name: StopStageKill, timeout: 10 * time.Millisecond, run: func() error { return nil }},
+		}
+
+		_, err := m.runStopStages(stages, func() bool { return false })
+		assert.Error(t, err)
+	})
+}
+
+func TestMachine_Stop(t *testing.T) {
+	t.Run("should do nothing without machine process", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading, Machine_state_starting, Machine_state_running, Machine_state_stop)
+
+		stage, err := m.Stop(StopOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, StopStageNone, stage)
+	})
+
+	t.Run("should kill the process downloading the machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading)
+		owner := startTestOwner(t)
+		assert.NoError(t, m.handOver(owner.Process.Pid))
+		assert.True(t, m.IsActive())
+
+		stage, err := m.Stop(StopOptions{Force: true})
+		assert.NoError(t, err)
+		assert.Equal(t, StopStageKill, stage)
+		assert.Equal(t, Machine_state_stop, m.State())
+		assert.NoError(t, m.Delete())
+	})
+}
+
+// startTestOwner runs a process passing for a machina daemon, it's killed at the end of the test
+func startTestOwner(t *testing.T) *exec.Cmd {
+	sleep, err := exec.LookPath("sleep")
+	assert.NoError(t, err)
+	content, err := os.ReadFile(sleep)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), commandPrefix+"-test")
+	assert.NoError(t, os.WriteFile(path, content, 0755))
+	cmd := exec.Command(path, "60")
+	assert.NoError(t, cmd.Start())
+	t.Cleanup(func() { cmd.Process.Kill() })
+	go cmd.Wait()
+	return cmd
+}
+
+func TestMachine_ownerPid(t *testing.T) {
+	t.Run("should find the process downloading the machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading)
+
+		pid, found := m.ownerPid()
+		assert.True(t, found)
+		assert.Equal(t, os.Getpid(), pid)
+	})
+
+	t.Run("should ask the daemon", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		serveTestControl(t, m, NewFakeDriver())
+		// the daemon answers even when its state doesn't record it
+		assert.NoError(t, m.handOver(-1))
+
+		pid, found := m.ownerPid()
+		assert.True(t, found)
+		assert.Equal(t, os.Getpid(), pid)
+	})
+
+	t.Run("should not find the process of a crashed machine", func(t *testing.T) {
+		m := newTestMachine(t, nil)
+		moveTo(t, m, Machine_state_downloading)
+		assert.NoError(t, m.handOver(-1))
+
+		_, found := m.ownerPid()
+		assert.False(t, found)
+	})
+}
+
+func TestPoweroffCommand(t *testing.T) {
+	newTestMachine(t, nil)
+
+	t.Run("should run poweroff as root", func(t *testing.T) {
+		var received *testSshRequest
+		address := startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 {
+			received = request
+			return 0
+		})
+
+		assert.NoError(t, poweroffCommand(address))
+		assert.Equal(t, DefaultSshUser, received.User)
+		assert.Equal(t, "poweroff", received.Command)
+	})
+
+	t.Run("should fail when poweroff is refused", func(t *testing.T) {
+		address := startTestSshServer(t, func(request *testSshRequest, channel ssh.Channel) uint32 {
+			return 1
+		})
+
+		assert.Error(t, poweroffCommand(address))
+	})
+}
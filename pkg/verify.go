@@ -0,0 +1,434 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/efortin/machina/utils"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/clearsign"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	checksumSuffix  = ".sha256"
+	maxChecksumSize = 16 * 1024 * 1024
+
+	Artifact_verified   = "ok"
+	Artifact_corrupted  = "corrupted"
+	Artifact_unverified = "unverified"
+
+	// unauthenticatedMarker starts the recorded checksum of an artifact verified against unsigned checksums
+	unauthenticatedMarker = "# unauthenticated"
+)
+
+// keyServerURL serves the pinned keys by fingerprint
+var keyServerURL = "https://keyserver.ubuntu.com/pks/lookup?op=get&options=mr&search=0x"
+
+// pinnedKeys are the fingerprints of the signing keys of the distributions which aren't bundled.
+// They're fetched from the key server at their first use and kept in the keyring directory.
+var pinnedKeys = map[string][]string{
+	// UEC Image Automatic Signing Key, it signs the SHA256SUMS of the cloud images
+	"ubuntu": {"D2EB44626FDDC30B513D5BB71A5D6C4C7DB87C81"},
+	// the primary keys of the Fedora releases, they sign the CHECKSUM files
+	"fedora": {
+		"E8F23996F23218640CB44CBE75CF5AC418B8E74C",
+		"115DF9AEF857853EE8445D0A0727707EA15B79CC",
+		"466CF2D8B60BC3057AA9453ED0622462E99D6AD1",
+	},
+}
+
+// bundledKeyring holds the signing keys of the distributions, named after their kind
+//
+//go:embed keyring
+var bundledKeyring embed.FS
+
+// Checksums is a list of "<hash> <name>" lines published along with the artifacts, like SHA256SUMS.
+// The list is authenticated by a detached signature, by being clearsigned, or by its checksum in a parent list.
+type Checksums struct {
+	URL string
+	// SignatureURL is the detached signature of the list
+	SignatureURL string
+	// Parent lists this list under Name
+	Parent *Checksums
+	Name   string
+}
+
+// ArtifactVerification is the state of a cached artifact against its recorded checksum
+type ArtifactVerification struct {
+	Path   string
+	Status string
+}
+
+// checksumVerifier checks the downloads of a distribution, the fetched lists are kept for its lifetime
+type checksumVerifier struct {
+	kind    string
+	keyring openpgp.EntityList
+	lists   map[string]*checksumList
+}
+
+// checksumList is a parsed checksums list, authenticated when it's signed by a trusted key
+type checksumList struct {
+	sums          map[string]string
+	authenticated bool
+}
+
+func newChecksumVerifier(kind string) (*checksumVerifier, error) {
+	keyring, err := loadKeyring(kind)
+	if err != nil {
+		return nil, err
+	}
+	return &checksumVerifier{kind: kind, keyring: keyring, lists: map[string]*checksumList{}}, nil
+}
+
+// loadKeyring reads the keys bundled for the distribution kind, the ones added to the keyring directory
+// of the working directory, as <kind>.gpg or <kind>.asc, and the pinned keys already fetched.
+func loadKeyring(kind string) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, name := range []string{kind + ".gpg", kind + ".asc", pinnedKeyringName(kind)} {
+		bundled, err := bundledKeyring.ReadFile("keyring/" + name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		added, err := ioutil.ReadFile(keyringDirectory() + "/" + name)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		for _, content := range [][]byte{bundled, added} {
+			if len(content) == 0 {
+				continue
+			}
+			var entities openpgp.EntityList
+			if strings.HasSuffix(name, ".asc") {
+				entities, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+			} else {
+				entities, err = openpgp.ReadKeyRing(bytes.NewReader(content))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid keyring %s: %v", name, err)
+			}
+			keyring = append(keyring, entities...)
+		}
+	}
+	return keyring, nil
+}
+
+func keyringDirectory() string {
+	return fmt.Sprintf("%s/keyring", GetWorkingDirectory())
+}
+
+func pinnedKeyringName(kind string) string {
+	return kind + ".pinned.gpg"
+}
+
+// fetchPinnedKeys adds the pinned keys of the distribution missing from the keyring, a key is only
+// trusted when its fingerprint is the pinned one. It returns the number of added keys.
+func (v *checksumVerifier) fetchPinnedKeys() (int, error) {
+	known := map[string]bool{}
+	for _, entity := range v.keyring {
+		known[strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:]))] = true
+	}
+	var fetched openpgp.EntityList
+	for _, fingerprint := range pinnedKeys[v.kind] {
+		if known[fingerprint] {
+			continue
+		}
+		content, err := fetchContent(keyServerURL + fingerprint)
+		if err != nil {
+			return 0, err
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+		if err != nil {
+			return 0, fmt.Errorf("invalid key %s: %v", fingerprint, err)
+		}
+		for _, entity := range entities {
+			if strings.ToUpper(hex.EncodeToString(entity.PrimaryKey.Fingerprint[:])) == fingerprint {
+				fetched = append(fetched, entity)
+			}
+		}
+	}
+	if len(fetched) == 0 {
+		return 0, nil
+	}
+	if err := DirectoryCreateIfAbsent(keyringDirectory()); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(keyringDirectory()+"/"+pinnedKeyringName(v.kind), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	for _, entity := range fetched {
+		if err = entity.Serialize(f); err != nil {
+			return 0, err
+		}
+	}
+	v.keyring = append(v.keyring, fetched...)
+	return len(fetched), nil
+}
+
+// verify checks the published file of the artifact against the checksums of the release.
+// It returns whether the checksums are authenticated, unsigned checksums only check the integrity.
+func (v *checksumVerifier) verify(artifact Artifact, published string) (authenticated bool, err error) {
+	if artifact.Checksums == nil {
+		return false, fmt.Errorf("%s has no checksums, it can't be verified", artifact.URL)
+	}
+	list, err := v.list(artifact.Checksums)
+	if err != nil {
+		return false, err
+	}
+	name := artifact.ChecksumName
+	if name == utils.Empty {
+		name = path.Base(artifact.URL)
+	}
+	expected, found := list.sums[name]
+	if !found {
+		return false, fmt.Errorf("%s isn't listed in %s", name, artifact.Checksums.URL)
+	}
+	actual, err := fileChecksum(published, expected)
+	if err != nil {
+		return false, err
+	}
+	if actual != expected {
+		return false, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", artifact.URL, expected, actual)
+	}
+	utils.Logger.Debugf("%s matches its checksum", artifact.URL)
+	return list.authenticated, nil
+}
+
+// list fetches, authenticates and parses the checksums list
+func (v *checksumVerifier) list(checksums *Checksums) (*checksumList, error) {
+	if list, found := v.lists[checksums.URL]; found {
+		return list, nil
+	}
+	content, err := fetchContent(checksums.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	authenticated := true
+	switch {
+	case checksums.SignatureURL != utils.Empty:
+		signature, err := fetchContent(checksums.SignatureURL)
+		if err != nil {
+			return nil, err
+		}
+		if err = v.checkSignature(checksums.URL, content, signature); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(bytes.TrimSpace(content), []byte("-----BEGIN PGP SIGNED MESSAGE-----")):
+		block, _ := clearsign.Decode(content)
+		if block == nil {
+			return nil, fmt.Errorf("invalid clearsigned checksums %s", checksums.URL)
+		}
+		if err = v.checkClearsigned(checksums.URL, content); err != nil {
+			return nil, err
+		}
+		content = block.Plaintext
+	case checksums.Parent != nil:
+		parent, err := v.list(checksums.Parent)
+		if err != nil {
+			return nil, err
+		}
+		expected, found := parent.sums[checksums.Name]
+		if !found {
+			return nil, fmt.Errorf("%s isn't listed in %s", checksums.Name, checksums.Parent.URL)
+		}
+		if actual := contentChecksum(content, expected); actual != expected {
+			return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", checksums.URL, expected, actual)
+		}
+		authenticated = parent.authenticated
+	default:
+		utils.Logger.Warnf("the checksums %s aren't signed, the downloads are only checked for integrity and reported unverified", checksums.URL)
+		authenticated = false
+	}
+
+	list := &checksumList{sums: parseChecksums(content), authenticated: authenticated}
+	v.lists[checksums.URL] = list
+	return list, nil
+}
+
+func (v *checksumVerifier) checkSignature(url string, content, signature []byte) error {
+	return v.checkTrusted(url, func() error {
+		_, err := openpgp.CheckArmoredDetachedSignature(v.keyring, bytes.NewReader(content), bytes.NewReader(signature))
+		if err != nil {
+			// the signature may not be armored
+			_, err = openpgp.CheckDetachedSignature(v.keyring, bytes.NewReader(content), bytes.NewReader(signature))
+		}
+		return err
+	})
+}
+
+func (v *checksumVerifier) checkClearsigned(url string, content []byte) error {
+	return v.checkTrusted(url, func() error {
+		// the signature is read by the check, the block is decoded for each one
+		block, _ := clearsign.Decode(content)
+		_, err := openpgp.CheckDetachedSignature(v.keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body)
+		return err
+	})
+}
+
+// checkTrusted runs the signature check, it runs again once the missing pinned keys of the distribution are fetched
+func (v *checksumVerifier) checkTrusted(url string, check func() error) error {
+	var err error
+	if len(v.keyring) > 0 {
+		if err = check(); err == nil {
+			return nil
+		}
+	}
+	added, fetchErr := v.fetchPinnedKeys()
+	if fetchErr != nil {
+		utils.Logger.Warnf("the pinned keys of %s can't be fetched: %v", v.kind, fetchErr)
+	}
+	if added > 0 {
+		err = check()
+	}
+	if len(v.keyring) == 0 {
+		return v.missingKey(url)
+	} else if err != nil {
+		return fmt.Errorf("invalid signature of %s: %v", url, err)
+	}
+	return nil
+}
+
+// missingKey refuses a signed list when no key of the distribution is trusted
+func (v *checksumVerifier) missingKey(url string) error {
+	return fmt.Errorf("no trusted key for %s to verify the signature of %s, add the signing key of the distribution to %s/%s.asc",
+		v.kind, url, keyringDirectory(), v.kind)
+}
+
+// parseChecksums reads the sha256sum (hash *name), apt Release (hash size name) and BSD (SHA256 (name) = hash) formats,
+// the longest hash of a name is kept.
+func parseChecksums(content []byte) map[string]string {
+	sums := map[string]string{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		var sum, name string
+		switch {
+		case len(fields) == 4 && fields[2] == "=":
+			sum, name = fields[3], strings.TrimSuffix(strings.TrimPrefix(fields[1], "("), ")")
+		case len(fields) >= 2:
+			sum, name = fields[0], fields[len(fields)-1]
+		default:
+			continue
+		}
+		if _, err := hex.DecodeString(sum); err != nil || (len(sum) != sha256.Size*2 && len(sum) != sha512.Size*2) {
+			continue
+		}
+		name = strings.TrimPrefix(strings.TrimPrefix(name, "*"), "./")
+		if len(sum) > len(sums[name]) {
+			sums[name] = strings.ToLower(sum)
+		}
+	}
+	return sums
+}
+
+// newHash returns the hash matching the length of the expected checksum
+func newHash(expected string) hash.Hash {
+	if len(expected) == sha512.Size*2 {
+		return sha512.New()
+	}
+	return sha256.New()
+}
+
+func contentChecksum(content []byte, expected string) string {
+	h := newHash(expected)
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func fileChecksum(filePath string, expected string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return utils.Empty, err
+	}
+	defer f.Close()
+	h := newHash(expected)
+	if _, err = io.Copy(h, f); err != nil {
+		return utils.Empty, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordChecksum writes the sha256 of the unpacked artifact at tmpPath next to its final path,
+// it's checked by VerifyImageCache. An artifact checked against unsigned checksums is recorded unauthenticated.
+func recordChecksum(tmpPath, finalPath string, authenticated bool) error {
+	sum, err := fileChecksum(tmpPath, utils.Empty)
+	if err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(finalPath))
+	if !authenticated {
+		line = unauthenticatedMarker + "\n" + line
+	}
+	return ioutil.WriteFile(finalPath+checksumSuffix, []byte(line), 0644)
+}
+
+// VerifyArtifact checks a cached artifact against the checksum recorded once it was verified,
+// an intact artifact whose checksums weren't signed is unverified.
+func VerifyArtifact(artifactPath string) (string, error) {
+	content, err := ioutil.ReadFile(artifactPath + checksumSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return Artifact_unverified, nil
+	} else if err != nil {
+		return utils.Empty, err
+	}
+	expected := parseChecksums(content)[filepath.Base(artifactPath)]
+	actual, err := fileChecksum(artifactPath, expected)
+	if err != nil {
+		return utils.Empty, err
+	}
+	if expected == utils.Empty || actual != expected {
+		return Artifact_corrupted, nil
+	}
+	if bytes.HasPrefix(content, []byte(unauthenticatedMarker)) {
+		return Artifact_unverified, nil
+	}
+	return Artifact_verified, nil
+}
+
+// VerifyImageCache checks every artifact of the downloaded distributions
+func VerifyImageCache() ([]ArtifactVerification, error) {
+	var verifications []ArtifactVerification
+	paths, err := filepath.Glob(baseImageDirectory() + "/*/*")
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, artifactPath := range paths {
+		if !isCachedArtifact(artifactPath) {
+			continue
+		}
+		status, err := VerifyArtifact(artifactPath)
+		if err != nil {
+			return nil, err
+		}
+		verifications = append(verifications, ArtifactVerification{Path: artifactPath, Status: status})
+	}
+	return verifications, nil
+}
+
+// isCachedArtifact excludes the checksums, the published archives and the files of interrupted downloads
+func isCachedArtifact(filePath string) bool {
+	info, err := os.Stat(filePath)
+	if err != nil || info.IsDir() {
+		return false
+	}
+	for _, suffix := range []string{checksumSuffix, ".download", partialSuffix, ".tmp", ".gz", ".xz", ".qcow2"} {
+		if strings.HasSuffix(filePath, suffix) {
+			return false
+		}
+	}
+	return true
+}
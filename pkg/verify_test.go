@@ -0,0 +1,231 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// newTestSigningKey creates a key trusted for the distribution kind
+func newTestSigningKey(t *testing.T, kind string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity("machina test", "", "test@machina.local", nil)
+	assert.NoError(t, err)
+	DirectoryCreateIfAbsent(keyringDirectory())
+	f, err := os.Create(keyringDirectory() + "/" + kind + ".asc")
+	assert.NoError(t, err)
+	defer f.Close()
+	w, _ := armor.Encode(f, openpgp.PublicKeyType, nil)
+	assert.NoError(t, entity.Serialize(w))
+	w.Close()
+	return entity
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func detachSign(t *testing.T, entity *openpgp.Entity, content string) string {
+	var signature bytes.Buffer
+	assert.NoError(t, openpgp.ArmoredDetachSign(&signature, entity, bytes.NewReader([]byte(content)), nil))
+	return signature.String()
+}
+
+func clearSign(t *testing.T, entity *openpgp.Entity, content string) string {
+	var signed bytes.Buffer
+	w, err := clearsign.Encode(&signed, entity.PrivateKey, nil)
+	assert.NoError(t, err)
+	w.Write([]byte(content))
+	w.Close()
+	return signed.String()
+}
+
+func serveFiles(t *testing.T, files map[string]string) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, found := files[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestChecksumVerifier(t *testing.T) {
+	newTestMachine(t, nil)
+	trusted := newTestSigningKey(t, "test")
+	untrusted, _ := openpgp.NewEntity("someone", "", "someone@example.com", nil)
+	sums := fmt.Sprintf("%s *kernel\n%s *other\n", sha256Hex("kernel"), sha256Hex("other"))
+
+	verifyDownload := func(t *testing.T, kind string, files map[string]string, checksums *Checksums) error {
+		files["/kernel"] = "kernel"
+		url := serveFiles(t, files)
+		checksums.URL = url + checksums.URL
+		if checksums.SignatureURL != "" {
+			checksums.SignatureURL = url + checksums.SignatureURL
+		}
+		if checksums.Parent != nil {
+			checksums.Parent.URL = url + checksums.Parent.URL
+		}
+		verifier, err := newChecksumVerifier(kind)
+		assert.NoError(t, err)
+		path := filepath.Join(t.TempDir(), "kernel")
+		return downloadArtifact(Artifact{URL: url + "/kernel", Path: path, Checksums: checksums}, verifier)
+	}
+
+	t.Run("should accept a file listed in signed checksums", func(t *testing.T) {
+		err := verifyDownload(t, "test", map[string]string{"/SHA256SUMS": sums, "/SHA256SUMS.gpg": detachSign(t, trusted, sums)},
+			&Checksums{URL: "/SHA256SUMS", SignatureURL: "/SHA256SUMS.gpg"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("should refuse checksums signed by an untrusted key", func(t *testing.T) {
+		err := verifyDownload(t, "test", map[string]string{"/SHA256SUMS": sums, "/SHA256SUMS.gpg": detachSign(t, untrusted, sums)},
+			&Checksums{URL: "/SHA256SUMS", SignatureURL: "/SHA256SUMS.gpg"})
+		assert.Error(t, err)
+	})
+
+	t.Run("should refuse a tampered file", func(t *testing.T) {
+		tampered := fmt.Sprintf("%s *kernel\n", sha256Hex("original kernel"))
+		err := verifyDownload(t, "test", map[string]string{"/SHA256SUMS": tampered, "/SHA256SUMS.gpg": detachSign(t, trusted, tampered)},
+			&Checksums{URL: "/SHA256SUMS", SignatureURL: "/SHA256SUMS.gpg"})
+		assert.Error(t, err)
+	})
+
+	t.Run("should refuse a file missing from the checksums", func(t *testing.T) {
+		other := fmt.Sprintf("%s *other\n", sha256Hex("other"))
+		err := verifyDownload(t, "test", map[string]string{"/SHA256SUMS": other, "/SHA256SUMS.gpg": detachSign(t, trusted, other)},
+			&Checksums{URL: "/SHA256SUMS", SignatureURL: "/SHA256SUMS.gpg"})
+		assert.Error(t, err)
+	})
+
+	t.Run("should accept clearsigned checksums", func(t *testing.T) {
+		err := verifyDownload(t, "test", map[string]string{"/CHECKSUM": clearSign(t, trusted, sums)}, &Checksums{URL: "/CHECKSUM"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("should follow the checksums listed in a signed release", func(t *testing.T) {
+		release := fmt.Sprintf("SHA256:\n %s %d images/SHA256SUMS\n", sha256Hex(sums), len(sums))
+		files := map[string]string{"/InRelease": clearSign(t, trusted, release), "/images/SHA256SUMS": sums}
+
+		err := verifyDownload(t, "test", files, &Checksums{URL: "/images/SHA256SUMS", Parent: &Checksums{URL: "/InRelease"}, Name: "images/SHA256SUMS"})
+		assert.NoError(t, err)
+	})
+
+	t.Run("should refuse signed checksums without trusted key", func(t *testing.T) {
+		err := verifyDownload(t, "unknown", map[string]string{"/SHA256SUMS": sums, "/SHA256SUMS.gpg": detachSign(t, untrusted, sums)},
+			&Checksums{URL: "/SHA256SUMS", SignatureURL: "/SHA256SUMS.gpg"})
+		assert.Error(t, err)
+	})
+
+	t.Run("should refuse clearsigned checksums without trusted key", func(t *testing.T) {
+		err := verifyDownload(t, "unknown", map[string]string{"/CHECKSUM": clearSign(t, untrusted, sums)}, &Checksums{URL: "/CHECKSUM"})
+		assert.Error(t, err)
+	})
+
+	t.Run("should report unverified a file listed in unsigned checksums", func(t *testing.T) {
+		files := map[string]string{"/kernel": "kernel", "/kernel.sha512": sums}
+		url := serveFiles(t, files)
+		verifier, _ := newChecksumVerifier("unknown")
+		path := filepath.Join(t.TempDir(), "kernel")
+
+		assert.NoError(t, downloadArtifact(Artifact{URL: url + "/kernel", Path: path, Checksums: &Checksums{URL: url + "/kernel.sha512"}}, verifier))
+		status, err := VerifyArtifact(path)
+		assert.NoError(t, err)
+		assert.Equal(t, Artifact_unverified, status)
+	})
+
+	t.Run("should fetch the pinned key of the distribution", func(t *testing.T) {
+		signer, _ := openpgp.NewEntity("pinned", "", "pinned@machina.local", nil)
+		fingerprint := strings.ToUpper(hex.EncodeToString(signer.PrimaryKey.Fingerprint[:]))
+		var key bytes.Buffer
+		w, _ := armor.Encode(&key, openpgp.PublicKeyType, nil)
+		assert.NoError(t, signer.Serialize(w))
+		w.Close()
+		keyServer := serveFiles(t, map[string]string{"/" + fingerprint: key.String(), "/" + strings.Repeat("0", 40): key.String()})
+		defer func(url string) { keyServerURL = url }(keyServerURL)
+		keyServerURL = keyServer + "/"
+		pinnedKeys["pinned"] = []string{fingerprint}
+		pinnedKeys["mismatch"] = []string{strings.Repeat("0", 40)}
+		defer delete(pinnedKeys, "pinned")
+		defer delete(pinnedKeys, "mismatch")
+		files := map[string]string{"/SHA256SUMS": sums, "/SHA256SUMS.gpg": detachSign(t, signer, sums)}
+
+		// the key served under another fingerprint isn't trusted
+		assert.Error(t, verifyDownload(t, "mismatch", files, &Checksums{URL: "/SHA256SUMS", SignatureURL: "/SHA256SUMS.gpg"}))
+		assert.NoError(t, verifyDownload(t, "pinned", files, &Checksums{URL: "/SHA256SUMS", SignatureURL: "/SHA256SUMS.gpg"}))
+		keyring, err := loadKeyring("pinned")
+		assert.NoError(t, err)
+		assert.Len(t, keyring, 1)
+	})
+
+	t.Run("should refuse an artifact without checksums", func(t *testing.T) {
+		url := serveFiles(t, map[string]string{"/kernel": "kernel"})
+		verifier, _ := newChecksumVerifier("test")
+		path := filepath.Join(t.TempDir(), "kernel")
+
+		assert.Error(t, downloadArtifact(Artifact{URL: url + "/kernel", Path: path}, verifier))
+		assert.NoFileExists(t, path)
+	})
+}
+
+func TestLoadKeyring(t *testing.T) {
+	newTestMachine(t, nil)
+
+	keyring, err := loadKeyring("debian")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, keyring)
+}
+
+func TestParseChecksums(t *testing.T) {
+	sum256 := sha256Hex("a")
+	content := fmt.Sprintf("%s *focal.img\n%s  ./netboot/linux\nSHA256 (Fedora.raw.xz) = %s\n %s 1234 main/SHA256SUMS\n"+
+		"d41d8cd98f00b204e9800998ecf8427e 12 short\n# comment\n", sum256, sum256, sum256, sum256)
+
+	assert.Equal(t, map[string]string{
+		"focal.img":       sum256,
+		"netboot/linux":   sum256,
+		"Fedora.raw.xz":   sum256,
+		"main/SHA256SUMS": sum256,
+	}, parseChecksums([]byte(content)))
+}
+
+func TestVerifyImageCache(t *testing.T) {
+	newTestMachine(t, nil)
+	directory := baseImageDirectory() + "/focal"
+	for _, name := range []string{"kernel", "image", "initrd", "legacy", "focal.tar.gz"} {
+		assert.NoError(t, os.WriteFile(directory+"/"+name, []byte(name), 0644))
+	}
+	assert.NoError(t, recordChecksum(directory+"/kernel", directory+"/kernel", true))
+	assert.NoError(t, recordChecksum(directory+"/image", directory+"/image", true))
+	assert.NoError(t, recordChecksum(directory+"/initrd", directory+"/initrd", false))
+	assert.NoError(t, os.WriteFile(directory+"/image", []byte("corrupted"), 0644))
+
+	verifications, err := VerifyImageCache()
+	assert.NoError(t, err)
+	statuses := map[string]string{}
+	for _, verification := range verifications {
+		statuses[filepath.Base(verification.Path)] = verification.Status
+	}
+	// the machine fixtures are unverified too
+	assert.Equal(t, Artifact_verified, statuses["kernel"])
+	assert.Equal(t, Artifact_corrupted, statuses["image"])
+	assert.Equal(t, Artifact_unverified, statuses["initrd"])
+	assert.Equal(t, Artifact_unverified, statuses["legacy"])
+	assert.NotContains(t, statuses, "focal.tar.gz")
+	assert.NotContains(t, statuses, "kernel"+checksumSuffix)
+}
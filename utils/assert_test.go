@@ -0,0 +1,14 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+// DeepEqual fails the test when expected and actual are not deeply equal
+func DeepEqual(t *testing.T, expected interface{}, actual interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
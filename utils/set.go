@@ -83,3 +83,8 @@ func (s *Set) UnmarshalYAML(unmarshal func(i interface{}) error) (err error) {
 	}
 	return err
 }
+
+// MarshalYAML writes the set as a sorted list
+func (s *Set) MarshalYAML() (interface{}, error) {
+	return s.List(), nil
+}
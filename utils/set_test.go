@@ -2,6 +2,7 @@ package utils
 
 import (
 	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
 	"testing"
 )
 
@@ -116,3 +117,21 @@ func TestSet_Contains(t *testing.T) {
 		assert.True(t, actual.Contains("a"), true)
 	})
 }
+
+func TestSet_YAML(t *testing.T) {
+	t.Run("should read a list or a comma separated string", func(t *testing.T) {
+		var fields struct {
+			List   Set `yaml:"list"`
+			String Set `yaml:"string"`
+		}
+		assert.NoError(t, yaml.Unmarshal([]byte("list: [b, a]\nstring: d,c\n"), &fields))
+		DeepEqual(t, []string{"a", "b"}, fields.List.List())
+		DeepEqual(t, []string{"c", "d"}, fields.String.List())
+	})
+
+	t.Run("should write a sorted list", func(t *testing.T) {
+		content, err := yaml.Marshal(map[string]*Set{"set": NewSetFromSlice("b", "a")})
+		assert.NoError(t, err)
+		assert.Equal(t, "set:\n    - a\n    - b\n", string(content))
+	})
+}